@@ -6,8 +6,13 @@ import (
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha256"
+	"crypto/x509"
 	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
 	"math/big"
+	"os"
 
 	"github.com/tv42/base58"
 
@@ -22,20 +27,31 @@ func (a *Account) Public() *ecdsa.PublicKey {
 	return &a.Key.PublicKey
 }
 
-func (a *Account) Address() ([]byte, error) {
+// PublicKeyBytes returns the serialized public key, which transactions
+// carry so their signature can be checked
+func (a *Account) PublicKeyBytes() ([]byte, error) {
 	pub := ecdsaPublicKey{X: a.Public().X, Y: a.Public().Y}
 
-	serialized, err := asn1.Marshal(pub)
+	return asn1.Marshal(pub)
+}
+
+func (a *Account) Address() ([]byte, error) {
+	serialized, err := a.PublicKeyBytes()
 	if err != nil {
 		return []byte{}, err
 	}
 
+	return addressOf(serialized), nil
+}
+
+// addressOf derives the address of a serialized public key
+func addressOf(serialized []byte) []byte {
 	hash := sha256.Sum256(serialized)
 	bytes := ripemd160.New().Sum(hash[:])
 
 	bigInt := new(big.Int).SetBytes(bytes)
 
-	return base58.EncodeBig([]byte{}, bigInt), nil
+	return base58.EncodeBig([]byte{}, bigInt)
 }
 
 type ecdsaPublicKey struct {
@@ -43,6 +59,25 @@ type ecdsaPublicKey struct {
 	Y *big.Int
 }
 
+// parsePublicKey decodes a serialized public key, which must be a point of
+// the curve accounts use
+func parsePublicKey(serialized []byte) (*ecdsa.PublicKey, error) {
+	var pub ecdsaPublicKey
+	rest, err := asn1.Unmarshal(serialized, &pub)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) > 0 {
+		return nil, errors.New("trailing data after public key")
+	}
+
+	curve := elliptic.P224()
+	if pub.X == nil || pub.Y == nil || !curve.IsOnCurve(pub.X, pub.Y) {
+		return nil, errors.New("invalid public key")
+	}
+	return &ecdsa.PublicKey{Curve: curve, X: pub.X, Y: pub.Y}, nil
+}
+
 func NewAccount() (*Account, error) {
 	key, err := ecdsa.GenerateKey(elliptic.P224(), rand.Reader)
 	if err != nil {
@@ -51,3 +86,55 @@ func NewAccount() (*Account, error) {
 
 	return &Account{key}, nil
 }
+
+// OpenAccount loads the account whose key is stored at path, or creates one
+// and stores its key there, so a node keeps its address across restarts
+func OpenAccount(path string) (*Account, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return createAccount(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no key found in account file")
+	}
+	key, err := x509.ParseECPrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	if key.Curve != elliptic.P224() {
+		return nil, errors.New("account key is not on the P-224 curve")
+	}
+	return &Account{key}, nil
+}
+
+// createAccount stores the key of a new account at path, readable by its
+// owner only
+func createAccount(path string) (*Account, error) {
+	account, err := NewAccount()
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(account.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := pem.Encode(f, &pem.Block{Type: "EC PRIVATE KEY", Bytes: der}); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return account, f.Close()
+}
@@ -1,6 +1,9 @@
 package main
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 
 	. "github.com/smartystreets/goconvey/convey"
@@ -26,4 +29,27 @@ func TestAccount(t *testing.T) {
 			So(string(address[:]), ShouldNotBeNil)
 		})
 	})
+
+	Convey("an account stored in a file", t, func() {
+		dir, err := ioutil.TempDir("", "bcdis-account")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "account.pem")
+
+		a, err := OpenAccount(path)
+		So(err, ShouldBeNil)
+		info, err := os.Stat(path)
+		So(err, ShouldBeNil)
+		So(info.Mode().Perm(), ShouldEqual, os.FileMode(0600))
+
+		Convey("keeps its address once loaded again", func() {
+			loaded, err := OpenAccount(path)
+			So(err, ShouldBeNil)
+			address, err := a.Address()
+			So(err, ShouldBeNil)
+			loadedAddress, err := loaded.Address()
+			So(err, ShouldBeNil)
+			So(string(loadedAddress), ShouldEqual, string(address))
+		})
+	})
 }
@@ -0,0 +1,121 @@
+// ownership of keys
+//
+// The first account writing a key owns it. Keys of the form "ns:rest" are
+// owned by namespace instead: the first account writing any key starting
+// with "ns:" owns all of them, written "ns:*". An owner can grant other
+// accounts the right to write its keys, and revoke it. Owners and grants
+// are kept in the state under reserved keys, so every node checks them
+// the same way while applying a block.
+package main
+
+import (
+	"errors"
+	"strings"
+)
+
+var errNoPerm = errors.New("NOPERM this user has no permissions to access one of the keys used as arguments")
+
+// keyScope returns what is owned when key is written: its namespace if it
+// has one, itself otherwise
+func keyScope(key string) string {
+	if i := strings.Index(key, ":"); i >= 0 {
+		return key[:i+1] + "*"
+	}
+	return key
+}
+
+func ownerKey(scope string) string {
+	return reservedPrefix + "owner:" + scope
+}
+
+// addresses never contain a zero byte, so grant keys are unambiguous
+func grantKey(scope, address string) string {
+	return reservedPrefix + "grant:" + scope + "\x00" + address
+}
+
+// keyOwner returns the owner of a scope, if any
+func keyOwner(state *State, scope string) (string, bool) {
+	v, ok := state.Get(ownerKey(scope))
+	if !ok {
+		return "", false
+	}
+	owner, ok := v.Val.(string)
+	return owner, ok
+}
+
+// canWrite reports whether an account may write the keys of a scope
+func canWrite(state *State, scope, address string) bool {
+	owner, ok := keyOwner(state, scope)
+	if !ok || owner == address {
+		return true
+	}
+	return state.Has(grantKey(scope, address))
+}
+
+// applyCommand runs a command sent by an account on a state. Reserved keys
+// and keys the account may not write are refused, and the account becomes
+// the owner of the keys it wrote without one, the keys it only read or left
+// missing are not claimed. The state is left untouched on failure.
+func applyCommand(state *State, cmd Command, from string) (interface{}, error) {
+	if cmd.OP == EXEC {
+		return cmd.executeExec(state, func(c Command, state *State) (interface{}, error) {
+			return applyCommand(state, c, from)
+		})
+	}
+
+	for _, key := range cmd.Keys() {
+		if strings.HasPrefix(key, reservedPrefix) {
+			return nil, errReservedKey
+		}
+	}
+	if cmd.ReadOnly() {
+		return cmd.Execute(state)
+	}
+
+	written := cmd.writeKeys()
+	for _, key := range written {
+		if !canWrite(state, keyScope(key), from) {
+			return nil, errNoPerm
+		}
+	}
+	ret, err := cmd.Execute(state)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, key := range written {
+		if !state.Has(key) {
+			continue
+		}
+		scope := keyScope(key)
+		if _, ok := keyOwner(state, scope); !ok {
+			state.Set(ownerKey(scope), &Value{Val: from})
+		}
+	}
+	return ret, nil
+}
+
+// setGrant grants or revokes the right of an account to write the keys in
+// the scope of key. Only the owner of the scope may change its grants, the
+// first account changing the grants of a scope owns it.
+func setGrant(state *State, key, from, address string, granted bool) error {
+	scope := keyScope(key)
+	owner, ok := keyOwner(state, scope)
+	if ok && owner != from {
+		return errNoPerm
+	}
+	if address == "" || strings.Contains(address, "\x00") {
+		return errors.New("invalid address")
+	}
+
+	if !ok {
+		state.Set(ownerKey(scope), &Value{Val: from})
+	}
+
+	if granted {
+		state.Set(grantKey(scope, address), &Value{Val: "1"})
+	} else {
+		state.Delete(grantKey(scope, address))
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestACL(t *testing.T) {
+	Convey("Keys written through transactions", t, func() {
+		state := NewState()
+		owner, err := NewAccount()
+		So(err, ShouldBeNil)
+		other, err := NewAccount()
+		So(err, ShouldBeNil)
+		otherAddress, err := other.Address()
+		So(err, ShouldBeNil)
+
+		apply := func(account *Account, cmd Command) (interface{}, error) {
+			tx, err := NewAccountTransaction(account, cmd)
+			if err != nil {
+				return nil, err
+			}
+			tx.Header.Sequence = accountSequence(state, tx.Header.From)
+			ret, err := applyTransaction(state, tx, time.Now())
+			if failed, ok := ret.(commandError); ok {
+				return nil, failed
+			}
+			return ret, err
+		}
+
+		_, err = apply(owner, NewCommand(SET, "foo", "1"))
+		So(err, ShouldBeNil)
+		_, err = apply(owner, NewCommand(SET, "user:1", "alice"))
+		So(err, ShouldBeNil)
+
+		Convey("belong to their first writer", func() {
+			_, err := apply(owner, NewCommand(INCR, "foo"))
+			So(err, ShouldBeNil)
+			So(valueOf(state, "foo").Val, ShouldEqual, "2")
+
+			_, err = apply(other, NewCommand(SET, "foo", "3"))
+			So(err, ShouldResemble, failedWith(errNoPerm))
+			_, err = apply(other, NewCommand(EXPIRE, "foo", "10"))
+			So(err, ShouldResemble, failedWith(errNoPerm))
+			So(valueOf(state, "foo").Val, ShouldEqual, "2")
+			So(valueOf(state, "foo").WillExpire, ShouldBeFalse)
+		})
+
+		Convey("can still be read by anyone", func() {
+			ret, err := applyCommand(state, NewCommand(GET, "foo"), string(otherAddress))
+			So(err, ShouldBeNil)
+			So(ret, ShouldEqual, "1")
+		})
+
+		Convey("can be read by writes of others to their own keys", func() {
+			_, err := apply(owner, NewCommand(SADD, "set", "a", "b"))
+			So(err, ShouldBeNil)
+			ret, err := apply(other, NewCommand(SINTERSTORE, "copy", "set"))
+			So(err, ShouldBeNil)
+			So(ret, ShouldEqual, int64(2))
+
+			ownerAddress, err := owner.Address()
+			So(err, ShouldBeNil)
+			setOwner, _ := keyOwner(state, "set")
+			So(setOwner, ShouldEqual, string(ownerAddress))
+			copyOwner, _ := keyOwner(state, "copy")
+			So(copyOwner, ShouldEqual, string(otherAddress))
+
+			_, err = apply(other, NewCommand(SINTERSTORE, "set", "copy"))
+			So(err, ShouldResemble, failedWith(errNoPerm))
+		})
+
+		Convey("are not claimed when left missing", func() {
+			_, err := apply(other, NewCommand(DEL, "missing"))
+			So(err, ShouldBeNil)
+			_, ok := keyOwner(state, "missing")
+			So(ok, ShouldBeFalse)
+			_, err = apply(owner, NewCommand(SET, "missing", "1"))
+			So(err, ShouldBeNil)
+		})
+
+		Convey("in a namespace belong to the first writer of the namespace", func() {
+			_, err := apply(owner, NewCommand(SET, "user:2", "bob"))
+			So(err, ShouldBeNil)
+			_, err = apply(other, NewCommand(SET, "user:3", "carol"))
+			So(err, ShouldResemble, failedWith(errNoPerm))
+
+			_, err = apply(other, NewCommand(SET, "other:1", "carol"))
+			So(err, ShouldBeNil)
+			_, err = apply(owner, NewCommand(SET, "other:2", "dave"))
+			So(err, ShouldResemble, failedWith(errNoPerm))
+		})
+
+		Convey("can be written by accounts granted by the owner", func() {
+			_, err := apply(owner, NewCommand(GRANT, "user:*", string(otherAddress)))
+			So(err, ShouldBeNil)
+			_, err = apply(other, NewCommand(SET, "user:3", "carol"))
+			So(err, ShouldBeNil)
+			So(valueOf(state, "user:3").Val, ShouldEqual, "carol")
+
+			Convey("who can't grant others", func() {
+				third, err := NewAccount()
+				So(err, ShouldBeNil)
+				thirdAddress, err := third.Address()
+				So(err, ShouldBeNil)
+				_, err = apply(other, NewCommand(GRANT, "user:*", string(thirdAddress)))
+				So(err, ShouldResemble, failedWith(errNoPerm))
+			})
+
+			Convey("until revoked", func() {
+				_, err := apply(owner, NewCommand(REVOKE, "user:1", string(otherAddress)))
+				So(err, ShouldBeNil)
+				_, err = apply(other, NewCommand(SET, "user:3", "eve"))
+				So(err, ShouldResemble, failedWith(errNoPerm))
+				So(valueOf(state, "user:3").Val, ShouldEqual, "carol")
+			})
+		})
+
+		Convey("can't have their access changed by others", func() {
+			_, err := apply(other, NewCommand(GRANT, "foo", string(otherAddress)))
+			So(err, ShouldResemble, failedWith(errNoPerm))
+			_, err = apply(other, NewCommand(SET, "foo", "3"))
+			So(err, ShouldResemble, failedWith(errNoPerm))
+		})
+
+		Convey("keep the error of transactions writing them without permission", func() {
+			genesis, err := NewGenesisBlock()
+			So(err, ShouldBeNil)
+			first, err := newTestTransaction(NewCommand(SET, "foo", "1"))
+			So(err, ShouldBeNil)
+			second, err := newTestTransaction(NewCommand(SET, "foo", "2"))
+			So(err, ShouldBeNil)
+
+			b, err := NewBlock(genesis)
+			So(err, ShouldBeNil)
+			b.Transactions = []*Transaction{first, second}
+			So(b.HashTransactions(), ShouldBeNil)
+			So(b.UpdateState(), ShouldBeNil)
+			So(Work(b), ShouldBeNil)
+			So(b.Verify(), ShouldBeNil)
+
+			So(valueOf(b.State, "foo").Val, ShouldEqual, "1")
+			hash, err := second.ReadableHash()
+			So(err, ShouldBeNil)
+			So(valueOf(b.State, resultKey(string(hash))).Val, ShouldResemble, failedWith(errNoPerm))
+			So(accountSequence(b.State, second.Header.From), ShouldEqual, 1)
+		})
+	})
+}
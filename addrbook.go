@@ -0,0 +1,191 @@
+// addresses of known nodes, persisted between restarts
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const maxKnownAddresses = 2000
+
+type knownAddress struct {
+	Addr        string
+	LastSeen    time.Time
+	BannedUntil time.Time
+}
+
+// AddrBook keeps the listening addresses of other nodes along with the last
+// time they were seen and whether they are banned
+type AddrBook struct {
+	path string
+
+	mu    sync.Mutex
+	addrs map[string]*knownAddress
+}
+
+// OpenAddrBook loads an address book from path. An empty path keeps the
+// book in memory only.
+func OpenAddrBook(path string) (*AddrBook, error) {
+	book := newAddrBook(path)
+	if path == "" {
+		return book, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return book, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var addrs []*knownAddress
+	if err := json.Unmarshal(data, &addrs); err != nil {
+		return nil, err
+	}
+	for _, a := range addrs {
+		book.addrs[a.Addr] = a
+	}
+	return book, nil
+}
+
+func newAddrBook(path string) *AddrBook {
+	return &AddrBook{
+		path:  path,
+		addrs: make(map[string]*knownAddress),
+	}
+}
+
+// Add records an address without marking it as seen
+func (b *AddrBook) Add(addr string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.add(addr)
+}
+
+func (b *AddrBook) add(addr string) *knownAddress {
+	if a, ok := b.addrs[addr]; ok {
+		return a
+	}
+	if len(b.addrs) >= maxKnownAddresses {
+		b.evict()
+	}
+
+	a := &knownAddress{Addr: addr}
+	b.addrs[addr] = a
+	return a
+}
+
+// evict drops the address seen least recently which is not banned
+func (b *AddrBook) evict() {
+	var oldest *knownAddress
+	for _, a := range b.addrs {
+		if a.BannedUntil.After(time.Now()) {
+			continue
+		}
+		if oldest == nil || a.LastSeen.Before(oldest.LastSeen) {
+			oldest = a
+		}
+	}
+	if oldest != nil {
+		delete(b.addrs, oldest.Addr)
+	}
+}
+
+// MarkSeen records that a node was reachable at addr
+func (b *AddrBook) MarkSeen(addr string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.add(addr).LastSeen = time.Now()
+}
+
+func (b *AddrBook) Remove(addr string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.addrs, addr)
+}
+
+func (b *AddrBook) Ban(addr string, duration time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.add(addr).BannedUntil = time.Now().Add(duration)
+}
+
+func (b *AddrBook) IsBanned(addr string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	a, ok := b.addrs[addr]
+	return ok && a.BannedUntil.After(time.Now())
+}
+
+// LastSeen returns when a node was last reachable at addr
+func (b *AddrBook) LastSeen(addr string) (time.Time, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	a, ok := b.addrs[addr]
+	if !ok {
+		return time.Time{}, false
+	}
+	return a.LastSeen, true
+}
+
+// Addresses returns up to max addresses which are not banned, the most
+// recently seen first
+func (b *AddrBook) Addresses(max int) []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	known := make([]*knownAddress, 0, len(b.addrs))
+	for _, a := range b.addrs {
+		if !a.BannedUntil.After(time.Now()) {
+			known = append(known, a)
+		}
+	}
+	sort.Slice(known, func(i, j int) bool {
+		if known[i].LastSeen.Equal(known[j].LastSeen) {
+			return known[i].Addr < known[j].Addr
+		}
+		return known[i].LastSeen.After(known[j].LastSeen)
+	})
+	if len(known) > max {
+		known = known[:max]
+	}
+
+	addrs := make([]string, len(known))
+	for i, a := range known {
+		addrs[i] = a.Addr
+	}
+	return addrs
+}
+
+// Save writes the book to its path
+func (b *AddrBook) Save() error {
+	if b.path == "" {
+		return nil
+	}
+
+	b.mu.Lock()
+	addrs := make([]*knownAddress, 0, len(b.addrs))
+	for _, a := range b.addrs {
+		copied := *a
+		addrs = append(addrs, &copied)
+	}
+	b.mu.Unlock()
+
+	sort.Slice(addrs, func(i, j int) bool { return addrs[i].Addr < addrs[j].Addr })
+	data, err := json.Marshal(addrs)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(b.path, data)
+}
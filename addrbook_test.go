@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestAddrBook(t *testing.T) {
+	Convey("An address book", t, func() {
+		dir, err := ioutil.TempDir("", "bcdis-addrbook")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "peers.json")
+
+		book, err := OpenAddrBook(path)
+		So(err, ShouldBeNil)
+
+		Convey("returns the most recently seen addresses first", func() {
+			book.Add("10.0.0.1:7379")
+			book.MarkSeen("10.0.0.2:7379")
+			book.MarkSeen("10.0.0.3:7379")
+
+			So(book.Addresses(10), ShouldResemble, []string{"10.0.0.3:7379", "10.0.0.2:7379", "10.0.0.1:7379"})
+			So(book.Addresses(1), ShouldResemble, []string{"10.0.0.3:7379"})
+		})
+
+		Convey("leaves out banned addresses", func() {
+			book.MarkSeen("10.0.0.1:7379")
+			book.Ban("10.0.0.2:7379", time.Hour)
+			book.Ban("10.0.0.3:7379", -time.Second)
+
+			So(book.IsBanned("10.0.0.2:7379"), ShouldBeTrue)
+			So(book.IsBanned("10.0.0.3:7379"), ShouldBeFalse)
+			So(book.Addresses(10), ShouldResemble, []string{"10.0.0.1:7379", "10.0.0.3:7379"})
+		})
+
+		Convey("is persisted with last seen times and bans", func() {
+			book.MarkSeen("10.0.0.1:7379")
+			book.Ban("10.0.0.2:7379", time.Hour)
+			seen, ok := book.LastSeen("10.0.0.1:7379")
+			So(ok, ShouldBeTrue)
+			So(book.Save(), ShouldBeNil)
+
+			loaded, err := OpenAddrBook(path)
+			So(err, ShouldBeNil)
+			loadedSeen, ok := loaded.LastSeen("10.0.0.1:7379")
+			So(ok, ShouldBeTrue)
+			So(loadedSeen.Equal(seen), ShouldBeTrue)
+			So(loaded.IsBanned("10.0.0.2:7379"), ShouldBeTrue)
+		})
+
+		Convey("evicts the least recently seen address when full", func() {
+			book.MarkSeen("10.0.0.1:7379")
+			for i := 0; i < maxKnownAddresses; i++ {
+				book.Add(fmt.Sprintf("10.1.%d.%d:7379", i/256, i%256))
+			}
+
+			_, ok := book.LastSeen("10.0.0.1:7379")
+			So(ok, ShouldBeTrue)
+			So(len(book.Addresses(2*maxKnownAddresses)), ShouldEqual, maxKnownAddresses)
+		})
+	})
+}
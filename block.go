@@ -1,11 +1,13 @@
 package main
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math/big"
 	"time"
 )
 
@@ -13,25 +15,84 @@ type Block struct {
 	Header       BlockHeader
 	Transactions []*Transaction
 	signature    []byte
-	State        State
+	State        *State
 	Previous     *Block
+	trie         *Trie
+	expiring     *expiryIndex
+	height       int
 }
 
 type BlockHeader struct {
-	Prev     [32]byte
-	RootHash [32]byte // TODO: root of merkel tree
-	Time     time.Time
-	Nonce    uint64
+	Prev      [32]byte
+	RootHash  [32]byte // merkle root of the transactions
+	StateRoot [32]byte // root of the state trie after applying the transactions
+	Time      time.Time
+	Bits      uint32 // target of the proof of work in compact form
+	Nonce     uint64
 }
 
-type State map[string]*Value
-
 type Value struct {
 	Val        interface{}
 	Expire     time.Time
 	WillExpire bool
 }
 
+// encode serializes a value deterministically to be stored in the state trie
+func (v *Value) encode() ([]byte, error) {
+	var expire int64
+	if v.WillExpire {
+		expire = v.Expire.UnixNano()
+	}
+
+	return json.Marshal(struct {
+		Val    interface{}
+		Expire int64
+	}{v.Val, expire})
+}
+
+// Type names the kind of value held, as reported by redis
+func (v *Value) Type() string {
+	switch v.Val.(type) {
+	case List:
+		return "list"
+	case Hash:
+		return "hash"
+	case Set:
+		return "set"
+	case ZSet:
+		return "zset"
+	}
+	return "string"
+}
+
+// clone copies a value along with the list, hash or set it holds
+func (v *Value) clone() *Value {
+	copied := *v
+	switch val := v.Val.(type) {
+	case List:
+		copied.Val = append(List{}, val...)
+	case Hash:
+		h := make(Hash, len(val))
+		for field, v := range val {
+			h[field] = v
+		}
+		copied.Val = h
+	case Set:
+		s := make(Set, len(val))
+		for member := range val {
+			s[member] = struct{}{}
+		}
+		copied.Val = s
+	case ZSet:
+		z := make(ZSet, len(val))
+		for member, score := range val {
+			z[member] = score
+		}
+		copied.Val = z
+	}
+	return &copied
+}
+
 func (v *Value) UpdateVal(val interface{}) {
 	v.Val = val
 }
@@ -42,15 +103,51 @@ func (v *Value) UpdateExpire(expire time.Time) {
 }
 
 func (b *Block) Hash() ([32]byte, error) {
-	data, err := json.Marshal(b.Header)
+	return b.Header.Hash()
+}
+
+func (b *Block) NextTry() {
+	b.Header.NextTry()
+}
+
+func (b *Block) HashWithNonce(nonce uint64) ([32]byte, error) {
+	return b.Header.HashWithNonce(nonce)
+}
+
+func (b *Block) SetNonce(nonce uint64) {
+	b.Header.Nonce = nonce
+}
+
+func (b *Block) Target() *big.Int {
+	return b.Header.Target()
+}
+
+// a header is workable on its own, so the proof of work of a block can be
+// checked before its transactions are downloaded
+func (h *BlockHeader) Hash() ([32]byte, error) {
+	data, err := json.Marshal(h)
 	if err != nil {
 		return [32]byte{}, err
 	}
 	return sha256.Sum256(data), nil
 }
 
-func (b *Block) NextTry() {
-	b.Header.Nonce++
+func (h *BlockHeader) NextTry() {
+	h.Nonce++
+}
+
+func (h *BlockHeader) HashWithNonce(nonce uint64) ([32]byte, error) {
+	header := *h
+	header.Nonce = nonce
+	return header.Hash()
+}
+
+func (h *BlockHeader) SetNonce(nonce uint64) {
+	h.Nonce = nonce
+}
+
+func (h *BlockHeader) Target() *big.Int {
+	return compactToBig(h.Bits)
 }
 
 func (b *Block) SignWith(signature []byte) error {
@@ -69,12 +166,7 @@ func (b *Block) Signature() ([]byte, error) {
 
 // merkle root
 func (b *Block) HashTransactions() error {
-	if len(b.Transactions) < 2 || !isPowerOf2(len(b.Transactions)) {
-		return errors.New("block can only contain 2^n transactions and n can't be 0")
-	}
-
-	length := len(b.Transactions)
-	rootHash, err := merkleHash(b.Transactions[0:length/2], b.Transactions[length/2:length])
+	rootHash, err := merkleRoot(b.Transactions)
 	if err != nil {
 		return err
 	}
@@ -83,6 +175,12 @@ func (b *Block) HashTransactions() error {
 }
 
 func (b *Block) Verify() error {
+	if err := b.checkTime(); err != nil {
+		return err
+	}
+	if err := b.checkBits(); err != nil {
+		return err
+	}
 	reached, err := reachThreshold(b)
 	if err != nil {
 		return err
@@ -95,16 +193,51 @@ func (b *Block) Verify() error {
 		return fmt.Errorf("Invalid Proof of work on block %s", readableHash(hash))
 	}
 
-	return b.VerifyTransactions()
+	if err := b.VerifyTransactions(); err != nil {
+		return err
+	}
+	if err := b.VerifySignatures(); err != nil {
+		return err
+	}
+
+	return b.VerifyState()
 }
 
-func (b *Block) VerifyTransactions() error {
-	if len(b.Transactions) < 2 || !isPowerOf2(len(b.Transactions)) {
-		return errors.New("block can only contain 2^n transactions and n can't be 0")
+// checkTime checks a block is not older than its parent, nor too far ahead
+// of the clock of the node. Expire times are compared with block times, so
+// they can't go backward.
+func (b *Block) checkTime() error {
+	if b.Previous != nil && b.Header.Time.Before(b.Previous.Header.Time) {
+		return errors.New("Block time before the time of its parent")
+	}
+	if b.Header.Time.After(time.Now().Add(maxFutureBlockTime)) {
+		return errFutureBlock
+	}
+	return nil
+}
+
+// VerifyState replays the transactions on top of the previous state and
+// checks the result against the state root in the header. The block keeps
+// the state once checked, so it is never replayed twice.
+func (b *Block) VerifyState() error {
+	state, expiring, err := b.applyTransactions()
+	if err != nil {
+		return err
+	}
+	trie, err := b.commitState(state)
+	if err != nil {
+		return err
+	}
+	if trie.Hash() != b.Header.StateRoot {
+		return errors.New("State root mismatch")
 	}
 
-	length := len(b.Transactions)
-	rootHash, err := merkleHash(b.Transactions[0:length/2], b.Transactions[length/2:length])
+	b.setState(state, trie, expiring)
+	return nil
+}
+
+func (b *Block) VerifyTransactions() error {
+	rootHash, err := merkleRoot(b.Transactions)
 	if err != nil {
 		return err
 	}
@@ -112,10 +245,12 @@ func (b *Block) VerifyTransactions() error {
 		return errors.New("Verification failed")
 	}
 
+	// transactions are checked against the transaction policy, not the
+	// target of the block
 	for _, tx := range b.Transactions {
 		hash, err := tx.ReadableHash()
 		if err != nil {
-
+			return err
 		}
 		reached, err := reachThreshold(tx)
 		if err != nil {
@@ -128,44 +263,122 @@ func (b *Block) VerifyTransactions() error {
 	return nil
 }
 
+// VerifySignatures checks every transaction is signed by its sender
+func (b *Block) VerifySignatures() error {
+	for _, tx := range b.Transactions {
+		if err := tx.VerifySignature(); err != nil {
+			hash, herr := tx.ReadableHash()
+			if herr != nil {
+				return herr
+			}
+			return fmt.Errorf("Invalid signature on transaction %s: %v", hash, err)
+		}
+	}
+	return nil
+}
+
+// UpdateState applies the transactions on top of the previous state and
+// commits the new state root into the header
 func (b *Block) UpdateState() error {
-	var state State
-	if b.Previous == nil {
-		state = State{}
-	} else {
-		state = cloneState(b.Previous.State)
+	state, expiring, err := b.applyTransactions()
+	if err != nil {
+		return err
+	}
+	trie, err := b.commitState(state)
+	if err != nil {
+		return err
+	}
+
+	b.Header.StateRoot = trie.Hash()
+	b.setState(state, trie, expiring)
+	return nil
+}
+
+// setState publishes the state computed for a block
+func (b *Block) setState(state *State, trie *Trie, expiring *expiryIndex) {
+	state.freeze()
+	b.State = state
+	b.trie = trie
+	b.expiring = expiring
+	if b.Previous != nil {
+		b.height = b.Previous.height + 1
 	}
+}
+
+// StateProof returns a proof of the value of key against the state root
+func (b *Block) StateProof(key string) [][]byte {
+	if b.trie == nil {
+		return [][]byte{}
+	}
+	return b.trie.Prove([]byte(key))
+}
 
+// applyTransactions returns the state after the transactions of the block,
+// without the keys expired at the time of the block, and its expiry index
+func (b *Block) applyTransactions() (*State, *expiryIndex, error) {
+	parent := NewState()
+	var expiring *expiryIndex
+	if b.Previous != nil && b.Previous.State != nil {
+		parent = b.Previous.State
+		expiring = b.Previous.expiring
+	}
+	state := parent.Snapshot()
+	expiring = expiring.fork()
+
+	// only the keys of a command may have got an expire time
+	written := make(map[string]bool)
 	for _, tx := range b.Transactions {
-		cmd, err := tx.Command()
+		ret, err := applyTransaction(state, tx, b.Header.Time)
 		if err != nil {
-			return err
+			return nil, nil, err
 		}
-
-		// TODO: handle return values from transaction (set to another key?)
-		ret, err := cmd.Execute(state)
-		if err != nil {
-			return err
+		if cmd, err := tx.Command(); err == nil {
+			for _, key := range cmd.Keys() {
+				written[key] = true
+			}
 		}
 
-		retKey, err := tx.ReadableHash()
+		hash, err := tx.ReadableHash()
 		if err != nil {
-			return err
+			return nil, nil, err
 		}
-		state[string(retKey)+":ret"] = &Value{Val: ret}
+		state.Set(resultKey(string(hash)), &Value{Val: resultValue(ret)})
 	}
 
-	// expire expired values
-	for k, v := range state {
-		if v.WillExpire && time.Now().After(v.Expire) {
-			delete(state, k)
-		}
+	expiring.track(parent, state, written)
+	expiring.expire(state, b.Header.Time)
+	return state, expiring, nil
+}
+
+// commitState builds the trie of a state from the trie of the previous
+// block, sharing the nodes of unchanged keys
+func (b *Block) commitState(state *State) (*Trie, error) {
+	trie := NewTrie()
+	keys := state.Keys()
+	if b.Previous != nil && b.Previous.trie != nil {
+		// the state is a snapshot of the previous one, only the keys
+		// changed since differ from its trie
+		trie = b.Previous.trie
+		keys = state.Changed()
 	}
 
-	// TODO: hash states in blockchain with patricia tree
-	b.State = state
+	for _, k := range keys {
+		v, ok := state.Get(k)
+		if !ok {
+			trie = trie.Delete([]byte(k))
+			continue
+		}
+		encoded, err := v.encode()
+		if err != nil {
+			return nil, err
+		}
+		if old, ok := trie.Get([]byte(k)); ok && bytes.Equal(old, encoded) {
+			continue
+		}
+		trie = trie.Put([]byte(k), encoded)
+	}
 
-	return nil
+	return trie, nil
 }
 
 func NewBlock(previous *Block) (*Block, error) {
@@ -177,55 +390,38 @@ func NewBlock(previous *Block) (*Block, error) {
 			return nil, err
 		}
 	}
-	return &Block{
+	b := &Block{
 		Transactions: make([]*Transaction, 0),
 		Previous:     previous,
 		Header: BlockHeader{
 			Time: time.Now(),
 			Prev: prevHash,
+			Bits: nextBits(previous),
 		},
-	}, nil
-}
-
-func isPowerOf2(n int) bool {
-	return ((n & (n - 1)) == 0)
-}
-
-func merkleHash(left []*Transaction, right []*Transaction) ([32]byte, error) {
-	if len(left) == 1 && len(right) == 1 {
-		leftHash, err := left[0].Hash()
-		if err != nil {
-			return [32]byte{}, err
-		}
-		rightHash, err := right[0].Hash()
-		if err != nil {
-			return [32]byte{}, err
+	}
+	if previous != nil {
+		b.height = previous.height + 1
+		// the clock of the node may be behind the one of the parent miner
+		if b.Header.Time.Before(previous.Header.Time) {
+			b.Header.Time = previous.Header.Time
 		}
-		combine := []byte{}
-		combine = append(combine, leftHash[:]...)
-		combine = append(combine, rightHash[:]...)
-		return sha256.Sum256(combine), nil
 	}
+	return b, nil
+}
 
-	combine := []byte{}
-	leftMerkleHash, err := merkleHash(left[0:len(left)/2], left[len(left)/2:len(left)])
+// every node has to start from the same genesis block, so it has a fixed
+// time and no transaction
+var genesisTime = time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func NewGenesisBlock() (*Block, error) {
+	b, err := NewBlock(nil)
 	if err != nil {
-		return [32]byte{}, err
+		return nil, err
 	}
-	rightMerkleHash, err := merkleHash(right[0:len(right)/2], right[len(right)/2:len(right)])
-	if err != nil {
-		return [32]byte{}, err
-	}
-	combine = append(combine, leftMerkleHash[:]...)
-	combine = append(combine, rightMerkleHash[:]...)
-	return sha256.Sum256(combine), nil
-}
+	b.Header.Time = genesisTime
 
-func cloneState(state State) State {
-	newState := State{}
-	for k, v := range state {
-		newState[k] = v
+	if err := b.UpdateState(); err != nil {
+		return nil, err
 	}
-
-	return newState
+	return b, nil
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"testing"
 	"time"
 
@@ -92,25 +93,53 @@ func TestBlock(t *testing.T) {
 				})
 			})
 
-			Convey(name+" with no transaction can't be verified", func() {
-				So(b.HashTransactions(), ShouldNotBeNil)
-				So(b.VerifyTransactions(), ShouldNotBeNil)
+			Convey(name+" with no transaction has an empty merkle root", func() {
+				So(b.HashTransactions(), ShouldBeNil)
+				So(b.Header.RootHash, ShouldEqual, [32]byte{})
+				So(b.VerifyTransactions(), ShouldBeNil)
 			})
 
 			Convey(name+" can add transactions into block", func() {
-				tx := NewTransaction("alice", "bob", "payload")
-				// find valid proof of work
-				So(Work(tx), ShouldBeNil)
+				tx, err := newTestTransaction(NewCommand(SET, "bob", "payload"))
+				So(err, ShouldBeNil)
 				b.Transactions = append(b.Transactions, tx)
 
-				Convey("block transaction count need to be power of 2 to calculate merkle hash", func() {
-					So(b.HashTransactions(), ShouldNotBeNil)
+				Convey("block with a transaction lacking work for the transaction policy fails to verify", func() {
+					for reached, _ := reachThreshold(tx); reached; reached, _ = reachThreshold(tx) {
+						tx.NextTry()
+					}
+					So(b.HashTransactions(), ShouldBeNil)
 					So(b.VerifyTransactions(), ShouldNotBeNil)
 				})
 
+				Convey("block with a transaction signed by another account fails to verify", func() {
+					other, err := NewAccount()
+					So(err, ShouldBeNil)
+					So(Sign(tx, other), ShouldBeNil)
+					So(b.HashTransactions(), ShouldBeNil)
+					So(b.UpdateState(), ShouldBeNil)
+					So(Work(b), ShouldBeNil)
+					So(b.VerifyTransactions(), ShouldBeNil)
+					So(b.Verify(), ShouldNotBeNil)
+				})
+
+				Convey("block with a single transaction uses the transaction hash as merkle root", func() {
+					So(b.HashTransactions(), ShouldBeNil)
+					hash, err := tx.Hash()
+					So(err, ShouldBeNil)
+					So(b.Header.RootHash, ShouldEqual, hash)
+					So(b.VerifyTransactions(), ShouldBeNil)
+
+					Convey("block can be worked to be valid", func() {
+						So(b.UpdateState(), ShouldBeNil)
+						So(Work(b), ShouldBeNil)
+						So(b.Verify(), ShouldBeNil)
+					})
+				})
+
 				Convey("block with 2 transaction can be hashed with merkle tree", func() {
-					tx := NewTransaction("bob", "alice", "payload2")
-					So(Work(tx), ShouldBeNil)
+					tx, err := newTestTransaction(NewCommand(SET, "alice2", "payload2"))
+					So(err, ShouldBeNil)
 
 					b.Transactions = append(b.Transactions, tx)
 					So(b.HashTransactions(), ShouldBeNil)
@@ -123,11 +152,13 @@ func TestBlock(t *testing.T) {
 
 						Convey("if we rehash the block and rework the transaction in the block, the block will be verified again", func() {
 							So(Work(b.Transactions[0]), ShouldBeNil)
+							So(signTestTransaction(b.Transactions[0]), ShouldBeNil)
 							So(b.HashTransactions(), ShouldBeNil)
 							So(b.Header.RootHash, ShouldNotEqual, [32]byte{})
 							So(b.VerifyTransactions(), ShouldBeNil)
 
 							Convey("block can be worked to be valid", func() {
+								So(b.UpdateState(), ShouldBeNil)
 								So(Work(b), ShouldBeNil)
 								So(b.Verify(), ShouldBeNil)
 							})
@@ -135,22 +166,23 @@ func TestBlock(t *testing.T) {
 					})
 
 					Convey("block can be worked to be valid", func() {
+						So(b.UpdateState(), ShouldBeNil)
 						So(Work(b), ShouldBeNil)
 						So(b.Verify(), ShouldBeNil)
 					})
 				})
 
 				Convey("block with len(transaction) = 2^n can be hashed with merkle tree", func() {
-					tx := NewTransaction("bob", "alice", "payload2")
-					So(Work(tx), ShouldBeNil)
+					tx, err := newTestTransaction(NewCommand(SET, "alice2", "payload2"))
+					So(err, ShouldBeNil)
 					b.Transactions = append(b.Transactions, tx)
 
-					tx = NewTransaction("alice", "bob", "payload3")
-					So(Work(tx), ShouldBeNil)
+					tx, err = newTestTransaction(NewCommand(SET, "bob3", "payload3"))
+					So(err, ShouldBeNil)
 					b.Transactions = append(b.Transactions, tx)
 
-					tx = NewTransaction("bob", "alice", "payload4")
-					So(Work(tx), ShouldBeNil)
+					tx, err = newTestTransaction(NewCommand(SET, "alice4", "payload4"))
+					So(err, ShouldBeNil)
 					b.Transactions = append(b.Transactions, tx)
 
 					So(b.HashTransactions(), ShouldBeNil)
@@ -158,6 +190,7 @@ func TestBlock(t *testing.T) {
 					So(b.VerifyTransactions(), ShouldBeNil)
 
 					Convey("block can be worked to be valid", func() {
+						So(b.UpdateState(), ShouldBeNil)
 						So(Work(b), ShouldBeNil)
 						So(b.Verify(), ShouldBeNil)
 					})
@@ -168,22 +201,97 @@ func TestBlock(t *testing.T) {
 
 						Convey("if we rehash the block and rework the transaction, the block will be verified again", func() {
 							So(Work(b.Transactions[1]), ShouldBeNil)
+							So(signTestTransaction(b.Transactions[1]), ShouldBeNil)
 
 							So(b.HashTransactions(), ShouldBeNil)
 							So(b.Header.RootHash, ShouldNotEqual, [32]byte{})
 							So(b.VerifyTransactions(), ShouldBeNil)
 
 							Convey("block can be worked to be valid", func() {
+								So(b.UpdateState(), ShouldBeNil)
 								So(Work(b), ShouldBeNil)
 								So(b.Verify(), ShouldBeNil)
 							})
 						})
 					})
 				})
+
+				for _, n := range []int{3, 5} {
+					count := n
+					Convey(fmt.Sprintf("block with %d transactions can be hashed with merkle tree", count), func() {
+						for i := 1; i < count; i++ {
+							tx, err := newTestTransaction(NewCommand(SET, fmt.Sprintf("alice%d", i+1), fmt.Sprintf("payload%d", i+1)))
+							So(err, ShouldBeNil)
+							b.Transactions = append(b.Transactions, tx)
+						}
+
+						So(b.HashTransactions(), ShouldBeNil)
+						So(b.Header.RootHash, ShouldNotEqual, [32]byte{})
+						So(b.VerifyTransactions(), ShouldBeNil)
+
+						Convey("block can be worked to be valid", func() {
+							So(b.UpdateState(), ShouldBeNil)
+							So(Work(b), ShouldBeNil)
+							So(b.Verify(), ShouldBeNil)
+						})
+
+						Convey("duplicating the last transaction changes the merkle root", func() {
+							b.Transactions = append(b.Transactions, b.Transactions[count-1])
+							So(b.VerifyTransactions(), ShouldNotBeNil)
+						})
+
+						Convey("if the last transaction is modified, block should be failed to verify without rehash", func() {
+							b.Transactions[count-1].NextTry()
+							So(b.VerifyTransactions(), ShouldNotBeNil)
+						})
+					})
+				}
 			})
 		}
 	})
 
+	Convey("A block with a state root", t, func() {
+		rootBlock, err := NewBlock(nil)
+		So(err, ShouldBeNil)
+
+		for _, cmd := range []Command{NewCommand(SET, "foo", "bar"), NewCommand(SET, "baz", "qux")} {
+			tx, err := newTestTransaction(cmd)
+			So(err, ShouldBeNil)
+			rootBlock.Transactions = append(rootBlock.Transactions, tx)
+		}
+		So(rootBlock.HashTransactions(), ShouldBeNil)
+		So(rootBlock.UpdateState(), ShouldBeNil)
+		So(rootBlock.Header.StateRoot, ShouldNotEqual, [32]byte{})
+		So(Work(rootBlock), ShouldBeNil)
+
+		Convey("can be verified by replaying its transactions", func() {
+			So(rootBlock.Verify(), ShouldBeNil)
+		})
+
+		Convey("keeps the state it is verified with", func() {
+			received := &Block{Header: rootBlock.Header, Transactions: rootBlock.Transactions}
+			So(received.Verify(), ShouldBeNil)
+			So(valueOf(received.State, "foo").Val, ShouldEqual, "bar")
+			So(received.StateProof("foo"), ShouldResemble, rootBlock.StateProof("foo"))
+		})
+
+		Convey("fails to verify if the state root doesn't match", func() {
+			rootBlock.Header.StateRoot[0]++
+			So(Work(rootBlock), ShouldBeNil)
+			So(rootBlock.Verify(), ShouldNotBeNil)
+		})
+
+		Convey("can prove a value against the state root", func() {
+			value, found, err := VerifyTrieProof(rootBlock.Header.StateRoot, []byte("foo"), rootBlock.StateProof("foo"))
+			So(err, ShouldBeNil)
+			So(found, ShouldBeTrue)
+
+			expected, err := valueOf(rootBlock.State, "foo").encode()
+			So(err, ShouldBeNil)
+			So(value, ShouldResemble, expected)
+		})
+	})
+
 	Convey("A root block with commmand transaction", t, func() {
 		rootBlock, err := NewBlock(nil)
 		So(err, ShouldBeNil)
@@ -197,7 +305,7 @@ func TestBlock(t *testing.T) {
 			err := rootBlock.UpdateState()
 			So(err, ShouldBeNil)
 
-			So(rootBlock.State["foo"].Val, ShouldEqual, "bar")
+			So(valueOf(rootBlock.State, "foo").Val, ShouldEqual, "bar")
 
 			Convey("A child block with command transaction", func() {
 				childBlock, err := NewBlock(rootBlock)
@@ -205,6 +313,7 @@ func TestBlock(t *testing.T) {
 
 				tx, err := NewTransactionFromCommand("alice", NewCommand(SET, "foo2", "baz"))
 				So(err, ShouldBeNil)
+				tx.Header.Sequence = 1
 
 				Convey("can caluclate new state based on included transactions", func() {
 					childBlock.Transactions = append(childBlock.Transactions, tx)
@@ -212,9 +321,9 @@ func TestBlock(t *testing.T) {
 					So(err, ShouldBeNil)
 
 					// previous state should not be affected
-					So(rootBlock.State["foo"].Val, ShouldEqual, "bar")
+					So(valueOf(rootBlock.State, "foo").Val, ShouldEqual, "bar")
 
-					So(childBlock.State["foo2"].Val, ShouldEqual, "baz")
+					So(valueOf(childBlock.State, "foo2").Val, ShouldEqual, "baz")
 				})
 			})
 
@@ -224,6 +333,7 @@ func TestBlock(t *testing.T) {
 
 				tx, err := NewTransactionFromCommand("alice", NewCommand(GETSET, "foo", "baz"))
 				So(err, ShouldBeNil)
+				tx.Header.Sequence = 1
 
 				Convey("can caluclate new state based on included transactions", func() {
 					childBlock.Transactions = append(childBlock.Transactions, tx)
@@ -231,12 +341,12 @@ func TestBlock(t *testing.T) {
 					So(err, ShouldBeNil)
 
 					// previous state should not be affected
-					So(rootBlock.State["foo"].Val, ShouldEqual, "bar")
+					So(valueOf(rootBlock.State, "foo").Val, ShouldEqual, "bar")
 					retKey, err := tx.ReadableHash()
 					So(err, ShouldBeNil)
 
-					So(childBlock.State["foo"].Val, ShouldEqual, "baz")
-					So(childBlock.State[string(retKey)+":ret"].Val, ShouldEqual, "bar")
+					So(valueOf(childBlock.State, "foo").Val, ShouldEqual, "baz")
+					So(valueOf(childBlock.State, resultKey(string(retKey))).Val, ShouldEqual, "bar")
 				})
 			})
 		})
@@ -245,7 +355,7 @@ func TestBlock(t *testing.T) {
 			err := rootBlock.UpdateState()
 			So(err, ShouldBeNil)
 
-			So(rootBlock.State["foo"].Val, ShouldEqual, "bar")
+			So(valueOf(rootBlock.State, "foo").Val, ShouldEqual, "bar")
 
 			Convey("A child block with command transaction", func() {
 				childBlock, err := NewBlock(rootBlock)
@@ -253,6 +363,7 @@ func TestBlock(t *testing.T) {
 
 				tx, err := NewTransactionFromCommand("alice", NewCommand(SET, "foo2", "baz"))
 				So(err, ShouldBeNil)
+				tx.Header.Sequence = 1
 
 				Convey("can caluclate new state based on included transactions", func() {
 					childBlock.Transactions = append(childBlock.Transactions, tx)
@@ -260,9 +371,9 @@ func TestBlock(t *testing.T) {
 					So(err, ShouldBeNil)
 
 					// previous state should not be affected
-					So(rootBlock.State["foo"].Val, ShouldEqual, "bar")
+					So(valueOf(rootBlock.State, "foo").Val, ShouldEqual, "bar")
 
-					So(childBlock.State["foo2"].Val, ShouldEqual, "baz")
+					So(valueOf(childBlock.State, "foo2").Val, ShouldEqual, "baz")
 				})
 			})
 
@@ -272,6 +383,7 @@ func TestBlock(t *testing.T) {
 
 				tx, err := NewTransactionFromCommand("alice", NewCommand(GETSET, "foo", "baz"))
 				So(err, ShouldBeNil)
+				tx.Header.Sequence = 1
 
 				Convey("can caluclate new state based on included transactions", func() {
 					childBlock.Transactions = append(childBlock.Transactions, tx)
@@ -279,12 +391,12 @@ func TestBlock(t *testing.T) {
 					So(err, ShouldBeNil)
 
 					// previous state should not be affected
-					So(rootBlock.State["foo"].Val, ShouldEqual, "bar")
+					So(valueOf(rootBlock.State, "foo").Val, ShouldEqual, "bar")
 					retKey, err := tx.ReadableHash()
 					So(err, ShouldBeNil)
 
-					So(childBlock.State["foo"].Val, ShouldEqual, "baz")
-					So(childBlock.State[string(retKey)+":ret"].Val, ShouldEqual, "bar")
+					So(valueOf(childBlock.State, "foo").Val, ShouldEqual, "baz")
+					So(valueOf(childBlock.State, resultKey(string(retKey))).Val, ShouldEqual, "bar")
 				})
 			})
 		})
@@ -299,16 +411,29 @@ func TestBlock(t *testing.T) {
 
 			tx, err = NewTransactionFromCommand("alice", NewCommand(EXPIRE, "foo", "2"))
 			So(err, ShouldBeNil)
+			tx.Header.Sequence = 1
 			rootBlock.Transactions = append(rootBlock.Transactions, tx)
 
-			time.Sleep(3 * time.Second)
+			// keys expire at the time of blocks, not the time they are applied
+			// nor the time chosen by the sender of the transaction
+			tx.Header.Time = time.Now().Add(-time.Hour)
+			So(rootBlock.UpdateState(), ShouldBeNil)
+			So(valueOf(rootBlock.State, "foo").Val, ShouldEqual, "bar")
 
-			Convey("can expire value when updating state", func() {
-				err := rootBlock.UpdateState()
+			child := func(after time.Duration) *Block {
+				b, err := NewBlock(rootBlock)
 				So(err, ShouldBeNil)
+				b.Header.Time = rootBlock.Header.Time.Add(after)
+				So(b.UpdateState(), ShouldBeNil)
+				return b
+			}
 
-				So(rootBlock.State["foo"], ShouldBeNil)
+			Convey("keeps the value until a block time passes its expire time", func() {
+				So(valueOf(child(time.Second).State, "foo").Val, ShouldEqual, "bar")
+			})
 
+			Convey("can expire value when updating state", func() {
+				So(valueOf(child(3*time.Second).State, "foo"), ShouldBeNil)
 			})
 		})
 	})
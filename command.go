@@ -2,12 +2,12 @@ package main
 
 import (
 	"errors"
-	"strconv"
 	"time"
 )
 
 type OP int
 
+// operations are stored in transactions by number, so new ones go last
 const (
 	// string
 	SET OP = iota
@@ -15,55 +15,413 @@ const (
 	GET
 	GETSET
 	EXPIRE
+
+	// access control
+	GRANT
+	REVOKE
+
+	// string
+	SETNX
+	SETEX
+	PSETEX
+	MSET
+	MSETNX
+	MGET
+	APPEND
+	STRLEN
+	GETRANGE
+	SETRANGE
+	INCRBY
+	INCRBYFLOAT
+	DECR
+	DECRBY
+	GETDEL
+	GETEX
+
+	// list
+	LPUSH
+	RPUSH
+	LPOP
+	RPOP
+	LRANGE
+	LLEN
+	LINDEX
+	LSET
+	LINSERT
+	LREM
+	LTRIM
+	LMOVE
+
+	// hash
+	HSET
+	HGET
+	HMGET
+	HGETALL
+	HDEL
+	HEXISTS
+	HKEYS
+	HVALS
+	HLEN
+	HINCRBY
+	HINCRBYFLOAT
+	HSETNX
+	HSCAN
+
+	// set
+	SADD
+	SREM
+	SISMEMBER
+	SMEMBERS
+	SCARD
+	SINTER
+	SUNION
+	SDIFF
+	SINTERSTORE
+
+	// sorted set
+	ZADD
+	ZRANGE
+	ZRANK
+	ZSCORE
+	ZINCRBY
+	ZREM
+	ZCARD
+	ZCOUNT
+	ZPOPMIN
+	ZPOPMAX
+
+	// keyspace
+	DEL
+	UNLINK
+	EXISTS
+	TYPE
+	RENAME
+	RENAMENX
+	TTL
+	PTTL
+	EXPIREAT
+	PEXPIRE
+	PERSIST
+	KEYS
+	SCAN
+	DBSIZE
+
+	// transactions
+	EXEC
+)
+
+var (
+	errWrongType  = errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+	errNotInteger = errors.New("value is not an integer or out of range")
+	errNoSuchKey  = errors.New("no such key")
 )
 
 type Command struct {
 	OP        OP
 	Key       string
 	Arguments []string
-	TX        *Transaction
+	// the commands queued by MULTI, applied all together by EXEC
+	Commands []Command `json:",omitempty"`
+	// the keys watched before an EXEC and the hashes of their values
+	Watch map[string]string `json:",omitempty"`
+	TX    *Transaction
+	// the time of the block applying the command, or of the node for a
+	// command answered locally
+	at time.Time
 }
 
-func (cmd Command) Execute(state State) (interface{}, error) {
+// Keys returns the keys a command reads or writes
+func (cmd Command) Keys() []string {
 	switch cmd.OP {
-	case SET:
-		state[cmd.Key] = &Value{Val: cmd.Arguments[0]}
-		return "OK", nil
-	case INCR:
-		if _, ok := state[cmd.Key]; !ok {
-			state[cmd.Key] = &Value{Val: "0"}
+	case MSET, MSETNX:
+		keys := []string{cmd.Key}
+		for i := 1; i < len(cmd.Arguments); i += 2 {
+			keys = append(keys, cmd.Arguments[i])
 		}
-		i, err := strconv.ParseInt(state[cmd.Key].Val.(string), 10, 64)
-		if err != nil {
-			return nil, err
+		return keys
+	case MGET, SINTER, SUNION, SDIFF, SINTERSTORE, DEL, UNLINK, EXISTS:
+		return append([]string{cmd.Key}, cmd.Arguments...)
+	case LMOVE, RENAME, RENAMENX:
+		return append([]string{cmd.Key}, cmd.Arguments[:1]...)
+	case KEYS, SCAN, DBSIZE:
+		// the key of KEYS and SCAN is a pattern and a cursor
+		return nil
+	case EXEC:
+		var keys []string
+		for _, c := range cmd.Commands {
+			keys = append(keys, c.Keys()...)
+		}
+		return keys
+	}
+	return []string{cmd.Key}
+}
+
+// writeKeys returns the keys a command may change, leaving out the ones it
+// only reads
+func (cmd Command) writeKeys() []string {
+	if cmd.ReadOnly() {
+		return nil
+	}
+	switch cmd.OP {
+	case SINTERSTORE:
+		return []string{cmd.Key}
+	case EXEC:
+		var keys []string
+		for _, c := range cmd.Commands {
+			keys = append(keys, c.writeKeys()...)
 		}
-		//newValue := Value{Val: strconv.FormatInt(i+1, 10), Expire: state[cmd.Key].Expire, WillExpire: state[cmd.Key].WillExpire}
-		//state[cmd.Key] = newValue
-		state[cmd.Key].UpdateVal(strconv.FormatInt(i+1, 10))
+		return keys
+	}
+	return cmd.Keys()
+}
+
+// ReadOnly reports whether a command leaves the state untouched
+func (cmd Command) ReadOnly() bool {
+	switch cmd.OP {
+	case GET, MGET, STRLEN, GETRANGE, LRANGE, LLEN, LINDEX,
+		HGET, HMGET, HGETALL, HEXISTS, HKEYS, HVALS, HLEN, HSCAN,
+		SISMEMBER, SMEMBERS, SCARD, SINTER, SUNION, SDIFF,
+		ZRANGE, ZRANK, ZSCORE, ZCARD, ZCOUNT,
+		EXISTS, TYPE, TTL, PTTL, KEYS, SCAN, DBSIZE:
+		return true
+	case EXEC:
+		for _, c := range cmd.Commands {
+			if !c.ReadOnly() {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func (cmd Command) Execute(state *State) (interface{}, error) {
+	if cmd.OP == EXEC {
+		return cmd.executeExec(state, Command.Execute)
+	}
+	state = cmd.withoutExpired(state)
+	// values may be shared with other states, writes get their own copy of
+	// the ones they touch to change them in place
+	for _, key := range cmd.writeKeys() {
+		state.Mutable(key)
+	}
 
-		return state[cmd.Key].Val, nil
+	switch cmd.OP {
+	case SET:
+		return cmd.executeSet(state)
+	case INCR:
+		return incrBy(state, cmd.Key, 1)
 	case GET:
-		return state[cmd.Key].Val, nil
+		v, ok := state.Get(cmd.Key)
+		if !ok {
+			return nil, nil
+		}
+		if v.Type() != "string" {
+			return nil, errWrongType
+		}
+		return v.Val, nil
 	case GETSET:
-		if _, ok := state[cmd.Key].Val.(string); !ok {
-			return nil, errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+		if !state.Has(cmd.Key) {
+			state.Set(cmd.Key, &Value{Val: cmd.Arguments[0]})
+			return nil, nil
+		}
+		v, _ := state.Get(cmd.Key)
+		oldValue, ok := v.Val.(string)
+		if !ok {
+			return nil, errWrongType
 		}
-		oldValue := state[cmd.Key].Val
-		state[cmd.Key] = &Value{Val: cmd.Arguments[0]}
+		state.Set(cmd.Key, &Value{Val: cmd.Arguments[0]})
 		return oldValue, nil
 	case EXPIRE:
-		seconds, err := strconv.Atoi(cmd.Arguments[0])
-		if err != nil {
+		return cmd.executeExpire(state, time.Second, false, "expire")
+	case GRANT, REVOKE:
+		if err := setGrant(state, cmd.Key, cmd.TX.Header.From, cmd.Arguments[0], cmd.OP == GRANT); err != nil {
 			return nil, err
 		}
-		state[cmd.Key].UpdateExpire(cmd.TX.Header.Time.Add(time.Duration(seconds) * time.Second))
-
 		return "OK", nil
+	case SETNX:
+		if state.Has(cmd.Key) {
+			return int64(0), nil
+		}
+		state.Set(cmd.Key, &Value{Val: cmd.Arguments[0]})
+		return int64(1), nil
+	case SETEX:
+		return cmd.executeSetEx(state, time.Second, "setex")
+	case PSETEX:
+		return cmd.executeSetEx(state, time.Millisecond, "psetex")
+	case MSET:
+		return cmd.executeMSet(state, false, "mset")
+	case MSETNX:
+		return cmd.executeMSet(state, true, "msetnx")
+	case MGET:
+		return cmd.executeMGet(state)
+	case APPEND:
+		return cmd.executeAppend(state)
+	case STRLEN:
+		s, _, err := getString(state, cmd.Key)
+		if err != nil {
+			return nil, err
+		}
+		return int64(len(s)), nil
+	case GETRANGE:
+		return cmd.executeGetRange(state)
+	case SETRANGE:
+		return cmd.executeSetRange(state)
+	case INCRBY:
+		return cmd.executeIncrBy(state, 1)
+	case INCRBYFLOAT:
+		return cmd.executeIncrByFloat(state)
+	case DECR:
+		return incrBy(state, cmd.Key, -1)
+	case DECRBY:
+		return cmd.executeIncrBy(state, -1)
+	case GETDEL:
+		return cmd.executeGetDel(state)
+	case GETEX:
+		return cmd.executeGetEx(state)
+	case LPUSH:
+		return cmd.executePush(state, true)
+	case RPUSH:
+		return cmd.executePush(state, false)
+	case LPOP:
+		return cmd.executePop(state, true)
+	case RPOP:
+		return cmd.executePop(state, false)
+	case LRANGE:
+		return cmd.executeLRange(state)
+	case LLEN:
+		l, _, err := getList(state, cmd.Key)
+		if err != nil {
+			return nil, err
+		}
+		return int64(len(l)), nil
+	case LINDEX:
+		return cmd.executeLIndex(state)
+	case LSET:
+		return cmd.executeLSet(state)
+	case LINSERT:
+		return cmd.executeLInsert(state)
+	case LREM:
+		return cmd.executeLRem(state)
+	case LTRIM:
+		return cmd.executeLTrim(state)
+	case LMOVE:
+		return cmd.executeLMove(state)
+	case HSET:
+		return cmd.executeHSet(state)
+	case HGET:
+		return cmd.executeHGet(state)
+	case HMGET:
+		return cmd.executeHMGet(state)
+	case HGETALL:
+		return cmd.executeHGetAll(state, true, true)
+	case HDEL:
+		return cmd.executeHDel(state)
+	case HEXISTS:
+		return cmd.executeHExists(state)
+	case HKEYS:
+		return cmd.executeHGetAll(state, true, false)
+	case HVALS:
+		return cmd.executeHGetAll(state, false, true)
+	case HLEN:
+		h, _, err := getHash(state, cmd.Key)
+		if err != nil {
+			return nil, err
+		}
+		return int64(len(h)), nil
+	case HINCRBY:
+		return cmd.executeHIncrBy(state)
+	case HINCRBYFLOAT:
+		return cmd.executeHIncrByFloat(state)
+	case HSETNX:
+		return cmd.executeHSetNX(state)
+	case HSCAN:
+		return cmd.executeHScan(state)
+	case SADD:
+		return cmd.executeSAdd(state)
+	case SREM:
+		return cmd.executeSRem(state)
+	case SISMEMBER:
+		return cmd.executeSIsMember(state)
+	case SMEMBERS:
+		s, _, err := getSet(state, cmd.Key)
+		if err != nil {
+			return nil, err
+		}
+		return s.members(), nil
+	case SCARD:
+		s, _, err := getSet(state, cmd.Key)
+		if err != nil {
+			return nil, err
+		}
+		return int64(len(s)), nil
+	case SINTER:
+		return cmd.executeSCombine(state, setInter)
+	case SUNION:
+		return cmd.executeSCombine(state, setUnion)
+	case SDIFF:
+		return cmd.executeSCombine(state, setDiff)
+	case SINTERSTORE:
+		return cmd.executeSInterStore(state)
+	case ZADD:
+		return cmd.executeZAdd(state)
+	case ZRANGE:
+		return cmd.executeZRange(state)
+	case ZRANK:
+		return cmd.executeZRank(state)
+	case ZSCORE:
+		return cmd.executeZScore(state)
+	case ZINCRBY:
+		return cmd.executeZIncrBy(state)
+	case ZREM:
+		return cmd.executeZRem(state)
+	case ZCARD:
+		z, _, err := getZSet(state, cmd.Key)
+		if err != nil {
+			return nil, err
+		}
+		return int64(len(z)), nil
+	case ZCOUNT:
+		return cmd.executeZCount(state)
+	case ZPOPMIN:
+		return cmd.executeZPop(state, false)
+	case ZPOPMAX:
+		return cmd.executeZPop(state, true)
+	case DEL, UNLINK:
+		return cmd.executeDel(state)
+	case EXISTS:
+		return cmd.executeExists(state)
+	case TYPE:
+		v, ok := state.Get(cmd.Key)
+		if !ok {
+			return "none", nil
+		}
+		return v.Type(), nil
+	case RENAME:
+		return cmd.executeRename(state, false)
+	case RENAMENX:
+		return cmd.executeRename(state, true)
+	case TTL:
+		return cmd.executeTTL(state, time.Second)
+	case PTTL:
+		return cmd.executeTTL(state, time.Millisecond)
+	case EXPIREAT:
+		return cmd.executeExpire(state, time.Second, true, "expireat")
+	case PEXPIRE:
+		return cmd.executeExpire(state, time.Millisecond, false, "pexpire")
+	case PERSIST:
+		return cmd.executePersist(state)
+	case KEYS:
+		return cmd.executeKeys(state)
+	case SCAN:
+		return cmd.executeScan(state)
+	case DBSIZE:
+		return int64(len(userKeys(state))), nil
 	}
 
 	return nil, nil
 }
 
 func NewCommand(op OP, key string, arguments ...string) Command {
-	return Command{op, key, arguments, nil}
+	return Command{OP: op, Key: key, Arguments: arguments}
 }
@@ -0,0 +1,244 @@
+// commands of the hash family
+package main
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"strconv"
+)
+
+// Hash is the value of a hash key. Go maps have no order, so fields are
+// always visited sorted, and hashes are serialized as JSON objects whose
+// keys are sorted too.
+type Hash map[string]string
+
+// fields returns the fields of a hash, sorted
+func (h Hash) fields() []string {
+	fields := make([]string, 0, len(h))
+	for field := range h {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+var (
+	errHashNotInteger = errors.New("hash value is not an integer")
+	errHashNotFloat   = errors.New("hash value is not a float")
+)
+
+// getHash returns the hash at key. Keys holding another kind of value are
+// refused with errWrongType.
+func getHash(state *State, key string) (Hash, bool, error) {
+	v, ok := state.Get(key)
+	if !ok {
+		return nil, false, nil
+	}
+	h, ok := v.Val.(Hash)
+	if !ok {
+		return nil, false, errWrongType
+	}
+	return h, true, nil
+}
+
+// createHash returns the hash at key, storing an empty one if missing
+func createHash(state *State, key string) (Hash, error) {
+	h, ok, err := getHash(state, key)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		h = Hash{}
+		state.Set(key, &Value{Val: h})
+	}
+	return h, nil
+}
+
+// HSET key field value [field value ...]
+func (cmd Command) executeHSet(state *State) (interface{}, error) {
+	if len(cmd.Arguments) == 0 || len(cmd.Arguments)%2 != 0 {
+		return nil, errWrongArity("hset")
+	}
+	h, err := createHash(state, cmd.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	added := int64(0)
+	for i := 0; i < len(cmd.Arguments); i += 2 {
+		if _, ok := h[cmd.Arguments[i]]; !ok {
+			added++
+		}
+		h[cmd.Arguments[i]] = cmd.Arguments[i+1]
+	}
+	return added, nil
+}
+
+// HSETNX key field value
+func (cmd Command) executeHSetNX(state *State) (interface{}, error) {
+	h, err := createHash(state, cmd.Key)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := h[cmd.Arguments[0]]; ok {
+		return int64(0), nil
+	}
+	h[cmd.Arguments[0]] = cmd.Arguments[1]
+	return int64(1), nil
+}
+
+func (cmd Command) executeHGet(state *State) (interface{}, error) {
+	h, _, err := getHash(state, cmd.Key)
+	if err != nil {
+		return nil, err
+	}
+	if v, ok := h[cmd.Arguments[0]]; ok {
+		return v, nil
+	}
+	return nil, nil
+}
+
+func (cmd Command) executeHMGet(state *State) (interface{}, error) {
+	h, _, err := getHash(state, cmd.Key)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]interface{}, len(cmd.Arguments))
+	for i, field := range cmd.Arguments {
+		if v, ok := h[field]; ok {
+			ret[i] = v
+		}
+	}
+	return ret, nil
+}
+
+// executeHGetAll replies with fields, values or both, sorted by field. Both
+// are a map in RESP3.
+func (cmd Command) executeHGetAll(state *State, fields, values bool) (interface{}, error) {
+	h, _, err := getHash(state, cmd.Key)
+	if err != nil {
+		return nil, err
+	}
+	ret := []interface{}{}
+	for _, field := range h.fields() {
+		if fields {
+			ret = append(ret, field)
+		}
+		if values {
+			ret = append(ret, h[field])
+		}
+	}
+	if fields && values {
+		return respMap(ret), nil
+	}
+	return ret, nil
+}
+
+// HDEL key field [field ...]
+func (cmd Command) executeHDel(state *State) (interface{}, error) {
+	h, _, err := getHash(state, cmd.Key)
+	if err != nil {
+		return nil, err
+	}
+	removed := int64(0)
+	for _, field := range cmd.Arguments {
+		if _, ok := h[field]; ok {
+			delete(h, field)
+			removed++
+		}
+	}
+	if removed > 0 && len(h) == 0 {
+		state.Delete(cmd.Key)
+	}
+	return removed, nil
+}
+
+func (cmd Command) executeHExists(state *State) (interface{}, error) {
+	h, _, err := getHash(state, cmd.Key)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := h[cmd.Arguments[0]]; ok {
+		return int64(1), nil
+	}
+	return int64(0), nil
+}
+
+// HINCRBY key field increment
+func (cmd Command) executeHIncrBy(state *State) (interface{}, error) {
+	by, err := strconv.ParseInt(cmd.Arguments[1], 10, 64)
+	if err != nil {
+		return nil, errNotInteger
+	}
+	h, err := createHash(state, cmd.Key)
+	if err != nil {
+		return nil, err
+	}
+	var i int64
+	if s, ok := h[cmd.Arguments[0]]; ok {
+		i, err = strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return nil, errHashNotInteger
+		}
+	}
+	if (by > 0 && i > math.MaxInt64-by) || (by < 0 && i < math.MinInt64-by) {
+		return nil, errOverflow
+	}
+
+	i += by
+	h[cmd.Arguments[0]] = strconv.FormatInt(i, 10)
+	return i, nil
+}
+
+// HINCRBYFLOAT key field increment
+func (cmd Command) executeHIncrByFloat(state *State) (interface{}, error) {
+	by, err := parseFloat(cmd.Arguments[1])
+	if err != nil {
+		return nil, err
+	}
+	h, err := createHash(state, cmd.Key)
+	if err != nil {
+		return nil, err
+	}
+	var f float64
+	if s, ok := h[cmd.Arguments[0]]; ok {
+		f, err = parseFloat(s)
+		if err != nil {
+			return nil, errHashNotFloat
+		}
+	}
+
+	f += by
+	if math.IsInf(f, 0) || math.IsNaN(f) {
+		return nil, errors.New("increment would produce NaN or Infinity")
+	}
+	result := strconv.FormatFloat(f, 'f', -1, 64)
+	h[cmd.Arguments[0]] = result
+	return result, nil
+}
+
+// HSCAN key cursor [MATCH pattern] [COUNT count] [NOVALUES]
+func (cmd Command) executeHScan(state *State) (interface{}, error) {
+	opts, err := parseScan(cmd.Arguments, "NOVALUES")
+	if err != nil {
+		return nil, err
+	}
+	h, _, err := getHash(state, cmd.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	fields, next := opts.page(h.fields())
+	ret := []interface{}{}
+	for _, field := range fields {
+		if !matchPattern(opts.pattern, field) {
+			continue
+		}
+		ret = append(ret, field)
+		if !opts.novalues {
+			ret = append(ret, h[field])
+		}
+	}
+	return []interface{}{next, ret}, nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestHashCommands(t *testing.T) {
+	Convey("A hash", t, func() {
+		state := newStateFrom(map[string]*Value{"str": {Val: "a"}})
+		ret, err := NewCommand(HSET, "user", "name", "alice", "age", "30", "city", "taipei").Execute(state)
+		So(err, ShouldBeNil)
+		So(ret, ShouldEqual, 3)
+
+		Convey("counts the fields HSET adds", func() {
+			ret, err := NewCommand(HSET, "user", "name", "bob", "job", "dev").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldEqual, 1)
+			So(valueOf(state, "user").Val, ShouldResemble, Hash{"name": "bob", "age": "30", "city": "taipei", "job": "dev"})
+			So(valueOf(state, "user").Type(), ShouldEqual, "hash")
+
+			_, err = NewCommand(HSET, "user", "name").Execute(state)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("only sets missing fields with HSETNX", func() {
+			ret, err := NewCommand(HSETNX, "user", "name", "bob").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldEqual, 0)
+			ret, err = NewCommand(HSETNX, "user", "job", "dev").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldEqual, 1)
+			So(valueOf(state, "user").Val.(Hash)["name"], ShouldEqual, "alice")
+		})
+
+		Convey("reads fields", func() {
+			ret, err := NewCommand(HGET, "user", "name").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldEqual, "alice")
+			ret, err = NewCommand(HGET, "user", "missing").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldBeNil)
+
+			ret, err = NewCommand(HMGET, "user", "age", "missing").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldResemble, []interface{}{"30", nil})
+
+			ret, err = NewCommand(HEXISTS, "user", "city").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldEqual, 1)
+			ret, err = NewCommand(HLEN, "user").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldEqual, 3)
+		})
+
+		Convey("lists fields sorted", func() {
+			ret, err := NewCommand(HGETALL, "user").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldResemble, respMap{"age", "30", "city", "taipei", "name", "alice"})
+			ret, err = NewCommand(HKEYS, "user").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldResemble, []interface{}{"age", "city", "name"})
+			ret, err = NewCommand(HVALS, "user").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldResemble, []interface{}{"30", "taipei", "alice"})
+			ret, err = NewCommand(HGETALL, "missing").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldBeEmpty)
+		})
+
+		Convey("deletes fields and is removed once empty", func() {
+			ret, err := NewCommand(HDEL, "user", "age", "missing").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldEqual, 1)
+			ret, err = NewCommand(HDEL, "user", "name", "city").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldEqual, 2)
+			So(state.Has("user"), ShouldBeFalse)
+		})
+
+		Convey("increments fields", func() {
+			ret, err := NewCommand(HINCRBY, "user", "age", "-5").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldEqual, 25)
+			ret, err = NewCommand(HINCRBY, "user", "visits", "1").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldEqual, 1)
+			_, err = NewCommand(HINCRBY, "user", "name", "1").Execute(state)
+			So(err, ShouldEqual, errHashNotInteger)
+
+			ret, err = NewCommand(HINCRBYFLOAT, "user", "age", "0.5").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldEqual, "25.5")
+			_, err = NewCommand(HINCRBYFLOAT, "user", "name", "1").Execute(state)
+			So(err, ShouldEqual, errHashNotFloat)
+			So(valueOf(state, "user").Val.(Hash)["age"], ShouldEqual, "25.5")
+		})
+
+		Convey("is scanned in field order", func() {
+			ret, err := NewCommand(HSCAN, "user", "0", "COUNT", "2").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldResemble, []interface{}{"2", []interface{}{"age", "30", "city", "taipei"}})
+			ret, err = NewCommand(HSCAN, "user", "2", "COUNT", "2").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldResemble, []interface{}{"0", []interface{}{"name", "alice"}})
+
+			ret, err = NewCommand(HSCAN, "user", "0", "MATCH", "*a*", "NOVALUES").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldResemble, []interface{}{"0", []interface{}{"age", "name"}})
+			_, err = NewCommand(HSCAN, "user", "0", "COUNT").Execute(state)
+			So(err, ShouldEqual, errSyntax)
+		})
+
+		Convey("refuses commands of other types", func() {
+			_, err := NewCommand(GET, "user").Execute(state)
+			So(err, ShouldEqual, errWrongType)
+			_, err = NewCommand(LPUSH, "user", "x").Execute(state)
+			So(err, ShouldEqual, errWrongType)
+			_, err = NewCommand(HSET, "str", "f", "v").Execute(state)
+			So(err, ShouldEqual, errWrongType)
+		})
+
+		Convey("is not shared by cloned states", func() {
+			cloned := state.Snapshot()
+			_, err := NewCommand(HSET, "user", "name", "bob").Execute(cloned)
+			So(err, ShouldBeNil)
+			So(valueOf(state, "user").Val.(Hash)["name"], ShouldEqual, "alice")
+		})
+
+		Convey("is serialized with sorted fields", func() {
+			encoded, err := valueOf(state, "user").encode()
+			So(err, ShouldBeNil)
+			So(string(encoded), ShouldEqual, `{"Val":{"age":"30","city":"taipei","name":"alice"},"Expire":0}`)
+		})
+	})
+}
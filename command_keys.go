@@ -0,0 +1,243 @@
+// commands working on keys whatever they hold
+//
+// Keys under reservedPrefix belong to the chain and are left out of KEYS,
+// SCAN and DBSIZE.
+package main
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultScanCount is the number of elements a SCAN visits without COUNT
+const defaultScanCount = 10
+
+var errInvalidCursor = errors.New("invalid cursor")
+
+// scanOptions are the arguments of the SCAN family. The cursor is the
+// position in the sorted names, so a scan sees every name present during
+// the whole iteration.
+type scanOptions struct {
+	cursor   uint64
+	pattern  string
+	count    uint64
+	novalues bool   // HSCAN only
+	typ      string // SCAN only
+}
+
+// parseScan parses cursor [MATCH pattern] [COUNT count] followed by the
+// options of a scan command, NOVALUES or TYPE
+func parseScan(args []string, extra string) (scanOptions, error) {
+	opts := scanOptions{pattern: "*", count: defaultScanCount}
+	if len(args) == 0 {
+		return opts, errSyntax
+	}
+	var err error
+	opts.cursor, err = strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return opts, errInvalidCursor
+	}
+
+	for i := 1; i < len(args); i++ {
+		option := strings.ToUpper(args[i])
+		switch {
+		case option == "MATCH" && i+1 < len(args):
+			opts.pattern = args[i+1]
+			i++
+		case option == "COUNT" && i+1 < len(args):
+			count, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil {
+				return opts, errNotInteger
+			}
+			if count < 1 {
+				return opts, errSyntax
+			}
+			opts.count = uint64(count)
+			i++
+		case option == "NOVALUES" && extra == option:
+			opts.novalues = true
+		case option == "TYPE" && extra == option && i+1 < len(args):
+			opts.typ = strings.ToLower(args[i+1])
+			i++
+		default:
+			return opts, errSyntax
+		}
+	}
+	return opts, nil
+}
+
+// page returns the sorted names visited from the cursor and the cursor to
+// continue with, "0" once done
+func (opts scanOptions) page(names []string) ([]string, string) {
+	n := uint64(len(names))
+	start := opts.cursor
+	if start > n {
+		start = n
+	}
+	end := n
+	if opts.count < end-start {
+		end = start + opts.count
+	}
+	if end == n {
+		return names[start:end], "0"
+	}
+	return names[start:end], strconv.FormatUint(end, 10)
+}
+
+// userKeys returns the keys of a state left to commands, sorted
+func userKeys(state *State) []string {
+	keys := make([]string, 0, state.Len())
+	state.Range(func(key string, _ *Value) bool {
+		if !strings.HasPrefix(key, reservedPrefix) {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	sort.Strings(keys)
+	return keys
+}
+
+// DEL key [key ...], UNLINK key [key ...]
+func (cmd Command) executeDel(state *State) (interface{}, error) {
+	removed := int64(0)
+	for _, key := range cmd.Keys() {
+		if state.Has(key) {
+			state.Delete(key)
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+// EXISTS key [key ...] counts keys mentioned more than once as many times
+func (cmd Command) executeExists(state *State) (interface{}, error) {
+	count := int64(0)
+	for _, key := range cmd.Keys() {
+		if state.Has(key) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// RENAME key newkey, RENAMENX key newkey move the value with its expire
+// time
+func (cmd Command) executeRename(state *State, nx bool) (interface{}, error) {
+	v, ok := state.Get(cmd.Key)
+	if !ok {
+		return nil, errNoSuchKey
+	}
+	newKey := cmd.Arguments[0]
+	if _, ok := state.Get(newKey); ok && nx {
+		return int64(0), nil
+	}
+
+	state.Delete(cmd.Key)
+	state.Set(newKey, v)
+	if nx {
+		return int64(1), nil
+	}
+	return "OK", nil
+}
+
+// TTL key, PTTL key reply -2 for missing keys and -1 for keys which never
+// expire
+func (cmd Command) executeTTL(state *State, unit time.Duration) (interface{}, error) {
+	v, ok := state.Get(cmd.Key)
+	if !ok {
+		return int64(-2), nil
+	}
+	if !v.WillExpire {
+		return int64(-1), nil
+	}
+	now, err := cmd.now()
+	if err != nil {
+		return nil, err
+	}
+
+	left := v.Expire.Sub(now)
+	if left < 0 {
+		return int64(-2), nil
+	}
+	return int64((left + unit/2) / unit), nil
+}
+
+// EXPIRE key seconds, PEXPIRE key milliseconds and EXPIREAT key timestamp
+// set the expire time of a key, at an amount of units after the command or
+// after the unix epoch. Unlike the expire options of SET, a time already
+// passed is allowed and deletes the key.
+func (cmd Command) executeExpire(state *State, unit time.Duration, absolute bool, name string) (interface{}, error) {
+	amount, err := strconv.ParseInt(cmd.Arguments[0], 10, 64)
+	if err != nil {
+		return nil, errNotInteger
+	}
+	if amount > math.MaxInt64/int64(unit) || amount < math.MinInt64/int64(unit) {
+		return nil, errInvalidExpire(name)
+	}
+	now, err := cmd.now()
+	if err != nil {
+		return nil, err
+	}
+	expire := now.Add(time.Duration(amount) * unit)
+	if absolute {
+		expire = time.Unix(0, amount*int64(unit)).UTC()
+	}
+
+	v, ok := state.Get(cmd.Key)
+	if !ok {
+		return int64(0), nil
+	}
+	if !expire.After(now) {
+		state.Delete(cmd.Key)
+		return int64(1), nil
+	}
+	v.UpdateExpire(expire)
+	return int64(1), nil
+}
+
+// PERSIST key
+func (cmd Command) executePersist(state *State) (interface{}, error) {
+	v, ok := state.Get(cmd.Key)
+	if !ok || !v.WillExpire {
+		return int64(0), nil
+	}
+	v.Expire = time.Time{}
+	v.WillExpire = false
+	return int64(1), nil
+}
+
+// KEYS pattern
+func (cmd Command) executeKeys(state *State) (interface{}, error) {
+	ret := []interface{}{}
+	for _, key := range userKeys(state) {
+		if matchPattern(cmd.Key, key) {
+			ret = append(ret, key)
+		}
+	}
+	return ret, nil
+}
+
+// SCAN cursor [MATCH pattern] [COUNT count] [TYPE type]
+func (cmd Command) executeScan(state *State) (interface{}, error) {
+	opts, err := parseScan(append([]string{cmd.Key}, cmd.Arguments...), "TYPE")
+	if err != nil {
+		return nil, err
+	}
+
+	keys, next := opts.page(userKeys(state))
+	ret := []interface{}{}
+	for _, key := range keys {
+		if !matchPattern(opts.pattern, key) {
+			continue
+		}
+		if v, _ := state.Get(key); opts.typ != "" && v.Type() != opts.typ {
+			continue
+		}
+		ret = append(ret, key)
+	}
+	return []interface{}{next, ret}, nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestKeyCommands(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	Convey("The keyspace", t, func() {
+		state := newStateFrom(map[string]*Value{
+			"foo":            {Val: "1"},
+			"bar":            {Val: List{"a"}},
+			"baz":            {Val: Hash{"f": "v"}},
+			sequenceKey("x"): {Val: "1"},
+		})
+		valueOf(state, "foo").UpdateExpire(now.Add(10 * time.Second))
+
+		Convey("deletes keys", func() {
+			ret, err := NewCommand(DEL, "foo", "missing", "bar").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldEqual, 2)
+			ret, err = NewCommand(UNLINK, "baz").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldEqual, 1)
+			So(userKeys(state), ShouldBeEmpty)
+			So(NewCommand(DEL, "foo", "bar").Keys(), ShouldResemble, []string{"foo", "bar"})
+		})
+
+		Convey("counts existing keys", func() {
+			ret, err := NewCommand(EXISTS, "foo", "foo", "missing").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldEqual, 2)
+		})
+
+		Convey("names the type of keys", func() {
+			for key, typ := range map[string]string{"foo": "string", "bar": "list", "baz": "hash", "missing": "none"} {
+				ret, err := NewCommand(TYPE, key).Execute(state)
+				So(err, ShouldBeNil)
+				So(ret, ShouldEqual, typ)
+			}
+		})
+
+		Convey("renames keys with their expire time", func() {
+			ret, err := NewCommand(RENAME, "foo", "bar").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldEqual, "OK")
+			So(state.Has("foo"), ShouldBeFalse)
+			So(valueOf(state, "bar").Val, ShouldEqual, "1")
+			So(valueOf(state, "bar").Expire, ShouldResemble, now.Add(10*time.Second))
+
+			ret, err = NewCommand(RENAMENX, "bar", "baz").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldEqual, 0)
+			ret, err = NewCommand(RENAMENX, "bar", "qux").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldEqual, 1)
+
+			_, err = NewCommand(RENAME, "missing", "foo").Execute(state)
+			So(err, ShouldEqual, errNoSuchKey)
+		})
+
+		Convey("tells the time to live of keys", func() {
+			ret, err := stringCommand(now.Add(2500*time.Millisecond), TTL, "foo").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldEqual, 8)
+			ret, err = stringCommand(now.Add(2500*time.Millisecond), PTTL, "foo").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldEqual, 7500)
+			ret, err = stringCommand(now, TTL, "bar").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldEqual, -1)
+			ret, err = stringCommand(now, TTL, "missing").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldEqual, -2)
+		})
+
+		Convey("sets and removes expire times", func() {
+			ret, err := stringCommand(now, EXPIREAT, "bar", "1600000000").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldEqual, 1)
+			So(valueOf(state, "bar").Expire.Equal(time.Unix(1600000000, 0)), ShouldBeTrue)
+			ret, err = stringCommand(now, PEXPIRE, "baz", "1500").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldEqual, 1)
+			So(valueOf(state, "baz").Expire, ShouldResemble, now.Add(1500*time.Millisecond))
+			ret, err = stringCommand(now, PEXPIRE, "missing", "1500").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldEqual, 0)
+			_, err = stringCommand(now, EXPIRE, "baz", "9223372036854775807").Execute(state)
+			So(err, ShouldResemble, errInvalidExpire("expire"))
+
+			ret, err = NewCommand(PERSIST, "foo").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldEqual, 1)
+			So(valueOf(state, "foo").WillExpire, ShouldBeFalse)
+			ret, err = NewCommand(PERSIST, "foo").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldEqual, 0)
+		})
+
+		Convey("deletes keys given an expire time already passed", func() {
+			ret, err := stringCommand(now, EXPIRE, "foo", "-1").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldEqual, 1)
+			So(state.Has("foo"), ShouldBeFalse)
+			ret, err = stringCommand(now, PEXPIRE, "bar", "0").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldEqual, 1)
+			So(state.Has("bar"), ShouldBeFalse)
+			ret, err = stringCommand(now, EXPIREAT, "baz", "1500000000").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldEqual, 1)
+			So(state.Has("baz"), ShouldBeFalse)
+			ret, err = stringCommand(now, EXPIRE, "missing", "-1").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldEqual, 0)
+		})
+
+		Convey("lists keys matching a pattern, without the reserved ones", func() {
+			ret, err := NewCommand(KEYS, "*").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldResemble, []interface{}{"bar", "baz", "foo"})
+			ret, err = NewCommand(KEYS, "ba?").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldResemble, []interface{}{"bar", "baz"})
+
+			ret, err = NewCommand(DBSIZE, "").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldEqual, 3)
+		})
+
+		Convey("is scanned in key order", func() {
+			ret, err := NewCommand(SCAN, "0", "COUNT", "2").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldResemble, []interface{}{"2", []interface{}{"bar", "baz"}})
+			ret, err = NewCommand(SCAN, "2", "COUNT", "2").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldResemble, []interface{}{"0", []interface{}{"foo"}})
+
+			ret, err = NewCommand(SCAN, "0", "MATCH", "b*", "TYPE", "hash").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldResemble, []interface{}{"0", []interface{}{"baz"}})
+			_, err = NewCommand(SCAN, "0", "NOVALUES").Execute(state)
+			So(err, ShouldEqual, errSyntax)
+			_, err = NewCommand(SCAN, "x").Execute(state)
+			So(err, ShouldEqual, errInvalidCursor)
+		})
+	})
+}
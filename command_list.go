@@ -0,0 +1,339 @@
+// commands of the list family
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// List is the value of a list key. Lists are serialized as JSON arrays in
+// the state trie. Values are copied along with their list when a state is
+// cloned, so commands may change a list in place.
+type List []string
+
+var (
+	errIndexRange     = errors.New("index out of range")
+	errMustBePositive = errors.New("value is out of range, must be positive")
+)
+
+// getList returns the list at key. Keys holding another kind of value are
+// refused with errWrongType.
+func getList(state *State, key string) (List, bool, error) {
+	v, ok := state.Get(key)
+	if !ok {
+		return nil, false, nil
+	}
+	l, ok := v.Val.(List)
+	if !ok {
+		return nil, false, errWrongType
+	}
+	return l, true, nil
+}
+
+// setList stores a list at key, keeping the expire time of the key. Empty
+// lists are removed.
+func setList(state *State, key string, l List) {
+	if len(l) == 0 {
+		state.Delete(key)
+		return
+	}
+	if v, ok := state.Get(key); ok {
+		v.UpdateVal(l)
+		return
+	}
+	state.Set(key, &Value{Val: l})
+}
+
+// listIndex resolves an index counted from the end when negative
+func listIndex(l List, arg string) (int, bool, error) {
+	i, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil {
+		return 0, false, errNotInteger
+	}
+	if i < 0 {
+		i += int64(len(l))
+	}
+	if i < 0 || i >= int64(len(l)) {
+		return 0, false, nil
+	}
+	return int(i), true, nil
+}
+
+// listRange resolves the included range between start and stop, counted
+// from the end when negative. An empty range has start > stop.
+func listRange(length int, startArg, stopArg string) (int, int, error) {
+	start, err := strconv.ParseInt(startArg, 10, 64)
+	if err != nil {
+		return 0, 0, errNotInteger
+	}
+	stop, err := strconv.ParseInt(stopArg, 10, 64)
+	if err != nil {
+		return 0, 0, errNotInteger
+	}
+
+	n := int64(length)
+	if start < 0 {
+		start += n
+	}
+	if stop < 0 {
+		stop += n
+	}
+	if start < 0 {
+		start = 0
+	}
+	if start >= n || start > stop {
+		return 0, -1, nil
+	}
+	if stop >= n {
+		stop = n - 1
+	}
+	return int(start), int(stop), nil
+}
+
+// LPUSH key element [element ...], RPUSH key element [element ...]
+func (cmd Command) executePush(state *State, left bool) (interface{}, error) {
+	l, _, err := getList(state, cmd.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	if left {
+		pushed := make(List, 0, len(l)+len(cmd.Arguments))
+		for i := len(cmd.Arguments) - 1; i >= 0; i-- {
+			pushed = append(pushed, cmd.Arguments[i])
+		}
+		l = append(pushed, l...)
+	} else {
+		l = append(l, cmd.Arguments...)
+	}
+	setList(state, cmd.Key, l)
+	return int64(len(l)), nil
+}
+
+// LPOP key [count], RPOP key [count]
+func (cmd Command) executePop(state *State, left bool) (interface{}, error) {
+	count := int64(1)
+	if len(cmd.Arguments) > 0 {
+		var err error
+		count, err = strconv.ParseInt(cmd.Arguments[0], 10, 64)
+		if err != nil || count < 0 {
+			return nil, errMustBePositive
+		}
+	}
+	l, ok, err := getList(state, cmd.Key)
+	if err != nil || !ok {
+		return nil, err
+	}
+
+	if count > int64(len(l)) {
+		count = int64(len(l))
+	}
+	popped := make([]interface{}, 0, count)
+	for i := int64(0); i < count; i++ {
+		if left {
+			popped = append(popped, l[0])
+			l = l[1:]
+		} else {
+			popped = append(popped, l[len(l)-1])
+			l = l[:len(l)-1]
+		}
+	}
+	setList(state, cmd.Key, l)
+
+	if len(cmd.Arguments) == 0 {
+		return popped[0], nil
+	}
+	return popped, nil
+}
+
+func (cmd Command) executeLRange(state *State) (interface{}, error) {
+	l, _, err := getList(state, cmd.Key)
+	if err != nil {
+		return nil, err
+	}
+	start, stop, err := listRange(len(l), cmd.Arguments[0], cmd.Arguments[1])
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]interface{}, 0, stop-start+1)
+	for i := start; i <= stop; i++ {
+		ret = append(ret, l[i])
+	}
+	return ret, nil
+}
+
+func (cmd Command) executeLIndex(state *State) (interface{}, error) {
+	l, _, err := getList(state, cmd.Key)
+	if err != nil {
+		return nil, err
+	}
+	i, ok, err := listIndex(l, cmd.Arguments[0])
+	if err != nil || !ok {
+		return nil, err
+	}
+	return l[i], nil
+}
+
+// LSET key index element
+func (cmd Command) executeLSet(state *State) (interface{}, error) {
+	l, ok, err := getList(state, cmd.Key)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errNoSuchKey
+	}
+	i, ok, err := listIndex(l, cmd.Arguments[0])
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errIndexRange
+	}
+
+	l[i] = cmd.Arguments[1]
+	return "OK", nil
+}
+
+// LINSERT key BEFORE | AFTER pivot element
+func (cmd Command) executeLInsert(state *State) (interface{}, error) {
+	var after bool
+	switch strings.ToUpper(cmd.Arguments[0]) {
+	case "BEFORE":
+	case "AFTER":
+		after = true
+	default:
+		return nil, errSyntax
+	}
+	l, ok, err := getList(state, cmd.Key)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return int64(0), nil
+	}
+
+	pivot, element := cmd.Arguments[1], cmd.Arguments[2]
+	for i, e := range l {
+		if e != pivot {
+			continue
+		}
+		if after {
+			i++
+		}
+		l = append(l, "")
+		copy(l[i+1:], l[i:])
+		l[i] = element
+		setList(state, cmd.Key, l)
+		return int64(len(l)), nil
+	}
+	return int64(-1), nil
+}
+
+// LREM key count element removes count occurrences of element from the
+// head, from the tail when count is negative, or all of them when zero
+func (cmd Command) executeLRem(state *State) (interface{}, error) {
+	count, err := strconv.ParseInt(cmd.Arguments[0], 10, 64)
+	if err != nil {
+		return nil, errNotInteger
+	}
+	l, _, err := getList(state, cmd.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	element := cmd.Arguments[1]
+	fromTail := count < 0
+	if fromTail {
+		count = -count
+	}
+	removed := int64(0)
+	kept := make(List, 0, len(l))
+	for j := range l {
+		i := j
+		if fromTail {
+			i = len(l) - 1 - j
+		}
+		if l[i] == element && (count == 0 || removed < count) {
+			removed++
+			continue
+		}
+		kept = append(kept, l[i])
+	}
+	if fromTail {
+		for i, j := 0, len(kept)-1; i < j; i, j = i+1, j-1 {
+			kept[i], kept[j] = kept[j], kept[i]
+		}
+	}
+
+	if removed > 0 {
+		setList(state, cmd.Key, kept)
+	}
+	return removed, nil
+}
+
+// LTRIM key start stop
+func (cmd Command) executeLTrim(state *State) (interface{}, error) {
+	l, ok, err := getList(state, cmd.Key)
+	if err != nil {
+		return nil, err
+	}
+	start, stop, err := listRange(len(l), cmd.Arguments[0], cmd.Arguments[1])
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return "OK", nil
+	}
+
+	setList(state, cmd.Key, append(List{}, l[start:stop+1]...))
+	return "OK", nil
+}
+
+// LMOVE source destination LEFT | RIGHT LEFT | RIGHT
+func (cmd Command) executeLMove(state *State) (interface{}, error) {
+	destination := cmd.Arguments[0]
+	var from, to bool
+	for i, arg := range cmd.Arguments[1:3] {
+		var left bool
+		switch strings.ToUpper(arg) {
+		case "LEFT":
+			left = true
+		case "RIGHT":
+		default:
+			return nil, errSyntax
+		}
+		if i == 0 {
+			from = left
+		} else {
+			to = left
+		}
+	}
+
+	l, ok, err := getList(state, cmd.Key)
+	if err != nil || !ok {
+		return nil, err
+	}
+	if _, _, err := getList(state, destination); err != nil {
+		return nil, err
+	}
+
+	var element string
+	if from {
+		element, l = l[0], l[1:]
+	} else {
+		element, l = l[len(l)-1], l[:len(l)-1]
+	}
+	setList(state, cmd.Key, l)
+
+	dst, _, _ := getList(state, destination)
+	if to {
+		dst = append(List{element}, dst...)
+	} else {
+		dst = append(dst, element)
+	}
+	setList(state, destination, dst)
+	return element, nil
+}
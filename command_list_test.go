@@ -0,0 +1,151 @@
+package main
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestListCommands(t *testing.T) {
+	Convey("A list", t, func() {
+		state := newStateFrom(map[string]*Value{"str": {Val: "a"}})
+		_, err := NewCommand(RPUSH, "list", "a", "b", "c").Execute(state)
+		So(err, ShouldBeNil)
+
+		Convey("is pushed on both ends", func() {
+			ret, err := NewCommand(LPUSH, "list", "x", "y").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldEqual, 5)
+			So(valueOf(state, "list").Val, ShouldResemble, List{"y", "x", "a", "b", "c"})
+			So(valueOf(state, "list").Type(), ShouldEqual, "list")
+		})
+
+		Convey("is popped on both ends and removed once empty", func() {
+			ret, err := NewCommand(LPOP, "list").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldEqual, "a")
+			ret, err = NewCommand(RPOP, "list", "5").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldResemble, []interface{}{"c", "b"})
+			So(state.Has("list"), ShouldBeFalse)
+
+			ret, err = NewCommand(LPOP, "list").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldBeNil)
+			_, err = NewCommand(LPOP, "list", "-1").Execute(state)
+			So(err, ShouldEqual, errMustBePositive)
+		})
+
+		Convey("is read by range and index", func() {
+			ret, err := NewCommand(LRANGE, "list", "0", "-1").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldResemble, []interface{}{"a", "b", "c"})
+			ret, err = NewCommand(LRANGE, "list", "-2", "100").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldResemble, []interface{}{"b", "c"})
+			ret, err = NewCommand(LRANGE, "list", "2", "1").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldBeEmpty)
+
+			ret, err = NewCommand(LLEN, "list").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldEqual, 3)
+			ret, err = NewCommand(LINDEX, "list", "-1").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldEqual, "c")
+			ret, err = NewCommand(LINDEX, "list", "3").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldBeNil)
+		})
+
+		Convey("sets and inserts elements", func() {
+			ret, err := NewCommand(LSET, "list", "-1", "z").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldEqual, "OK")
+			_, err = NewCommand(LSET, "list", "3", "z").Execute(state)
+			So(err, ShouldEqual, errIndexRange)
+			_, err = NewCommand(LSET, "missing", "0", "z").Execute(state)
+			So(err, ShouldEqual, errNoSuchKey)
+
+			ret, err = NewCommand(LINSERT, "list", "before", "b", "x").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldEqual, 4)
+			ret, err = NewCommand(LINSERT, "list", "AFTER", "z", "y").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldEqual, 5)
+			So(valueOf(state, "list").Val, ShouldResemble, List{"a", "x", "b", "z", "y"})
+
+			ret, err = NewCommand(LINSERT, "list", "AFTER", "nope", "y").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldEqual, -1)
+			_, err = NewCommand(LINSERT, "list", "AROUND", "a", "y").Execute(state)
+			So(err, ShouldEqual, errSyntax)
+		})
+
+		Convey("removes elements from the head or the tail", func() {
+			_, err := NewCommand(RPUSH, "list", "a", "b", "a").Execute(state)
+			So(err, ShouldBeNil)
+
+			ret, err := NewCommand(LREM, "list", "-2", "a").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldEqual, 2)
+			So(valueOf(state, "list").Val, ShouldResemble, List{"a", "b", "c", "b"})
+
+			ret, err = NewCommand(LREM, "list", "0", "b").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldEqual, 2)
+			So(valueOf(state, "list").Val, ShouldResemble, List{"a", "c"})
+		})
+
+		Convey("is trimmed", func() {
+			ret, err := NewCommand(LTRIM, "list", "1", "-1").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldEqual, "OK")
+			So(valueOf(state, "list").Val, ShouldResemble, List{"b", "c"})
+
+			_, err = NewCommand(LTRIM, "list", "5", "10").Execute(state)
+			So(err, ShouldBeNil)
+			So(state.Has("list"), ShouldBeFalse)
+		})
+
+		Convey("moves elements between lists", func() {
+			ret, err := NewCommand(LMOVE, "list", "other", "RIGHT", "LEFT").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldEqual, "c")
+			ret, err = NewCommand(LMOVE, "list", "list", "left", "right").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldEqual, "a")
+			So(valueOf(state, "list").Val, ShouldResemble, List{"b", "a"})
+			So(valueOf(state, "other").Val, ShouldResemble, List{"c"})
+
+			_, err = NewCommand(LMOVE, "list", "str", "LEFT", "LEFT").Execute(state)
+			So(err, ShouldEqual, errWrongType)
+			So(valueOf(state, "list").Val, ShouldResemble, List{"b", "a"})
+			So(NewCommand(LMOVE, "list", "other", "LEFT", "LEFT").Keys(), ShouldResemble, []string{"list", "other"})
+		})
+
+		Convey("refuses commands of other types", func() {
+			_, err := NewCommand(GET, "list").Execute(state)
+			So(err, ShouldEqual, errWrongType)
+			_, err = NewCommand(APPEND, "list", "x").Execute(state)
+			So(err, ShouldEqual, errWrongType)
+			_, err = NewCommand(LPUSH, "str", "x").Execute(state)
+			So(err, ShouldEqual, errWrongType)
+			_, err = NewCommand(LRANGE, "str", "0", "-1").Execute(state)
+			So(err, ShouldEqual, errWrongType)
+		})
+
+		Convey("is not shared by cloned states", func() {
+			cloned := state.Snapshot()
+			_, err := NewCommand(LSET, "list", "0", "z").Execute(cloned)
+			So(err, ShouldBeNil)
+			So(valueOf(state, "list").Val, ShouldResemble, List{"a", "b", "c"})
+		})
+
+		Convey("is serialized as an array", func() {
+			encoded, err := valueOf(state, "list").encode()
+			So(err, ShouldBeNil)
+			So(string(encoded), ShouldEqual, `{"Val":["a","b","c"],"Expire":0}`)
+		})
+	})
+}
@@ -0,0 +1,171 @@
+// commands of the set family
+package main
+
+import "sort"
+
+// Set is the value of a set key. Members are replied sorted, and sets are
+// serialized as JSON objects whose keys are sorted too.
+type Set map[string]struct{}
+
+// members returns the members of a set, sorted
+func (s Set) members() respSet {
+	members := make([]string, 0, len(s))
+	for member := range s {
+		members = append(members, member)
+	}
+	sort.Strings(members)
+
+	ret := make(respSet, len(members))
+	for i, member := range members {
+		ret[i] = member
+	}
+	return ret
+}
+
+// getSet returns the set at key. Keys holding another kind of value are
+// refused with errWrongType.
+func getSet(state *State, key string) (Set, bool, error) {
+	v, ok := state.Get(key)
+	if !ok {
+		return nil, false, nil
+	}
+	s, ok := v.Val.(Set)
+	if !ok {
+		return nil, false, errWrongType
+	}
+	return s, true, nil
+}
+
+// SADD key member [member ...]
+func (cmd Command) executeSAdd(state *State) (interface{}, error) {
+	s, ok, err := getSet(state, cmd.Key)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		s = Set{}
+		state.Set(cmd.Key, &Value{Val: s})
+	}
+
+	added := int64(0)
+	for _, member := range cmd.Arguments {
+		if _, ok := s[member]; !ok {
+			s[member] = struct{}{}
+			added++
+		}
+	}
+	return added, nil
+}
+
+// SREM key member [member ...]
+func (cmd Command) executeSRem(state *State) (interface{}, error) {
+	s, _, err := getSet(state, cmd.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	removed := int64(0)
+	for _, member := range cmd.Arguments {
+		if _, ok := s[member]; ok {
+			delete(s, member)
+			removed++
+		}
+	}
+	if removed > 0 && len(s) == 0 {
+		state.Delete(cmd.Key)
+	}
+	return removed, nil
+}
+
+func (cmd Command) executeSIsMember(state *State) (interface{}, error) {
+	s, _, err := getSet(state, cmd.Key)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := s[cmd.Arguments[0]]; ok {
+		return int64(1), nil
+	}
+	return int64(0), nil
+}
+
+type setOP int
+
+const (
+	setInter setOP = iota
+	setUnion
+	setDiff
+)
+
+// combineSets combines the sets at keys into a new set. Missing keys are
+// empty sets.
+func combineSets(state *State, keys []string, op setOP) (Set, error) {
+	sets := make([]Set, len(keys))
+	for i, key := range keys {
+		s, _, err := getSet(state, key)
+		if err != nil {
+			return nil, err
+		}
+		sets[i] = s
+	}
+
+	combined := Set{}
+	if len(sets) == 0 {
+		return combined, nil
+	}
+	switch op {
+	case setInter:
+		for member := range sets[0] {
+			in := true
+			for _, s := range sets[1:] {
+				if _, ok := s[member]; !ok {
+					in = false
+					break
+				}
+			}
+			if in {
+				combined[member] = struct{}{}
+			}
+		}
+	case setUnion:
+		for _, s := range sets {
+			for member := range s {
+				combined[member] = struct{}{}
+			}
+		}
+	case setDiff:
+		for member := range sets[0] {
+			combined[member] = struct{}{}
+		}
+		for _, s := range sets[1:] {
+			for member := range s {
+				delete(combined, member)
+			}
+		}
+	}
+	return combined, nil
+}
+
+// SINTER key [key ...], SUNION key [key ...], SDIFF key [key ...]
+func (cmd Command) executeSCombine(state *State, op setOP) (interface{}, error) {
+	s, err := combineSets(state, cmd.Keys(), op)
+	if err != nil {
+		return nil, err
+	}
+	return s.members(), nil
+}
+
+// SINTERSTORE destination key [key ...] replaces destination whatever it
+// holds
+func (cmd Command) executeSInterStore(state *State) (interface{}, error) {
+	s, err := combineSets(state, cmd.Arguments, setInter)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(s) == 0 {
+		state.Delete(cmd.Key)
+	} else {
+		state.Set(cmd.Key, &Value{Val: s})
+	}
+	return int64(len(s)), nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestSetCommands(t *testing.T) {
+	Convey("A set", t, func() {
+		state := newStateFrom(map[string]*Value{"str": {Val: "a"}})
+		ret, err := NewCommand(SADD, "a", "x", "y", "z", "x").Execute(state)
+		So(err, ShouldBeNil)
+		So(ret, ShouldEqual, 3)
+		_, err = NewCommand(SADD, "b", "y", "z", "w").Execute(state)
+		So(err, ShouldBeNil)
+
+		Convey("holds members once", func() {
+			ret, err := NewCommand(SADD, "a", "x", "v").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldEqual, 1)
+			So(valueOf(state, "a").Type(), ShouldEqual, "set")
+
+			ret, err = NewCommand(SISMEMBER, "a", "v").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldEqual, 1)
+			ret, err = NewCommand(SISMEMBER, "a", "w").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldEqual, 0)
+			ret, err = NewCommand(SCARD, "a").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldEqual, 4)
+		})
+
+		Convey("lists members sorted", func() {
+			ret, err := NewCommand(SMEMBERS, "a").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldResemble, respSet{"x", "y", "z"})
+		})
+
+		Convey("removes members and is removed once empty", func() {
+			ret, err := NewCommand(SREM, "a", "x", "missing").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldEqual, 1)
+			_, err = NewCommand(SREM, "a", "y", "z").Execute(state)
+			So(err, ShouldBeNil)
+			So(state.Has("a"), ShouldBeFalse)
+		})
+
+		Convey("is combined with other sets", func() {
+			ret, err := NewCommand(SINTER, "a", "b").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldResemble, respSet{"y", "z"})
+			ret, err = NewCommand(SUNION, "a", "b", "missing").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldResemble, respSet{"w", "x", "y", "z"})
+			ret, err = NewCommand(SDIFF, "a", "b").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldResemble, respSet{"x"})
+			ret, err = NewCommand(SINTER, "a", "missing").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldBeEmpty)
+
+			_, err = NewCommand(SINTER, "a", "str").Execute(state)
+			So(err, ShouldEqual, errWrongType)
+			So(NewCommand(SDIFF, "a", "b").Keys(), ShouldResemble, []string{"a", "b"})
+		})
+
+		Convey("stores an intersection over any value", func() {
+			ret, err := NewCommand(SINTERSTORE, "str", "a", "b").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldEqual, 2)
+			So(valueOf(state, "str").Val, ShouldResemble, Set{"y": {}, "z": {}})
+
+			ret, err = NewCommand(SINTERSTORE, "str", "a", "missing").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldEqual, 0)
+			So(state.Has("str"), ShouldBeFalse)
+		})
+
+		Convey("is not shared by cloned states", func() {
+			cloned := state.Snapshot()
+			_, err := NewCommand(SADD, "a", "v").Execute(cloned)
+			So(err, ShouldBeNil)
+			So(valueOf(state, "a").Val, ShouldHaveLength, 3)
+		})
+
+		Convey("is serialized with sorted members", func() {
+			encoded, err := valueOf(state, "a").encode()
+			So(err, ShouldBeNil)
+			So(string(encoded), ShouldEqual, `{"Val":{"x":{},"y":{},"z":{}},"Expire":0}`)
+		})
+	})
+}
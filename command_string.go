@@ -0,0 +1,463 @@
+// commands of the string family
+//
+// Values are Go strings holding any bytes. Expire times are computed from
+// the time of the block applying the command, so every node applies them
+// the same way.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// strings are kept well below the 512MB allowed by Redis, as every node
+// holds every value
+const maxStringSize = 1 << 20
+
+var (
+	errSyntax        = errors.New("syntax error")
+	errNotFloat      = errors.New("value is not a valid float")
+	errOverflow      = errors.New("increment or decrement would overflow")
+	errOffsetRange   = errors.New("offset is out of range")
+	errStringTooLong = errors.New("string exceeds maximum allowed size (proto-max-bulk-len)")
+	errNoTime        = errors.New("command needs a block to know the time")
+)
+
+func errInvalidExpire(name string) error {
+	return fmt.Errorf("invalid expire time in '%s' command", name)
+}
+
+// getString returns the string at key. Keys holding another kind of value
+// are refused with errWrongType.
+func getString(state *State, key string) (string, bool, error) {
+	v, ok := state.Get(key)
+	if !ok {
+		return "", false, nil
+	}
+	s, ok := v.Val.(string)
+	if !ok {
+		return "", false, errWrongType
+	}
+	return s, true, nil
+}
+
+// now returns the time the command is applied at
+func (cmd Command) now() (time.Time, error) {
+	if cmd.at.IsZero() {
+		return time.Time{}, errNoTime
+	}
+	return cmd.at, nil
+}
+
+// expireAfter returns the time amount units after the command is applied.
+// The amount must be positive.
+func (cmd Command) expireAfter(amount int64, unit time.Duration, name string) (time.Time, error) {
+	if amount <= 0 || amount > math.MaxInt64/int64(unit) {
+		return time.Time{}, errInvalidExpire(name)
+	}
+	now, err := cmd.now()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return now.Add(time.Duration(amount) * unit), nil
+}
+
+// expireAt returns the time amount units after the unix epoch
+func expireAt(amount int64, unit time.Duration, name string) (time.Time, error) {
+	if amount <= 0 || amount > math.MaxInt64/int64(unit) {
+		return time.Time{}, errInvalidExpire(name)
+	}
+	return time.Unix(0, amount*int64(unit)).UTC(), nil
+}
+
+// expireOption parses the expire options shared by SET and GETEX: EX, PX,
+// EXAT and PXAT followed by an integer
+func (cmd Command) expireOption(option, arg, name string) (time.Time, error) {
+	amount, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil {
+		return time.Time{}, errNotInteger
+	}
+
+	switch option {
+	case "EX":
+		return cmd.expireAfter(amount, time.Second, name)
+	case "PX":
+		return cmd.expireAfter(amount, time.Millisecond, name)
+	case "EXAT":
+		return expireAt(amount, time.Second, name)
+	case "PXAT":
+		return expireAt(amount, time.Millisecond, name)
+	}
+	return time.Time{}, errSyntax
+}
+
+type setOptions struct {
+	nx, xx  bool
+	get     bool
+	keepTTL bool
+	expire  bool
+	at      time.Time
+}
+
+// SET key value [NX | XX] [GET] [EX seconds | PX milliseconds |
+// EXAT unix-time-seconds | PXAT unix-time-milliseconds | KEEPTTL]
+func (cmd Command) setOptions() (setOptions, error) {
+	var opts setOptions
+	args := cmd.Arguments[1:]
+	for i := 0; i < len(args); i++ {
+		switch option := strings.ToUpper(args[i]); option {
+		case "NX":
+			if opts.xx {
+				return opts, errSyntax
+			}
+			opts.nx = true
+		case "XX":
+			if opts.nx {
+				return opts, errSyntax
+			}
+			opts.xx = true
+		case "GET":
+			opts.get = true
+		case "KEEPTTL":
+			if opts.expire {
+				return opts, errSyntax
+			}
+			opts.keepTTL = true
+		case "EX", "PX", "EXAT", "PXAT":
+			if opts.expire || opts.keepTTL || i+1 >= len(args) {
+				return opts, errSyntax
+			}
+			at, err := cmd.expireOption(option, args[i+1], "set")
+			if err != nil {
+				return opts, err
+			}
+			opts.expire = true
+			opts.at = at
+			i++
+		default:
+			return opts, errSyntax
+		}
+	}
+	return opts, nil
+}
+
+func (cmd Command) executeSet(state *State) (interface{}, error) {
+	opts, err := cmd.setOptions()
+	if err != nil {
+		return nil, err
+	}
+
+	old, exists := state.Get(cmd.Key)
+	var ret interface{} = "OK"
+	if opts.get {
+		s, _, err := getString(state, cmd.Key)
+		if err != nil {
+			return nil, err
+		}
+		ret = nil
+		if exists {
+			ret = s
+		}
+	}
+	if (opts.nx && exists) || (opts.xx && !exists) {
+		if opts.get {
+			return ret, nil
+		}
+		return nil, nil
+	}
+
+	v := &Value{Val: cmd.Arguments[0]}
+	if opts.expire {
+		v.UpdateExpire(opts.at)
+	} else if opts.keepTTL && exists {
+		v.Expire, v.WillExpire = old.Expire, old.WillExpire
+	}
+	state.Set(cmd.Key, v)
+	return ret, nil
+}
+
+// SETEX key seconds value, PSETEX key milliseconds value
+func (cmd Command) executeSetEx(state *State, unit time.Duration, name string) (interface{}, error) {
+	amount, err := strconv.ParseInt(cmd.Arguments[0], 10, 64)
+	if err != nil {
+		return nil, errNotInteger
+	}
+	at, err := cmd.expireAfter(amount, unit, name)
+	if err != nil {
+		return nil, err
+	}
+
+	v := &Value{Val: cmd.Arguments[1]}
+	v.UpdateExpire(at)
+	state.Set(cmd.Key, v)
+	return "OK", nil
+}
+
+// MSET key value [key value ...], MSETNX key value [key value ...]
+func (cmd Command) executeMSet(state *State, nx bool, name string) (interface{}, error) {
+	if len(cmd.Arguments)%2 != 1 {
+		return nil, errWrongArity(name)
+	}
+
+	keys := cmd.Keys()
+	if nx {
+		for _, key := range keys {
+			if state.Has(key) {
+				return int64(0), nil
+			}
+		}
+	}
+	for i, key := range keys {
+		state.Set(key, &Value{Val: cmd.Arguments[2*i]})
+	}
+	if nx {
+		return int64(1), nil
+	}
+	return "OK", nil
+}
+
+// MGET key [key ...] returns nil for missing keys and keys holding another
+// kind of value
+func (cmd Command) executeMGet(state *State) (interface{}, error) {
+	keys := cmd.Keys()
+	ret := make([]interface{}, len(keys))
+	for i, key := range keys {
+		if s, ok, err := getString(state, key); ok && err == nil {
+			ret[i] = s
+		}
+	}
+	return ret, nil
+}
+
+func (cmd Command) executeAppend(state *State) (interface{}, error) {
+	s, ok, err := getString(state, cmd.Key)
+	if err != nil {
+		return nil, err
+	}
+	if len(s)+len(cmd.Arguments[0]) > maxStringSize {
+		return nil, errStringTooLong
+	}
+
+	s += cmd.Arguments[0]
+	if ok {
+		v, _ := state.Get(cmd.Key)
+		v.UpdateVal(s)
+	} else {
+		state.Set(cmd.Key, &Value{Val: s})
+	}
+	return int64(len(s)), nil
+}
+
+// GETRANGE key start end, both ends included and counted from the end of
+// the string when negative
+func (cmd Command) executeGetRange(state *State) (interface{}, error) {
+	start, err := strconv.ParseInt(cmd.Arguments[0], 10, 64)
+	if err != nil {
+		return nil, errNotInteger
+	}
+	end, err := strconv.ParseInt(cmd.Arguments[1], 10, 64)
+	if err != nil {
+		return nil, errNotInteger
+	}
+	s, _, err := getString(state, cmd.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	length := int64(len(s))
+	if start < 0 && end < 0 && start > end {
+		return "", nil
+	}
+	if start < 0 {
+		start += length
+	}
+	if end < 0 {
+		end += length
+	}
+	if start < 0 {
+		start = 0
+	}
+	if end < 0 {
+		end = 0
+	}
+	if end >= length {
+		end = length - 1
+	}
+	if length == 0 || start > end {
+		return "", nil
+	}
+	return s[start : end+1], nil
+}
+
+// SETRANGE key offset value overwrites part of a string, padding it with
+// zero bytes as needed
+func (cmd Command) executeSetRange(state *State) (interface{}, error) {
+	offset, err := strconv.ParseInt(cmd.Arguments[0], 10, 64)
+	if err != nil {
+		return nil, errNotInteger
+	}
+	if offset < 0 {
+		return nil, errOffsetRange
+	}
+	s, ok, err := getString(state, cmd.Key)
+	if err != nil {
+		return nil, err
+	}
+	value := cmd.Arguments[1]
+	if len(value) == 0 {
+		return int64(len(s)), nil
+	}
+	if offset > maxStringSize-int64(len(value)) {
+		return nil, errStringTooLong
+	}
+
+	b := []byte(s)
+	if end := int(offset) + len(value); end > len(b) {
+		b = append(b, make([]byte, end-len(b))...)
+	}
+	copy(b[offset:], value)
+	if ok {
+		v, _ := state.Get(cmd.Key)
+		v.UpdateVal(string(b))
+	} else {
+		state.Set(cmd.Key, &Value{Val: string(b)})
+	}
+	return int64(len(b)), nil
+}
+
+// incrBy adds to the integer at key, keeping its expire time
+func incrBy(state *State, key string, by int64) (interface{}, error) {
+	s, ok, err := getString(state, key)
+	if err != nil {
+		return nil, err
+	}
+	var i int64
+	if ok {
+		i, err = strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return nil, errNotInteger
+		}
+	}
+	if (by > 0 && i > math.MaxInt64-by) || (by < 0 && i < math.MinInt64-by) {
+		return nil, errOverflow
+	}
+
+	i += by
+	if ok {
+		v, _ := state.Get(key)
+		v.UpdateVal(strconv.FormatInt(i, 10))
+	} else {
+		state.Set(key, &Value{Val: strconv.FormatInt(i, 10)})
+	}
+	return i, nil
+}
+
+func (cmd Command) executeIncrBy(state *State, sign int64) (interface{}, error) {
+	by, err := strconv.ParseInt(cmd.Arguments[0], 10, 64)
+	if err != nil {
+		return nil, errNotInteger
+	}
+	if sign < 0 {
+		if by == math.MinInt64 {
+			return nil, errors.New("decrement would overflow")
+		}
+		by = -by
+	}
+	return incrBy(state, cmd.Key, by)
+}
+
+// INCRBYFLOAT key increment. The result is formatted as the shortest
+// decimal reading back to the same float64.
+func (cmd Command) executeIncrByFloat(state *State) (interface{}, error) {
+	by, err := parseFloat(cmd.Arguments[0])
+	if err != nil {
+		return nil, err
+	}
+	s, ok, err := getString(state, cmd.Key)
+	if err != nil {
+		return nil, err
+	}
+	var f float64
+	if ok {
+		f, err = parseFloat(s)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	f += by
+	if math.IsInf(f, 0) || math.IsNaN(f) {
+		return nil, errors.New("increment would produce NaN or Infinity")
+	}
+	result := strconv.FormatFloat(f, 'f', -1, 64)
+	if ok {
+		v, _ := state.Get(cmd.Key)
+		v.UpdateVal(result)
+	} else {
+		state.Set(cmd.Key, &Value{Val: result})
+	}
+	return result, nil
+}
+
+func parseFloat(s string) (float64, error) {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsInf(f, 0) || math.IsNaN(f) {
+		return 0, errNotFloat
+	}
+	return f, nil
+}
+
+func (cmd Command) executeGetDel(state *State) (interface{}, error) {
+	s, ok, err := getString(state, cmd.Key)
+	if err != nil || !ok {
+		return nil, err
+	}
+	state.Delete(cmd.Key)
+	return s, nil
+}
+
+// GETEX key [EX seconds | PX milliseconds | EXAT unix-time-seconds |
+// PXAT unix-time-milliseconds | PERSIST]
+func (cmd Command) executeGetEx(state *State) (interface{}, error) {
+	var at time.Time
+	var err error
+	expire, persist := false, false
+	for i := 0; i < len(cmd.Arguments); i++ {
+		switch option := strings.ToUpper(cmd.Arguments[i]); option {
+		case "PERSIST":
+			if expire || persist {
+				return nil, errSyntax
+			}
+			persist = true
+		case "EX", "PX", "EXAT", "PXAT":
+			if expire || persist || i+1 >= len(cmd.Arguments) {
+				return nil, errSyntax
+			}
+			at, err = cmd.expireOption(option, cmd.Arguments[i+1], "getex")
+			if err != nil {
+				return nil, err
+			}
+			expire = true
+			i++
+		default:
+			return nil, errSyntax
+		}
+	}
+	s, ok, err := getString(state, cmd.Key)
+	if err != nil || !ok {
+		return nil, err
+	}
+
+	v, _ := state.Get(cmd.Key)
+	if expire {
+		v.UpdateExpire(at)
+	}
+	if persist {
+		v.Expire, v.WillExpire = time.Time{}, false
+	}
+	return s, nil
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// stringCommand returns a command applied at now
+func stringCommand(now time.Time, op OP, key string, arguments ...string) Command {
+	cmd := NewCommand(op, key, arguments...)
+	cmd.at = now
+	return cmd
+}
+
+func TestStringCommands(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	Convey("SET", t, func() {
+		state := newStateFrom(map[string]*Value{"foo": {Val: "1"}})
+		valueOf(state, "foo").UpdateExpire(now.Add(time.Minute))
+
+		Convey("replaces the value and its expire time", func() {
+			ret, err := stringCommand(now, SET, "foo", "2").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldEqual, "OK")
+			So(valueOf(state, "foo").Val, ShouldEqual, "2")
+			So(valueOf(state, "foo").WillExpire, ShouldBeFalse)
+		})
+
+		Convey("keeps the expire time with KEEPTTL", func() {
+			_, err := stringCommand(now, SET, "foo", "2", "keepttl").Execute(state)
+			So(err, ShouldBeNil)
+			So(valueOf(state, "foo").WillExpire, ShouldBeTrue)
+			So(valueOf(state, "foo").Expire, ShouldResemble, now.Add(time.Minute))
+		})
+
+		Convey("sets an expire time with EX, PX, EXAT and PXAT", func() {
+			_, err := stringCommand(now, SET, "a", "1", "EX", "10").Execute(state)
+			So(err, ShouldBeNil)
+			So(valueOf(state, "a").Expire, ShouldResemble, now.Add(10*time.Second))
+
+			_, err = stringCommand(now, SET, "a", "1", "PX", "1500").Execute(state)
+			So(err, ShouldBeNil)
+			So(valueOf(state, "a").Expire, ShouldResemble, now.Add(1500*time.Millisecond))
+
+			_, err = stringCommand(now, SET, "a", "1", "EXAT", "1600000000").Execute(state)
+			So(err, ShouldBeNil)
+			So(valueOf(state, "a").Expire.Equal(time.Unix(1600000000, 0)), ShouldBeTrue)
+
+			_, err = stringCommand(now, SET, "a", "1", "PXAT", "1600000000500").Execute(state)
+			So(err, ShouldBeNil)
+			So(valueOf(state, "a").Expire.Equal(time.Unix(1600000000, 500*int64(time.Millisecond))), ShouldBeTrue)
+		})
+
+		Convey("only sets missing keys with NX", func() {
+			ret, err := stringCommand(now, SET, "foo", "2", "NX").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldBeNil)
+			So(valueOf(state, "foo").Val, ShouldEqual, "1")
+
+			ret, err = stringCommand(now, SET, "bar", "2", "NX").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldEqual, "OK")
+			So(valueOf(state, "bar").Val, ShouldEqual, "2")
+		})
+
+		Convey("only sets existing keys with XX", func() {
+			ret, err := stringCommand(now, SET, "bar", "2", "XX").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldBeNil)
+			_, ok := state.Get("bar")
+			So(ok, ShouldBeFalse)
+
+			ret, err = stringCommand(now, SET, "foo", "2", "XX").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldEqual, "OK")
+		})
+
+		Convey("returns the old value with GET", func() {
+			ret, err := stringCommand(now, SET, "foo", "2", "GET").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldEqual, "1")
+
+			ret, err = stringCommand(now, SET, "bar", "2", "GET").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldBeNil)
+
+			state.Set("list", &Value{Val: 1})
+			_, err = stringCommand(now, SET, "list", "2", "GET").Execute(state)
+			So(err, ShouldEqual, errWrongType)
+			So(valueOf(state, "list").Val, ShouldEqual, 1)
+		})
+
+		Convey("refuses invalid options", func() {
+			for _, args := range [][]string{
+				{"NX", "XX"},
+				{"EX", "10", "PX", "100"},
+				{"EX", "10", "KEEPTTL"},
+				{"EX"},
+				{"FOO"},
+			} {
+				_, err := stringCommand(now, SET, "foo", append([]string{"2"}, args...)...).Execute(state)
+				So(err, ShouldEqual, errSyntax)
+			}
+
+			_, err := stringCommand(now, SET, "foo", "2", "EX", "x").Execute(state)
+			So(err, ShouldEqual, errNotInteger)
+			_, err = stringCommand(now, SET, "foo", "2", "EX", "0").Execute(state)
+			So(err.Error(), ShouldEqual, "invalid expire time in 'set' command")
+			So(valueOf(state, "foo").Val, ShouldEqual, "1")
+		})
+	})
+
+	Convey("SETNX", t, func() {
+		state := newStateFrom(map[string]*Value{"foo": {Val: "1"}})
+
+		ret, err := stringCommand(now, SETNX, "foo", "2").Execute(state)
+		So(err, ShouldBeNil)
+		So(ret, ShouldEqual, 0)
+		So(valueOf(state, "foo").Val, ShouldEqual, "1")
+
+		ret, err = stringCommand(now, SETNX, "bar", "2").Execute(state)
+		So(err, ShouldBeNil)
+		So(ret, ShouldEqual, 1)
+		So(valueOf(state, "bar").Val, ShouldEqual, "2")
+	})
+
+	Convey("SETEX and PSETEX", t, func() {
+		state := NewState()
+
+		Convey("set a value with an expire time", func() {
+			ret, err := stringCommand(now, SETEX, "foo", "10", "bar").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldEqual, "OK")
+			So(valueOf(state, "foo").Val, ShouldEqual, "bar")
+			So(valueOf(state, "foo").Expire, ShouldResemble, now.Add(10*time.Second))
+
+			_, err = stringCommand(now, PSETEX, "foo", "10", "baz").Execute(state)
+			So(err, ShouldBeNil)
+			So(valueOf(state, "foo").Val, ShouldEqual, "baz")
+			So(valueOf(state, "foo").Expire, ShouldResemble, now.Add(10*time.Millisecond))
+		})
+
+		Convey("refuse invalid expire times", func() {
+			_, err := stringCommand(now, SETEX, "foo", "-1", "bar").Execute(state)
+			So(err.Error(), ShouldEqual, "invalid expire time in 'setex' command")
+			_, err = stringCommand(now, PSETEX, "foo", "0", "bar").Execute(state)
+			So(err.Error(), ShouldEqual, "invalid expire time in 'psetex' command")
+			_, err = stringCommand(now, SETEX, "foo", "x", "bar").Execute(state)
+			So(err, ShouldEqual, errNotInteger)
+			So(state.Len(), ShouldEqual, 0)
+		})
+
+		Convey("need the time of a transaction", func() {
+			_, err := NewCommand(SETEX, "foo", "10", "bar").Execute(state)
+			So(err, ShouldEqual, errNoTime)
+		})
+	})
+
+	Convey("MSET, MSETNX and MGET", t, func() {
+		state := newStateFrom(map[string]*Value{"foo": {Val: "1"}, "list": {Val: 1}})
+
+		Convey("set and get several keys", func() {
+			ret, err := NewCommand(MSET, "a", "1", "b", "2").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldEqual, "OK")
+
+			ret, err = NewCommand(MGET, "a", "b", "missing", "list").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldResemble, []interface{}{"1", "2", nil, nil})
+		})
+
+		Convey("set nothing with MSETNX if any key exists", func() {
+			ret, err := NewCommand(MSETNX, "a", "1", "foo", "2").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldEqual, 0)
+			_, ok := state.Get("a")
+			So(ok, ShouldBeFalse)
+			So(valueOf(state, "foo").Val, ShouldEqual, "1")
+
+			ret, err = NewCommand(MSETNX, "a", "1", "b", "2").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldEqual, 1)
+			So(valueOf(state, "b").Val, ShouldEqual, "2")
+		})
+
+		Convey("need a value for every key", func() {
+			_, err := NewCommand(MSET, "a", "1", "b").Execute(state)
+			So(err.Error(), ShouldEqual, "wrong number of arguments for 'mset' command")
+		})
+
+		Convey("touch every key", func() {
+			So(NewCommand(MSET, "a", "1", "b", "2").Keys(), ShouldResemble, []string{"a", "b"})
+			So(NewCommand(MGET, "a", "b").Keys(), ShouldResemble, []string{"a", "b"})
+		})
+	})
+
+	Convey("APPEND and STRLEN", t, func() {
+		state := newStateFrom(map[string]*Value{"foo": {Val: "Hello"}})
+
+		ret, err := NewCommand(APPEND, "foo", " World").Execute(state)
+		So(err, ShouldBeNil)
+		So(ret, ShouldEqual, 11)
+		So(valueOf(state, "foo").Val, ShouldEqual, "Hello World")
+
+		ret, err = NewCommand(APPEND, "bar", "x").Execute(state)
+		So(err, ShouldBeNil)
+		So(ret, ShouldEqual, 1)
+
+		ret, err = NewCommand(STRLEN, "foo").Execute(state)
+		So(err, ShouldBeNil)
+		So(ret, ShouldEqual, 11)
+		ret, err = NewCommand(STRLEN, "missing").Execute(state)
+		So(err, ShouldBeNil)
+		So(ret, ShouldEqual, 0)
+
+		_, err = NewCommand(APPEND, "foo", strings.Repeat("x", maxStringSize)).Execute(state)
+		So(err, ShouldEqual, errStringTooLong)
+	})
+
+	Convey("GETRANGE", t, func() {
+		state := newStateFrom(map[string]*Value{"foo": {Val: "This is a string"}})
+
+		for _, c := range []struct {
+			start, end, expected string
+		}{
+			{"0", "3", "This"},
+			{"-3", "-1", "ing"},
+			{"0", "-1", "This is a string"},
+			{"10", "100", "string"},
+			{"5", "3", ""},
+			{"-1", "-5", ""},
+			{"-100", "3", "This"},
+		} {
+			ret, err := NewCommand(GETRANGE, "foo", c.start, c.end).Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldEqual, c.expected)
+		}
+
+		ret, err := NewCommand(GETRANGE, "missing", "0", "-1").Execute(state)
+		So(err, ShouldBeNil)
+		So(ret, ShouldEqual, "")
+		_, err = NewCommand(GETRANGE, "foo", "a", "1").Execute(state)
+		So(err, ShouldEqual, errNotInteger)
+	})
+
+	Convey("SETRANGE", t, func() {
+		state := newStateFrom(map[string]*Value{"foo": {Val: "Hello World"}})
+
+		ret, err := NewCommand(SETRANGE, "foo", "6", "Redis").Execute(state)
+		So(err, ShouldBeNil)
+		So(ret, ShouldEqual, 11)
+		So(valueOf(state, "foo").Val, ShouldEqual, "Hello Redis")
+
+		ret, err = NewCommand(SETRANGE, "bar", "3", "x").Execute(state)
+		So(err, ShouldBeNil)
+		So(ret, ShouldEqual, 4)
+		So(valueOf(state, "bar").Val, ShouldEqual, "\x00\x00\x00x")
+
+		ret, err = NewCommand(SETRANGE, "missing", "3", "").Execute(state)
+		So(err, ShouldBeNil)
+		So(ret, ShouldEqual, 0)
+		_, ok := state.Get("missing")
+		So(ok, ShouldBeFalse)
+
+		_, err = NewCommand(SETRANGE, "foo", "-1", "x").Execute(state)
+		So(err, ShouldEqual, errOffsetRange)
+		_, err = NewCommand(SETRANGE, "foo", "1", strings.Repeat("x", maxStringSize)).Execute(state)
+		So(err, ShouldEqual, errStringTooLong)
+		for _, offset := range []string{"9223372036854775807", "9223372036854775806", strconv.Itoa(maxStringSize)} {
+			_, err = NewCommand(SETRANGE, "foo", offset, "a").Execute(state)
+			So(err, ShouldEqual, errStringTooLong)
+		}
+	})
+
+	Convey("INCRBY, DECR and DECRBY", t, func() {
+		state := newStateFrom(map[string]*Value{"foo": {Val: "10"}})
+		valueOf(state, "foo").UpdateExpire(now)
+
+		ret, err := NewCommand(INCRBY, "foo", "5").Execute(state)
+		So(err, ShouldBeNil)
+		So(ret, ShouldEqual, 15)
+
+		ret, err = NewCommand(DECR, "foo").Execute(state)
+		So(err, ShouldBeNil)
+		So(ret, ShouldEqual, 14)
+
+		ret, err = NewCommand(DECRBY, "foo", "20").Execute(state)
+		So(err, ShouldBeNil)
+		So(ret, ShouldEqual, -6)
+		So(valueOf(state, "foo").Val, ShouldEqual, "-6")
+		So(valueOf(state, "foo").WillExpire, ShouldBeTrue)
+
+		ret, err = NewCommand(DECR, "missing").Execute(state)
+		So(err, ShouldBeNil)
+		So(ret, ShouldEqual, -1)
+
+		Convey("refuse to overflow", func() {
+			state.Set("max", &Value{Val: "9223372036854775807"})
+			_, err := NewCommand(INCRBY, "max", "1").Execute(state)
+			So(err, ShouldEqual, errOverflow)
+			_, err = NewCommand(DECRBY, "foo", "-9223372036854775808").Execute(state)
+			So(err.Error(), ShouldEqual, "decrement would overflow")
+			So(valueOf(state, "max").Val, ShouldEqual, "9223372036854775807")
+		})
+
+		Convey("refuse values which are not integers", func() {
+			_, err := NewCommand(INCRBY, "foo", "1.5").Execute(state)
+			So(err, ShouldEqual, errNotInteger)
+			state.Set("float", &Value{Val: "1.5"})
+			_, err = NewCommand(DECR, "float").Execute(state)
+			So(err, ShouldEqual, errNotInteger)
+		})
+	})
+
+	Convey("INCRBYFLOAT", t, func() {
+		state := newStateFrom(map[string]*Value{"foo": {Val: "10.50"}})
+
+		ret, err := NewCommand(INCRBYFLOAT, "foo", "0.1").Execute(state)
+		So(err, ShouldBeNil)
+		So(ret, ShouldEqual, "10.6")
+		So(valueOf(state, "foo").Val, ShouldEqual, "10.6")
+
+		ret, err = NewCommand(INCRBYFLOAT, "bar", "5.0e3").Execute(state)
+		So(err, ShouldBeNil)
+		So(ret, ShouldEqual, "5000")
+
+		_, err = NewCommand(INCRBYFLOAT, "foo", "x").Execute(state)
+		So(err, ShouldEqual, errNotFloat)
+		_, err = NewCommand(INCRBYFLOAT, "foo", "inf").Execute(state)
+		So(err, ShouldEqual, errNotFloat)
+		state.Set("max", &Value{Val: "1.7e308"})
+		_, err = NewCommand(INCRBYFLOAT, "max", "1.7e308").Execute(state)
+		So(err, ShouldNotBeNil)
+		So(valueOf(state, "max").Val, ShouldEqual, "1.7e308")
+	})
+
+	Convey("GETDEL", t, func() {
+		state := newStateFrom(map[string]*Value{"foo": {Val: "1"}})
+
+		ret, err := NewCommand(GETDEL, "foo").Execute(state)
+		So(err, ShouldBeNil)
+		So(ret, ShouldEqual, "1")
+		_, ok := state.Get("foo")
+		So(ok, ShouldBeFalse)
+
+		ret, err = NewCommand(GETDEL, "foo").Execute(state)
+		So(err, ShouldBeNil)
+		So(ret, ShouldBeNil)
+	})
+
+	Convey("GETEX", t, func() {
+		state := newStateFrom(map[string]*Value{"foo": {Val: "1"}})
+
+		ret, err := stringCommand(now, GETEX, "foo", "EX", "10").Execute(state)
+		So(err, ShouldBeNil)
+		So(ret, ShouldEqual, "1")
+		So(valueOf(state, "foo").Expire, ShouldResemble, now.Add(10*time.Second))
+
+		ret, err = stringCommand(now, GETEX, "foo", "PERSIST").Execute(state)
+		So(err, ShouldBeNil)
+		So(ret, ShouldEqual, "1")
+		So(valueOf(state, "foo").WillExpire, ShouldBeFalse)
+
+		ret, err = stringCommand(now, GETEX, "missing", "EX", "10").Execute(state)
+		So(err, ShouldBeNil)
+		So(ret, ShouldBeNil)
+
+		_, err = stringCommand(now, GETEX, "foo", "EX", "10", "PERSIST").Execute(state)
+		So(err, ShouldEqual, errSyntax)
+	})
+}
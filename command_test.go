@@ -9,14 +9,14 @@ import (
 
 func TestCommand(t *testing.T) {
 	Convey("INCR", t, func() {
-		state := State{"foo": &Value{Val: "1"}}
+		state := newStateFrom(map[string]*Value{"foo": {Val: "1"}})
 
 		Convey("can update state", func() {
 			command := NewCommand(INCR, "foo")
 
 			_, err := command.Execute(state)
 			So(err, ShouldBeNil)
-			So(state["foo"].Val, ShouldEqual, "2")
+			So(valueOf(state, "foo").Val, ShouldEqual, "2")
 		})
 
 		Convey("initialize key as 0 if not exists", func() {
@@ -24,12 +24,12 @@ func TestCommand(t *testing.T) {
 			_, err := command.Execute(state)
 
 			So(err, ShouldBeNil)
-			So(state["foo"].Val, ShouldEqual, "1")
-			So(state["bar"].Val, ShouldEqual, "1")
+			So(valueOf(state, "foo").Val, ShouldEqual, "1")
+			So(valueOf(state, "bar").Val, ShouldEqual, "1")
 		})
 
 		Convey("return err if value can't be parsed as string", func() {
-			state = State{"foo": &Value{Val: "x"}}
+			state = newStateFrom(map[string]*Value{"foo": {Val: "x"}})
 			command := NewCommand(INCR, "foo")
 
 			_, err := command.Execute(state)
@@ -38,7 +38,7 @@ func TestCommand(t *testing.T) {
 	})
 
 	Convey("GET", t, func() {
-		state := State{"foo": &Value{Val: "1"}}
+		state := newStateFrom(map[string]*Value{"foo": {Val: "1"}})
 
 		Convey("can return state", func() {
 			cmd := NewCommand(GET, "foo")
@@ -47,12 +47,12 @@ func TestCommand(t *testing.T) {
 			So(err, ShouldBeNil)
 			So(ret, ShouldEqual, "1")
 
-			So(state["foo"].Val, ShouldEqual, "1")
+			So(valueOf(state, "foo").Val, ShouldEqual, "1")
 		})
 	})
 
 	Convey("GETSET", t, func() {
-		state := State{"foo": &Value{Val: "1"}}
+		state := newStateFrom(map[string]*Value{"foo": {Val: "1"}})
 
 		Convey("can update and set state", func() {
 			cmd := NewCommand(GETSET, "foo", "2")
@@ -61,11 +61,11 @@ func TestCommand(t *testing.T) {
 			So(err, ShouldBeNil)
 			So(ret, ShouldEqual, "1")
 
-			So(state["foo"].Val, ShouldEqual, "2")
+			So(valueOf(state, "foo").Val, ShouldEqual, "2")
 		})
 
 		Convey("returns error if key is associated with a non-string value", func() {
-			state := State{"foo": &Value{Val: 1}}
+			state := newStateFrom(map[string]*Value{"foo": {Val: 1}})
 
 			cmd := NewCommand(GETSET, "foo", "2")
 
@@ -75,19 +75,19 @@ func TestCommand(t *testing.T) {
 	})
 
 	Convey("EXPIRE", t, func() {
-		state := State{"foo": &Value{Val: "1"}}
+		state := newStateFrom(map[string]*Value{"foo": {Val: "1"}})
 
 		Convey("can set a value to correct expire time", func() {
 			cmd := NewCommand(EXPIRE, "foo", "1")
-			// expire command need to be in a transaction to know when to expire
-			cmd.TX = &Transaction{Header: TransactionHeader{Time: time.Now()}}
+			// expire command need to be applied by a block to know when to expire
+			cmd.at = time.Now()
 
 			ret, err := cmd.Execute(state)
 			So(err, ShouldBeNil)
-			So(ret, ShouldEqual, "OK")
+			So(ret, ShouldEqual, int64(1))
 
-			So(state["foo"].Val, ShouldEqual, "1")
-			So(state["foo"].WillExpire, ShouldEqual, true)
+			So(valueOf(state, "foo").Val, ShouldEqual, "1")
+			So(valueOf(state, "foo").WillExpire, ShouldEqual, true)
 		})
 	})
 }
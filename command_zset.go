@@ -0,0 +1,509 @@
+// commands of the sorted set family
+//
+// Scores are float64 and only ever parsed, compared and added, which Go
+// does the same way on every platform. Members are ordered by score, then
+// bytewise, so ties never depend on the node.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ZSet is the value of a sorted set key, the score of each member
+type ZSet map[string]float64
+
+var (
+	errScoreNaN      = errors.New("resulting score is not a number (NaN)")
+	errScoreRange    = errors.New("min or max is not a float")
+	errLexRange      = errors.New("min or max not valid string range item")
+	errZAddNXXX      = errors.New("XX and NX options at the same time are not compatible")
+	errZAddGTLTNX    = errors.New("GT, LT, and/or NX options at the same time are not compatible")
+	errZAddIncrPairs = errors.New("INCR option supports a single increment-element pair")
+	errZRangeLimit   = errors.New("syntax error, LIMIT is only supported in combination with either BYSCORE or BYLEX")
+	errZRangeLex     = errors.New("syntax error, WITHSCORES not supported in combination with BYLEX")
+)
+
+// MarshalJSON serializes scores as strings, as JSON has no infinity
+func (z ZSet) MarshalJSON() ([]byte, error) {
+	scores := make(map[string]string, len(z))
+	for member, score := range z {
+		scores[member] = formatScore(score)
+	}
+	return json.Marshal(scores)
+}
+
+type zmember struct {
+	member string
+	score  float64
+}
+
+// sorted returns the members of a sorted set in order
+func (z ZSet) sorted() []zmember {
+	members := make([]zmember, 0, len(z))
+	for member, score := range z {
+		members = append(members, zmember{member, score})
+	}
+	sort.Slice(members, func(i, j int) bool {
+		if members[i].score != members[j].score {
+			return members[i].score < members[j].score
+		}
+		return members[i].member < members[j].member
+	})
+	return members
+}
+
+// parseScore parses a score, refusing NaN but allowing infinities
+func parseScore(s string) (float64, error) {
+	f, err := strconv.ParseFloat(s, 64)
+	if (err != nil && !errors.Is(err, strconv.ErrRange)) || math.IsNaN(f) {
+		return 0, errNotFloat
+	}
+	return f, nil
+}
+
+// formatScore formats a score the shortest way it parses back, like Redis
+func formatScore(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "inf"
+	case math.IsInf(f, -1):
+		return "-inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// getZSet returns the sorted set at key. Keys holding another kind of value
+// are refused with errWrongType.
+func getZSet(state *State, key string) (ZSet, bool, error) {
+	v, ok := state.Get(key)
+	if !ok {
+		return nil, false, nil
+	}
+	z, ok := v.Val.(ZSet)
+	if !ok {
+		return nil, false, errWrongType
+	}
+	return z, true, nil
+}
+
+// appendMembers appends members to a reply, each followed by its score
+// when withScores
+func appendMembers(ret []interface{}, members []zmember, withScores bool) []interface{} {
+	for _, m := range members {
+		ret = append(ret, m.member)
+		if withScores {
+			ret = append(ret, formatScore(m.score))
+		}
+	}
+	return ret
+}
+
+// ZADD key [NX | XX] [GT | LT] [CH] [INCR] score member [score member ...]
+func (cmd Command) executeZAdd(state *State) (interface{}, error) {
+	var nx, xx, gt, lt, ch, incr bool
+	i := 0
+options:
+	for ; i < len(cmd.Arguments); i++ {
+		switch strings.ToUpper(cmd.Arguments[i]) {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "GT":
+			gt = true
+		case "LT":
+			lt = true
+		case "CH":
+			ch = true
+		case "INCR":
+			incr = true
+		default:
+			break options
+		}
+	}
+	pairs := cmd.Arguments[i:]
+	if len(pairs) == 0 || len(pairs)%2 != 0 {
+		return nil, errSyntax
+	}
+	if nx && xx {
+		return nil, errZAddNXXX
+	}
+	if (gt && lt) || (nx && (gt || lt)) {
+		return nil, errZAddGTLTNX
+	}
+	if incr && len(pairs) > 2 {
+		return nil, errZAddIncrPairs
+	}
+	scores := make([]float64, len(pairs)/2)
+	for j := range scores {
+		score, err := parseScore(pairs[2*j])
+		if err != nil {
+			return nil, err
+		}
+		scores[j] = score
+	}
+
+	z, ok, err := getZSet(state, cmd.Key)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		z = ZSet{}
+	}
+
+	added, changed := int64(0), int64(0)
+	var incremented interface{}
+	for j, score := range scores {
+		member := pairs[2*j+1]
+		current, exists := z[member]
+		if (nx && exists) || (xx && !exists) {
+			continue
+		}
+		if incr && exists {
+			score += current
+			if math.IsNaN(score) {
+				return nil, errScoreNaN
+			}
+		}
+		if exists && ((gt && score <= current) || (lt && score >= current)) {
+			continue
+		}
+
+		incremented = formatScore(score)
+		if !exists {
+			added++
+		} else if score != current {
+			changed++
+		}
+		z[member] = score
+	}
+
+	if !ok && len(z) > 0 {
+		state.Set(cmd.Key, &Value{Val: z})
+	}
+	if incr {
+		return incremented, nil
+	}
+	if ch {
+		return added + changed, nil
+	}
+	return added, nil
+}
+
+// ZINCRBY key increment member
+func (cmd Command) executeZIncrBy(state *State) (interface{}, error) {
+	by, err := parseScore(cmd.Arguments[0])
+	if err != nil {
+		return nil, err
+	}
+	z, ok, err := getZSet(state, cmd.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	score := z[cmd.Arguments[1]] + by
+	if math.IsNaN(score) {
+		return nil, errScoreNaN
+	}
+	if !ok {
+		z = ZSet{}
+		state.Set(cmd.Key, &Value{Val: z})
+	}
+	z[cmd.Arguments[1]] = score
+	return formatScore(score), nil
+}
+
+// ZREM key member [member ...]
+func (cmd Command) executeZRem(state *State) (interface{}, error) {
+	z, _, err := getZSet(state, cmd.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	removed := int64(0)
+	for _, member := range cmd.Arguments {
+		if _, ok := z[member]; ok {
+			delete(z, member)
+			removed++
+		}
+	}
+	if removed > 0 && len(z) == 0 {
+		state.Delete(cmd.Key)
+	}
+	return removed, nil
+}
+
+func (cmd Command) executeZScore(state *State) (interface{}, error) {
+	z, _, err := getZSet(state, cmd.Key)
+	if err != nil {
+		return nil, err
+	}
+	if score, ok := z[cmd.Arguments[0]]; ok {
+		return score, nil
+	}
+	return nil, nil
+}
+
+// ZRANK key member [WITHSCORE]
+func (cmd Command) executeZRank(state *State) (interface{}, error) {
+	withScore := false
+	switch {
+	case len(cmd.Arguments) == 2 && strings.EqualFold(cmd.Arguments[1], "WITHSCORE"):
+		withScore = true
+	case len(cmd.Arguments) != 1:
+		return nil, errSyntax
+	}
+	z, _, err := getZSet(state, cmd.Key)
+	if err != nil {
+		return nil, err
+	}
+	score, ok := z[cmd.Arguments[0]]
+	if !ok {
+		return nil, nil
+	}
+
+	rank := int64(0)
+	for _, m := range z.sorted() {
+		if m.member == cmd.Arguments[0] {
+			break
+		}
+		rank++
+	}
+	if withScore {
+		return []interface{}{rank, formatScore(score)}, nil
+	}
+	return rank, nil
+}
+
+type scoreBound struct {
+	value     float64
+	exclusive bool
+}
+
+// parseScoreBound parses a score range item, exclusive after a '('
+func parseScoreBound(s string) (scoreBound, error) {
+	exclusive := strings.HasPrefix(s, "(")
+	if exclusive {
+		s = s[1:]
+	}
+	f, err := parseScore(s)
+	if err != nil {
+		return scoreBound{}, errScoreRange
+	}
+	return scoreBound{f, exclusive}, nil
+}
+
+func (b scoreBound) above(score float64) bool {
+	return score > b.value || (!b.exclusive && score == b.value)
+}
+
+func (b scoreBound) below(score float64) bool {
+	return score < b.value || (!b.exclusive && score == b.value)
+}
+
+type lexBound struct {
+	value     string
+	exclusive bool
+	infinite  int // -1 for '-', 1 for '+'
+}
+
+// parseLexBound parses a lexicographical range item: '-', '+', or a string
+// after '[' when inclusive or '(' when exclusive
+func parseLexBound(s string) (lexBound, error) {
+	switch {
+	case s == "-":
+		return lexBound{infinite: -1}, nil
+	case s == "+":
+		return lexBound{infinite: 1}, nil
+	case strings.HasPrefix(s, "["):
+		return lexBound{value: s[1:]}, nil
+	case strings.HasPrefix(s, "("):
+		return lexBound{value: s[1:], exclusive: true}, nil
+	}
+	return lexBound{}, errLexRange
+}
+
+func (b lexBound) above(member string) bool {
+	if b.infinite != 0 {
+		return b.infinite < 0
+	}
+	return member > b.value || (!b.exclusive && member == b.value)
+}
+
+func (b lexBound) below(member string) bool {
+	if b.infinite != 0 {
+		return b.infinite > 0
+	}
+	return member < b.value || (!b.exclusive && member == b.value)
+}
+
+// ZCOUNT key min max
+func (cmd Command) executeZCount(state *State) (interface{}, error) {
+	min, err := parseScoreBound(cmd.Arguments[0])
+	if err != nil {
+		return nil, err
+	}
+	max, err := parseScoreBound(cmd.Arguments[1])
+	if err != nil {
+		return nil, err
+	}
+	z, _, err := getZSet(state, cmd.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	count := int64(0)
+	for _, score := range z {
+		if min.above(score) && max.below(score) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// ZRANGE key start stop [BYSCORE | BYLEX] [REV] [LIMIT offset count]
+// [WITHSCORES]
+func (cmd Command) executeZRange(state *State) (interface{}, error) {
+	var byScore, byLex, rev, limit, withScores bool
+	offset, count := int64(0), int64(-1)
+	for i := 2; i < len(cmd.Arguments); i++ {
+		switch strings.ToUpper(cmd.Arguments[i]) {
+		case "BYSCORE":
+			byScore = true
+		case "BYLEX":
+			byLex = true
+		case "REV":
+			rev = true
+		case "WITHSCORES":
+			withScores = true
+		case "LIMIT":
+			if i+2 >= len(cmd.Arguments) {
+				return nil, errSyntax
+			}
+			var err error
+			if offset, err = strconv.ParseInt(cmd.Arguments[i+1], 10, 64); err != nil {
+				return nil, errNotInteger
+			}
+			if count, err = strconv.ParseInt(cmd.Arguments[i+2], 10, 64); err != nil {
+				return nil, errNotInteger
+			}
+			limit = true
+			i += 2
+		default:
+			return nil, errSyntax
+		}
+	}
+	if byScore && byLex {
+		return nil, errSyntax
+	}
+	if limit && !byScore && !byLex {
+		return nil, errZRangeLimit
+	}
+	if byLex && withScores {
+		return nil, errZRangeLex
+	}
+
+	// the range is given from max to min when reversed
+	minArg, maxArg := cmd.Arguments[0], cmd.Arguments[1]
+	if rev && (byScore || byLex) {
+		minArg, maxArg = maxArg, minArg
+	}
+	var inRange func(zmember) bool
+	switch {
+	case byScore:
+		min, err := parseScoreBound(minArg)
+		if err != nil {
+			return nil, err
+		}
+		max, err := parseScoreBound(maxArg)
+		if err != nil {
+			return nil, err
+		}
+		inRange = func(m zmember) bool { return min.above(m.score) && max.below(m.score) }
+	case byLex:
+		min, err := parseLexBound(minArg)
+		if err != nil {
+			return nil, err
+		}
+		max, err := parseLexBound(maxArg)
+		if err != nil {
+			return nil, err
+		}
+		inRange = func(m zmember) bool { return min.above(m.member) && max.below(m.member) }
+	}
+
+	z, _, err := getZSet(state, cmd.Key)
+	if err != nil {
+		return nil, err
+	}
+	members := z.sorted()
+	if rev {
+		for i, j := 0, len(members)-1; i < j; i, j = i+1, j-1 {
+			members[i], members[j] = members[j], members[i]
+		}
+	}
+
+	if inRange == nil {
+		start, stop, err := listRange(len(members), minArg, maxArg)
+		if err != nil {
+			return nil, err
+		}
+		return appendMembers([]interface{}{}, members[start:stop+1], withScores), nil
+	}
+
+	selected := members[:0]
+	for _, m := range members {
+		if inRange(m) {
+			selected = append(selected, m)
+		}
+	}
+	if offset < 0 {
+		return []interface{}{}, nil
+	}
+	if offset > int64(len(selected)) {
+		offset = int64(len(selected))
+	}
+	selected = selected[offset:]
+	if count >= 0 && count < int64(len(selected)) {
+		selected = selected[:count]
+	}
+	return appendMembers([]interface{}{}, selected, withScores), nil
+}
+
+// ZPOPMIN key [count], ZPOPMAX key [count]
+func (cmd Command) executeZPop(state *State, max bool) (interface{}, error) {
+	count := int64(1)
+	if len(cmd.Arguments) > 0 {
+		var err error
+		count, err = strconv.ParseInt(cmd.Arguments[0], 10, 64)
+		if err != nil || count < 0 {
+			return nil, errMustBePositive
+		}
+	}
+	z, _, err := getZSet(state, cmd.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	members := z.sorted()
+	if max {
+		for i, j := 0, len(members)-1; i < j; i, j = i+1, j-1 {
+			members[i], members[j] = members[j], members[i]
+		}
+	}
+	if count < int64(len(members)) {
+		members = members[:count]
+	}
+	for _, m := range members {
+		delete(z, m.member)
+	}
+	if len(members) > 0 && len(z) == 0 {
+		state.Delete(cmd.Key)
+	}
+	return appendMembers([]interface{}{}, members, true), nil
+}
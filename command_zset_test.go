@@ -0,0 +1,158 @@
+package main
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestSortedSetCommands(t *testing.T) {
+	Convey("A sorted set", t, func() {
+		state := newStateFrom(map[string]*Value{"str": {Val: "a"}})
+		ret, err := NewCommand(ZADD, "z", "1", "a", "2", "b", "2", "c", "3", "d").Execute(state)
+		So(err, ShouldBeNil)
+		So(ret, ShouldEqual, 4)
+
+		Convey("adds and updates members", func() {
+			ret, err := NewCommand(ZADD, "z", "CH", "5", "a", "2", "b", "0", "e").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldEqual, 2)
+			So(valueOf(state, "z").Val, ShouldResemble, ZSet{"a": 5, "b": 2, "c": 2, "d": 3, "e": 0})
+			So(valueOf(state, "z").Type(), ShouldEqual, "zset")
+		})
+
+		Convey("honours NX, XX, GT and LT", func() {
+			ret, err := NewCommand(ZADD, "z", "NX", "9", "a", "9", "e").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldEqual, 1)
+			_, err = NewCommand(ZADD, "z", "XX", "9", "b", "9", "f").Execute(state)
+			So(err, ShouldBeNil)
+			_, err = NewCommand(ZADD, "z", "GT", "0", "c", "4", "d").Execute(state)
+			So(err, ShouldBeNil)
+			So(valueOf(state, "z").Val, ShouldResemble, ZSet{"a": 1, "b": 9, "c": 2, "d": 4, "e": 9})
+
+			_, err = NewCommand(ZADD, "z", "NX", "XX", "1", "a").Execute(state)
+			So(err, ShouldEqual, errZAddNXXX)
+			_, err = NewCommand(ZADD, "z", "GT", "LT", "1", "a").Execute(state)
+			So(err, ShouldEqual, errZAddGTLTNX)
+			_, err = NewCommand(ZADD, "z", "1", "a", "2").Execute(state)
+			So(err, ShouldEqual, errSyntax)
+			_, err = NewCommand(ZADD, "z", "nan", "a").Execute(state)
+			So(err, ShouldEqual, errNotFloat)
+		})
+
+		Convey("increments scores", func() {
+			ret, err := NewCommand(ZADD, "z", "INCR", "1.5", "a").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldEqual, "2.5")
+			ret, err = NewCommand(ZADD, "z", "INCR", "LT", "1", "a").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldBeNil)
+			_, err = NewCommand(ZADD, "z", "INCR", "1", "a", "1", "b").Execute(state)
+			So(err, ShouldEqual, errZAddIncrPairs)
+
+			ret, err = NewCommand(ZINCRBY, "z", "-0.5", "a").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldEqual, "2")
+			ret, err = NewCommand(ZINCRBY, "other", "+inf", "a").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldEqual, "inf")
+			_, err = NewCommand(ZINCRBY, "other", "-inf", "a").Execute(state)
+			So(err, ShouldEqual, errScoreNaN)
+		})
+
+		Convey("ranges by index with ties ordered by member", func() {
+			ret, err := NewCommand(ZRANGE, "z", "0", "-1", "WITHSCORES").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldResemble, []interface{}{"a", "1", "b", "2", "c", "2", "d", "3"})
+			ret, err = NewCommand(ZRANGE, "z", "0", "1", "REV").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldResemble, []interface{}{"d", "c"})
+		})
+
+		Convey("ranges by score", func() {
+			ret, err := NewCommand(ZRANGE, "z", "(1", "+inf", "BYSCORE").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldResemble, []interface{}{"b", "c", "d"})
+			ret, err = NewCommand(ZRANGE, "z", "3", "2", "BYSCORE", "REV", "LIMIT", "1", "1").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldResemble, []interface{}{"c"})
+			_, err = NewCommand(ZRANGE, "z", "x", "2", "BYSCORE").Execute(state)
+			So(err, ShouldEqual, errScoreRange)
+			_, err = NewCommand(ZRANGE, "z", "0", "1", "LIMIT", "0", "1").Execute(state)
+			So(err, ShouldEqual, errZRangeLimit)
+
+			ret, err = NewCommand(ZCOUNT, "z", "-inf", "(3").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldEqual, 3)
+		})
+
+		Convey("ranges by member", func() {
+			_, err := NewCommand(ZADD, "lex", "0", "a", "0", "b", "0", "c").Execute(state)
+			So(err, ShouldBeNil)
+			ret, err := NewCommand(ZRANGE, "lex", "(a", "+", "BYLEX").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldResemble, []interface{}{"b", "c"})
+			ret, err = NewCommand(ZRANGE, "lex", "[b", "-", "BYLEX", "REV").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldResemble, []interface{}{"b", "a"})
+			_, err = NewCommand(ZRANGE, "lex", "a", "+", "BYLEX").Execute(state)
+			So(err, ShouldEqual, errLexRange)
+		})
+
+		Convey("ranks and scores members", func() {
+			ret, err := NewCommand(ZRANK, "z", "c").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldEqual, 2)
+			ret, err = NewCommand(ZRANK, "z", "c", "WITHSCORE").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldResemble, []interface{}{int64(2), "2"})
+			ret, err = NewCommand(ZRANK, "z", "missing").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldBeNil)
+
+			ret, err = NewCommand(ZSCORE, "z", "d").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldEqual, 3.0)
+			ret, err = NewCommand(ZCARD, "z").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldEqual, 4)
+		})
+
+		Convey("removes and pops members", func() {
+			ret, err := NewCommand(ZREM, "z", "a", "missing").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldEqual, 1)
+
+			ret, err = NewCommand(ZPOPMIN, "z").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldResemble, []interface{}{"b", "2"})
+			ret, err = NewCommand(ZPOPMAX, "z", "5").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldResemble, []interface{}{"d", "3", "c", "2"})
+			So(state.Has("z"), ShouldBeFalse)
+		})
+
+		Convey("refuses commands of other types", func() {
+			_, err := NewCommand(ZADD, "str", "1", "a").Execute(state)
+			So(err, ShouldEqual, errWrongType)
+			_, err = NewCommand(SADD, "z", "a").Execute(state)
+			So(err, ShouldEqual, errWrongType)
+		})
+
+		Convey("is not shared by cloned states", func() {
+			cloned := state.Snapshot()
+			_, err := NewCommand(ZINCRBY, "z", "1", "a").Execute(cloned)
+			So(err, ShouldBeNil)
+			So(valueOf(state, "z").Val.(ZSet)["a"], ShouldEqual, 1)
+		})
+
+		Convey("is serialized with scores as strings", func() {
+			_, err := NewCommand(ZADD, "z", "-inf", "a", "0.1", "b").Execute(state)
+			So(err, ShouldBeNil)
+			encoded, err := valueOf(state, "z").encode()
+			So(err, ShouldBeNil)
+			So(string(encoded), ShouldEqual, `{"Val":{"a":"-inf","b":"0.1","c":"2","d":"3"},"Expire":0}`)
+		})
+	})
+}
@@ -0,0 +1,146 @@
+// difficulty of finding a block
+//
+// Each block header carries the target its hash must not exceed in the
+// compact "bits" form: the top byte is the length of the target in bytes
+// and the lower three bytes its most significant bytes. The target stays
+// the same for BlockWork.RetargetInterval blocks, then is scaled by how
+// long the last interval actually took compared to BlockWork.BlockTime per
+// block.
+package main
+
+import (
+	"errors"
+	"math"
+	"math/big"
+	"time"
+)
+
+// BlockPolicy decides the target of blocks
+type BlockPolicy struct {
+	// the target of the genesis block, which is also the easiest allowed
+	InitialBits      uint32
+	BlockTime        time.Duration
+	RetargetInterval int
+	// a single retarget changes the target by at most this factor
+	MaxRetargetFactor int
+}
+
+// BlockWork is the policy every node of a network must agree on
+var BlockWork = BlockPolicy{
+	InitialBits:       0x20010000,
+	BlockTime:         10 * time.Second,
+	RetargetInterval:  64,
+	MaxRetargetFactor: 4,
+}
+
+// MaxTarget returns the easiest target allowed
+func (p BlockPolicy) MaxTarget() *big.Int {
+	return compactToBig(p.InitialBits)
+}
+
+// compactToBig decodes a target in compact form
+func compactToBig(bits uint32) *big.Int {
+	exponent := uint(bits >> 24)
+	mantissa := int64(bits & 0x007fffff)
+
+	target := big.NewInt(mantissa)
+	if exponent <= 3 {
+		target.Rsh(target, 8*(3-exponent))
+	} else {
+		target.Lsh(target, 8*(exponent-3))
+	}
+	if bits&0x00800000 != 0 {
+		target.Neg(target)
+	}
+	return target
+}
+
+// bigToCompact encodes a non-negative target in compact form, keeping its
+// three most significant bytes
+func bigToCompact(target *big.Int) uint32 {
+	if target.Sign() == 0 {
+		return 0
+	}
+
+	exponent := uint(len(target.Bytes()))
+	var mantissa uint32
+	if exponent <= 3 {
+		mantissa = uint32(target.Uint64()) << (8 * (3 - exponent))
+	} else {
+		mantissa = uint32(new(big.Int).Rsh(target, 8*(exponent-3)).Uint64())
+	}
+	// the sign bit of the mantissa must stay clear
+	if mantissa&0x00800000 != 0 {
+		mantissa >>= 8
+		exponent++
+	}
+	return uint32(exponent<<24) | mantissa
+}
+
+// nextBits returns the target of the block following prev
+func nextBits(prev *Block) uint32 {
+	if prev == nil {
+		return BlockWork.InitialBits
+	}
+	if (prev.height+1)%BlockWork.RetargetInterval != 0 {
+		return prev.Header.Bits
+	}
+
+	first := prev
+	for i := 0; i < BlockWork.RetargetInterval-1 && first.Previous != nil; i++ {
+		first = first.Previous
+	}
+	return retarget(prev.Header.Bits, prev.Header.Time.Sub(first.Header.Time))
+}
+
+// retarget scales a target by the time the last interval took
+func retarget(bits uint32, actual time.Duration) uint32 {
+	desired := BlockWork.BlockTime * time.Duration(BlockWork.RetargetInterval-1)
+	factor := time.Duration(BlockWork.MaxRetargetFactor)
+	if actual < desired/factor {
+		actual = desired / factor
+	}
+	if actual > desired*factor {
+		actual = desired * factor
+	}
+
+	target := compactToBig(bits)
+	target.Mul(target, big.NewInt(int64(actual)))
+	target.Div(target, big.NewInt(int64(desired)))
+	if maxTarget := BlockWork.MaxTarget(); target.Cmp(maxTarget) > 0 {
+		target = maxTarget
+	}
+	return bigToCompact(target)
+}
+
+// checkBits checks the target of a block against the target expected
+// after its parent
+func (b *Block) checkBits() error {
+	if b.Header.Bits != nextBits(b.Previous) {
+		return errors.New("unexpected target")
+	}
+	return nil
+}
+
+// checkHeaderBits checks what can be known of the target of a header from
+// its parent's header alone: it is the same as the parent's between
+// retargets, and within the bounds of a retarget otherwise
+func checkHeaderBits(header, parent *BlockHeader, height int) error {
+	target := compactToBig(header.Bits)
+	if target.Sign() <= 0 || target.Cmp(BlockWork.MaxTarget()) > 0 {
+		return errors.New("target out of range")
+	}
+	if height%BlockWork.RetargetInterval != 0 {
+		if header.Bits != parent.Bits {
+			return errors.New("unexpected target")
+		}
+		return nil
+	}
+
+	easiest := compactToBig(retarget(parent.Bits, math.MaxInt64))
+	hardest := compactToBig(retarget(parent.Bits, 0))
+	if target.Cmp(hardest) < 0 || target.Cmp(easiest) > 0 {
+		return errors.New("target changed too much")
+	}
+	return nil
+}
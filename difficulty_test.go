@@ -0,0 +1,104 @@
+package main
+
+import (
+	"math/big"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestDifficulty(t *testing.T) {
+	Convey("Compact targets", t, func() {
+		Convey("decode to the full target", func() {
+			So(compactToBig(BlockWork.InitialBits), ShouldResemble, new(big.Int).Lsh(big.NewInt(1), 248))
+			So(compactToBig(0x1d00ffff).Text(16), ShouldEqual, "ffff"+"0000000000000000000000000000000000000000000000000000")
+			So(compactToBig(0x03123456).Int64(), ShouldEqual, 0x123456)
+			So(compactToBig(0x01120000).Int64(), ShouldEqual, 0x12)
+		})
+
+		Convey("encode their three most significant bytes", func() {
+			for _, bits := range []uint32{BlockWork.InitialBits, 0x1d00ffff, 0x1b0404cb, 0x03123456, 0x01120000} {
+				So(bigToCompact(compactToBig(bits)), ShouldEqual, bits)
+			}
+			So(bigToCompact(big.NewInt(0x80)), ShouldEqual, 0x02008000)
+			So(bigToCompact(new(big.Int)), ShouldEqual, 0)
+		})
+	})
+
+	Convey("Retargeting", t, func() {
+		desired := BlockWork.BlockTime * time.Duration(BlockWork.RetargetInterval-1)
+		hard := bigToCompact(new(big.Int).Rsh(BlockWork.MaxTarget(), 8))
+
+		Convey("keeps the target when blocks come on time", func() {
+			So(retarget(hard, desired), ShouldEqual, hard)
+		})
+
+		Convey("lowers the target when blocks come too fast", func() {
+			So(compactToBig(retarget(hard, desired/2)), ShouldResemble, new(big.Int).Rsh(compactToBig(hard), 1))
+		})
+
+		Convey("raises the target when blocks come too slow, up to the easiest target", func() {
+			So(compactToBig(retarget(hard, desired*2)), ShouldResemble, new(big.Int).Lsh(compactToBig(hard), 1))
+			So(retarget(BlockWork.InitialBits, desired*2), ShouldEqual, BlockWork.InitialBits)
+		})
+
+		Convey("changes the target by a bounded factor", func() {
+			So(retarget(hard, 0), ShouldEqual, retarget(hard, desired/time.Duration(BlockWork.MaxRetargetFactor)))
+			So(retarget(hard, desired*100), ShouldEqual, retarget(hard, desired*time.Duration(BlockWork.MaxRetargetFactor)))
+		})
+	})
+
+	Convey("A chain", t, func() {
+		genesis, err := NewGenesisBlock()
+		So(err, ShouldBeNil)
+		So(genesis.Header.Bits, ShouldEqual, BlockWork.InitialBits)
+
+		Convey("found too fast gets a lower target after an interval", func() {
+			head := genesis
+			for i := 1; i < BlockWork.RetargetInterval; i++ {
+				b, err := NewBlock(head)
+				So(err, ShouldBeNil)
+				b.Header.Time = head.Header.Time.Add(time.Second)
+				So(b.UpdateState(), ShouldBeNil)
+				So(Work(b), ShouldBeNil)
+				So(b.Header.Bits, ShouldEqual, BlockWork.InitialBits)
+				head = b
+			}
+
+			next, err := NewBlock(head)
+			So(err, ShouldBeNil)
+			So(next.Header.Bits, ShouldEqual, retarget(BlockWork.InitialBits, time.Second*time.Duration(BlockWork.RetargetInterval-1)))
+			So(compactToBig(next.Header.Bits).Cmp(BlockWork.MaxTarget()), ShouldBeLessThan, 0)
+			So(next.UpdateState(), ShouldBeNil)
+			So(Work(next), ShouldBeNil)
+			So(next.Verify(), ShouldBeNil)
+
+			Convey("and its blocks must use it", func() {
+				next.Header.Bits = BlockWork.InitialBits
+				So(Work(next), ShouldBeNil)
+				So(next.Verify(), ShouldNotBeNil)
+			})
+		})
+
+		Convey("refuses blocks with another target between retargets", func() {
+			b, err := NewBlock(genesis)
+			So(err, ShouldBeNil)
+			b.Header.Bits = bigToCompact(new(big.Int).Rsh(BlockWork.MaxTarget(), 1))
+			So(b.UpdateState(), ShouldBeNil)
+			So(Work(b), ShouldBeNil)
+			So(b.Verify(), ShouldNotBeNil)
+		})
+	})
+
+	Convey("Proof of work", t, func() {
+		Convey("compares the whole hash to the target", func() {
+			header := BlockHeader{Bits: 0x1f00ffff}
+			target := compactToBig(header.Bits)
+			So(Work(&header), ShouldBeNil)
+			hash, err := header.Hash()
+			So(err, ShouldBeNil)
+			So(new(big.Int).SetBytes(hash[:]).Cmp(target), ShouldBeLessThanOrEqualTo, 0)
+		})
+	})
+}
@@ -0,0 +1,80 @@
+// finding other nodes to connect to
+package main
+
+import (
+	"errors"
+	"log"
+	"time"
+)
+
+// SetAddrBook replaces the in-memory address book of the node, usually with
+// one loaded from disk
+func (n *Node) SetAddrBook(book *AddrBook) {
+	n.addrBook = book
+}
+
+func (n *Node) AddrBook() *AddrBook {
+	return n.addrBook
+}
+
+// Discover keeps the node connected to up to maxPeers other nodes. It starts
+// from the seeds and learns about more nodes by asking its peers for the
+// addresses they know.
+func (n *Node) Discover(seeds []string, maxPeers int, interval time.Duration) {
+	for _, seed := range seeds {
+		n.addrBook.Add(seed)
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			n.connectToKnownAddresses(maxPeers)
+			if err := n.addrBook.Save(); err != nil {
+				log.Printf("failed to save address book: %s", err)
+			}
+
+			select {
+			case <-ticker.C:
+			case <-n.quit:
+				return
+			}
+		}
+	}()
+}
+
+func (n *Node) connectToKnownAddresses(maxPeers int) {
+	peers := n.Peers()
+	if len(peers) >= maxPeers {
+		return
+	}
+
+	connected := make(map[string]bool)
+	for _, p := range peers {
+		connected[p.ListenAddr()] = true
+	}
+	for _, addr := range n.addrBook.Addresses(maxKnownAddresses) {
+		if len(peers) >= maxPeers {
+			return
+		}
+		if connected[addr] {
+			continue
+		}
+
+		p, err := n.Connect(addr)
+		if err != nil {
+			continue
+		}
+		peers = append(peers, p)
+	}
+}
+
+// ban disconnects a misbehaving peer and refuses connections to and from
+// its address for a while
+func (n *Node) ban(p *Peer) {
+	if addr := p.ListenAddr(); addr != "" {
+		n.addrBook.Ban(addr, banDuration)
+	}
+	p.closeWith(errors.New("banned"))
+}
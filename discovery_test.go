@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestDiscovery(t *testing.T) {
+	Convey("Nodes started from a single seed", t, func() {
+		genesis, err := NewGenesisBlock()
+		So(err, ShouldBeNil)
+		nodes, err := startTestNodes(genesis, 5)
+		So(err, ShouldBeNil)
+		defer closeTestNodes(nodes)
+
+		seed := nodes[0].ListenAddr()
+		for _, node := range nodes[1:] {
+			node.Discover([]string{seed}, len(nodes)-1, 50*time.Millisecond)
+		}
+
+		Convey("converge to a connected mesh", func() {
+			for _, node := range nodes {
+				n := node
+				So(eventually(10*time.Second, func() bool { return len(n.Peers()) == len(nodes)-1 }), ShouldBeTrue)
+			}
+		})
+	})
+
+	Convey("A node receiving an invalid block", t, func() {
+		genesis, err := NewGenesisBlock()
+		So(err, ShouldBeNil)
+		nodes, err := startTestNodes(genesis, 2)
+		So(err, ShouldBeNil)
+		defer closeTestNodes(nodes)
+
+		peer, err := nodes[0].Connect(nodes[1].ListenAddr())
+		So(err, ShouldBeNil)
+
+		b, err := NewBlock(genesis)
+		So(err, ShouldBeNil)
+		So(b.UpdateState(), ShouldBeNil)
+		for reached, _ := reachThreshold(b); reached; reached, _ = reachThreshold(b) {
+			b.NextTry()
+		}
+		data, err := encodeBlock(b)
+		So(err, ShouldBeNil)
+		peer.Send(msgBlock, json.RawMessage(data))
+
+		Convey("bans the peer which sent it", func() {
+			So(eventually(5*time.Second, func() bool { return len(nodes[1].Peers()) == 0 }), ShouldBeTrue)
+			So(nodes[1].Height(), ShouldEqual, 0)
+
+			So(eventually(time.Second, func() bool { return nodes[1].AddrBook().IsBanned(nodes[0].ListenAddr()) }), ShouldBeTrue)
+			_, err := nodes[0].Connect(nodes[1].ListenAddr())
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
@@ -0,0 +1,141 @@
+// keys past their expire time
+//
+// Expire times are only ever compared with the time of the block applying
+// the commands and sweeping the keys, which senders of transactions can't
+// choose. Every node replaying a block ends with the same state, whenever it
+// does.
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+// a block may be ahead of the clock of a node by at most maxFutureBlockTime
+const maxFutureBlockTime = 2 * time.Hour
+
+// errFutureBlock depends on the clock of the node, so the block may be valid
+// for others
+var errFutureBlock = errors.New("Block time too far in the future")
+
+// expiredAt reports whether a value is past its expire time at t
+func (v *Value) expiredAt(t time.Time) bool {
+	return v.WillExpire && t.After(v.Expire)
+}
+
+// withoutExpired hides the keys of a command expired at the time it is
+// applied. Writes delete them from the state. Reads get a state of their
+// keys still alive instead, as the state they read is shared.
+func (cmd Command) withoutExpired(state *State) *State {
+	now, err := cmd.now()
+	if err != nil {
+		return state
+	}
+	keys := cmd.Keys()
+	if keys == nil {
+		// KEYS, SCAN and DBSIZE read every key
+		keys = state.Keys()
+	}
+
+	expired := false
+	for _, key := range keys {
+		if v, ok := state.Get(key); ok && v.expiredAt(now) {
+			expired = true
+			if !cmd.ReadOnly() {
+				state.Delete(key)
+			}
+		}
+	}
+	if !expired || !cmd.ReadOnly() {
+		return state
+	}
+
+	alive := NewState()
+	for _, key := range keys {
+		if v, ok := state.Get(key); ok && !v.expiredAt(now) {
+			alive.Set(key, v)
+		}
+	}
+	return alive
+}
+
+// an expiryNode is a node of a persistent leftist heap of expire times,
+// soonest first. Nodes are never changed once in a heap, so the index of a
+// block shares them with the index of its parent.
+type expiryNode struct {
+	at          time.Time
+	key         string
+	rank        int // length of the rightmost path
+	left, right *expiryNode
+}
+
+func (n *expiryNode) rankOf() int {
+	if n == nil {
+		return 0
+	}
+	return n.rank
+}
+
+// mergeExpiry returns the heap of the entries of a and b, copying the nodes
+// on their rightmost paths only
+func mergeExpiry(a, b *expiryNode) *expiryNode {
+	if a == nil {
+		return b
+	}
+	if b == nil {
+		return a
+	}
+	if b.at.Before(a.at) {
+		a, b = b, a
+	}
+	left, right := a.left, mergeExpiry(a.right, b)
+	if left.rankOf() < right.rankOf() {
+		left, right = right, left
+	}
+	return &expiryNode{a.at, a.key, right.rankOf() + 1, left, right}
+}
+
+// expiryIndex keeps the keys of a state given an expire time, so a block
+// only visits the keys due instead of the whole state. Entries are not
+// removed when a key is deleted or gets another expire time, they are
+// checked against the state once due.
+type expiryIndex struct {
+	root *expiryNode
+}
+
+// fork returns a copy of an index to be updated by the next block, in
+// constant time
+func (x *expiryIndex) fork() *expiryIndex {
+	if x == nil {
+		return &expiryIndex{}
+	}
+	return &expiryIndex{x.root}
+}
+
+// track indexes the keys written by a block which got another expire time
+// than they had in the state of its parent. Keys keeping theirs are already
+// indexed.
+func (x *expiryIndex) track(parent, state *State, keys map[string]bool) {
+	for key := range keys {
+		v, ok := state.Get(key)
+		if !ok || !v.WillExpire {
+			continue
+		}
+		if old, ok := parent.Get(key); ok && old.WillExpire && old.Expire.Equal(v.Expire) {
+			continue
+		}
+		x.root = mergeExpiry(x.root, &expiryNode{at: v.Expire, key: key, rank: 1})
+	}
+}
+
+// expire deletes the keys of a state expired at t
+func (x *expiryIndex) expire(state *State, t time.Time) {
+	for x.root != nil && t.After(x.root.at) {
+		e := x.root
+		x.root = mergeExpiry(e.left, e.right)
+		// the key may have got another expire time since
+		if v, ok := state.Get(e.key); ok && v.WillExpire && v.Expire.Equal(e.at) {
+			state.Delete(e.key)
+		}
+	}
+}
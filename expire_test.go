@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// newTimedBlock returns a block at a time holding transactions of an
+// account sent at that time
+func newTimedBlock(previous *Block, at time.Time, account *Account, cmds ...Command) (*Block, error) {
+	b, err := NewBlock(previous)
+	if err != nil {
+		return nil, err
+	}
+	b.Header.Time = at
+	address, err := account.Address()
+	if err != nil {
+		return nil, err
+	}
+	sequence := accountSequence(previous.State, string(address))
+	for i, cmd := range cmds {
+		tx, err := newTestTransactionFrom(account, sequence+uint64(i), cmd)
+		if err != nil {
+			return nil, err
+		}
+		tx.Header.Time = at
+		b.Transactions = append(b.Transactions, tx)
+	}
+	return b, b.UpdateState()
+}
+
+func TestExpire(t *testing.T) {
+	Convey("Expired keys", t, func() {
+		genesis, err := NewGenesisBlock()
+		So(err, ShouldBeNil)
+		account, err := NewAccount()
+		So(err, ShouldBeNil)
+		start := genesis.Header.Time.Add(time.Hour)
+		b, err := newTimedBlock(genesis, start, account,
+			NewCommand(SET, "foo", "bar", "EX", "10"),
+			NewCommand(SET, "baz", "qux", "EX", "20"))
+		So(err, ShouldBeNil)
+
+		Convey("are deleted by the first block past their expire time", func() {
+			before, err := newTimedBlock(b, start.Add(10*time.Second), account)
+			So(err, ShouldBeNil)
+			So(before.State.Has("foo"), ShouldBeTrue)
+
+			after, err := newTimedBlock(before, start.Add(11*time.Second), account)
+			So(err, ShouldBeNil)
+			So(after.State.Has("foo"), ShouldBeFalse)
+			So(after.State.Has("baz"), ShouldBeTrue)
+			So(before.State.Has("foo"), ShouldBeTrue)
+		})
+
+		Convey("are kept when they get a later expire time", func() {
+			later, err := newTimedBlock(b, start.Add(5*time.Second), account, NewCommand(EXPIRE, "foo", "60"))
+			So(err, ShouldBeNil)
+			after, err := newTimedBlock(later, start.Add(30*time.Second), account)
+			So(err, ShouldBeNil)
+			So(after.State.Has("foo"), ShouldBeTrue)
+			So(after.State.Has("baz"), ShouldBeFalse)
+		})
+
+		Convey("are missing for commands sent after their expire time", func() {
+			cmd := stringCommand(start.Add(15*time.Second), GET, "foo")
+			ret, err := cmd.Execute(b.State)
+			So(err, ShouldBeNil)
+			So(ret, ShouldBeNil)
+			So(b.State.Has("foo"), ShouldBeTrue)
+
+			ret, err = stringCommand(start.Add(15*time.Second), EXISTS, "foo", "baz").Execute(b.State)
+			So(err, ShouldBeNil)
+			So(ret, ShouldEqual, 1)
+			ret, err = stringCommand(start.Add(15*time.Second), KEYS, "*").Execute(b.State)
+			So(err, ShouldBeNil)
+			So(ret, ShouldNotContain, "foo")
+
+			state := b.State.Snapshot()
+			ret, err = stringCommand(start.Add(15*time.Second), SETNX, "foo", "new").Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldEqual, 1)
+			So(valueOf(state, "foo").WillExpire, ShouldBeFalse)
+		})
+
+		Convey("give the same state whenever a block is replayed", func() {
+			replayed := &Block{Header: b.Header, Transactions: b.Transactions, Previous: genesis}
+			So(replayed.VerifyState(), ShouldBeNil)
+		})
+	})
+
+	Convey("A block time", t, func() {
+		genesis, err := NewGenesisBlock()
+		So(err, ShouldBeNil)
+
+		Convey("is never before the time of its parent", func() {
+			b, err := NewBlock(genesis)
+			So(err, ShouldBeNil)
+			So(b.checkTime(), ShouldBeNil)
+
+			b.Header.Time = genesis.Header.Time.Add(-time.Second)
+			So(b.checkTime(), ShouldNotBeNil)
+
+			genesis.Header.Time = time.Now().Add(time.Minute)
+			b, err = NewBlock(genesis)
+			So(err, ShouldBeNil)
+			So(b.Header.Time, ShouldResemble, genesis.Header.Time)
+		})
+
+		Convey("is not too far in the future", func() {
+			b, err := NewBlock(genesis)
+			So(err, ShouldBeNil)
+			b.Header.Time = time.Now().Add(maxFutureBlockTime + time.Minute)
+			So(b.checkTime(), ShouldNotBeNil)
+		})
+	})
+
+	Convey("An expiry index", t, func() {
+		now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+		parent := newStateFrom(map[string]*Value{"a": {Val: "1"}, "b": {Val: "2"}, "c": {Val: "3"}})
+		valueOf(parent, "a").UpdateExpire(now.Add(time.Second))
+		valueOf(parent, "b").UpdateExpire(now.Add(time.Minute))
+		index := (*expiryIndex)(nil).fork()
+		index.track(NewState(), parent, map[string]bool{"a": true, "b": true, "c": true})
+		So(index.root.key, ShouldEqual, "a")
+
+		Convey("only indexes keys getting another expire time", func() {
+			state := parent.Snapshot()
+			state.Mutable("c")
+			forked := index.fork()
+			forked.track(parent, state, map[string]bool{"a": true, "c": true})
+			So(forked.root, ShouldEqual, index.root)
+		})
+
+		Convey("only deletes keys still due", func() {
+			state := parent.Snapshot()
+			forked := index.fork()
+			v, _ := state.Mutable("a")
+			v.UpdateExpire(now.Add(time.Hour))
+			forked.track(parent, state, map[string]bool{"a": true})
+
+			forked.expire(state, now.Add(2*time.Minute))
+			So(state.Has("a"), ShouldBeTrue)
+			So(state.Has("b"), ShouldBeFalse)
+			So(state.Has("c"), ShouldBeTrue)
+			So(forked.root.key, ShouldEqual, "a")
+			So(forked.root.left, ShouldBeNil)
+
+			Convey("leaving the index it was forked from alone", func() {
+				So(index.root.key, ShouldEqual, "a")
+				So(index.root.at, ShouldResemble, now.Add(time.Second))
+				So(parent.Has("b"), ShouldBeTrue)
+			})
+		})
+
+		Convey("pops entries soonest first", func() {
+			state := NewState()
+			written := make(map[string]bool)
+			for i := 0; i < 100; i++ {
+				key := fmt.Sprint(i)
+				state.Set(key, &Value{Val: "1"})
+				valueOf(state, key).UpdateExpire(now.Add(time.Duration((i*37)%100) * time.Second))
+				written[key] = true
+			}
+			index.root = nil
+			index.track(NewState(), state, written)
+
+			for i := 1; i <= 100; i++ {
+				index.expire(state, now.Add(time.Duration(i)*time.Second-time.Millisecond))
+				So(state.Len(), ShouldEqual, 100-i)
+			}
+			So(index.root, ShouldBeNil)
+		})
+	})
+}
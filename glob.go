@@ -0,0 +1,93 @@
+// glob-style patterns of the MATCH options and KEYS
+package main
+
+// matchPattern reports whether s matches a Redis glob pattern. It supports
+// *, ?, [abc], [^abc], [a-z] and \ to escape the next byte. Patterns and
+// strings are matched byte by byte.
+//
+// Only the last * met is backtracked to, letting it match one more byte
+// when the rest of the pattern fails. Earlier stars never have to
+// match more, so the match takes at most len(pattern) * len(s) steps.
+func matchPattern(pattern, s string) bool {
+	p, i := 0, 0
+	// the pattern after the last star and where its match in s ends
+	star, next := -1, 0
+	for i < len(s) {
+		if p < len(pattern) {
+			switch pattern[p] {
+			case '*':
+				p++
+				star, next = p, i
+				continue
+			case '?':
+				p++
+				i++
+				continue
+			case '[':
+				if matched, rest := matchClass(pattern[p+1:], s[i]); matched {
+					p = len(pattern) - len(rest)
+					i++
+					continue
+				}
+			case '\\':
+				if p+1 < len(pattern) {
+					if pattern[p+1] == s[i] {
+						p += 2
+						i++
+						continue
+					}
+					break
+				}
+				fallthrough
+			default:
+				if pattern[p] == s[i] {
+					p++
+					i++
+					continue
+				}
+			}
+		}
+		if star < 0 {
+			return false
+		}
+		next++
+		p, i = star, next
+	}
+
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// matchClass matches c against the class following a '[' and returns the
+// pattern after the closing ']'. An unclosed class ends with the pattern.
+func matchClass(pattern string, c byte) (bool, string) {
+	not := len(pattern) > 0 && pattern[0] == '^'
+	if not {
+		pattern = pattern[1:]
+	}
+
+	matched := false
+	for len(pattern) > 0 && pattern[0] != ']' {
+		switch {
+		case pattern[0] == '\\' && len(pattern) > 1:
+			matched = matched || pattern[1] == c
+			pattern = pattern[2:]
+		case len(pattern) > 2 && pattern[1] == '-' && pattern[2] != ']':
+			lo, hi := pattern[0], pattern[2]
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+			matched = matched || (lo <= c && c <= hi)
+			pattern = pattern[3:]
+		default:
+			matched = matched || pattern[0] == c
+			pattern = pattern[1:]
+		}
+	}
+	if len(pattern) > 0 {
+		pattern = pattern[1:]
+	}
+	return matched != not, pattern
+}
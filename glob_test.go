@@ -0,0 +1,51 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestMatchPattern(t *testing.T) {
+	Convey("A glob pattern", t, func() {
+		Convey("matches any string with *", func() {
+			So(matchPattern("*", ""), ShouldBeTrue)
+			So(matchPattern("h*llo", "heeello"), ShouldBeTrue)
+			So(matchPattern("h*llo", "hllo"), ShouldBeTrue)
+			So(matchPattern("h**o*", "hello world"), ShouldBeTrue)
+			So(matchPattern("h*llo", "hello!"), ShouldBeFalse)
+			So(matchPattern("*llo*", "hello world"), ShouldBeTrue)
+			So(matchPattern("a*b*c", "abxbxc"), ShouldBeTrue)
+			So(matchPattern("a*b?c", "abxbc"), ShouldBeFalse)
+			So(matchPattern("*[0-9]", "key9"), ShouldBeTrue)
+		})
+
+		Convey("matches many stars without backtracking to each", func() {
+			pattern := strings.Repeat("a*", 50) + "b"
+			So(matchPattern(pattern, strings.Repeat("a", 200)), ShouldBeFalse)
+			So(matchPattern(pattern, strings.Repeat("a", 200)+"b"), ShouldBeTrue)
+		})
+
+		Convey("matches one byte with ?", func() {
+			So(matchPattern("h?llo", "hallo"), ShouldBeTrue)
+			So(matchPattern("h?llo", "hllo"), ShouldBeFalse)
+		})
+
+		Convey("matches classes", func() {
+			So(matchPattern("h[ae]llo", "hello"), ShouldBeTrue)
+			So(matchPattern("h[ae]llo", "hillo"), ShouldBeFalse)
+			So(matchPattern("h[^e]llo", "hallo"), ShouldBeTrue)
+			So(matchPattern("h[^e]llo", "hello"), ShouldBeFalse)
+			So(matchPattern("h[a-b]llo", "hbllo"), ShouldBeTrue)
+			So(matchPattern("h[b-a]llo", "hallo"), ShouldBeTrue)
+			So(matchPattern("h[a-b]llo", "hcllo"), ShouldBeFalse)
+		})
+
+		Convey("escapes special bytes", func() {
+			So(matchPattern(`h\*llo`, "h*llo"), ShouldBeTrue)
+			So(matchPattern(`h\*llo`, "hello"), ShouldBeFalse)
+			So(matchPattern(`h[\]]llo`, "h]llo"), ShouldBeTrue)
+		})
+	})
+}
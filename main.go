@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const Version = "0.1.0"
+
+func main() {
+	addr := flag.String("addr", ":6379", "address of the redis protocol server")
+	dataDir := flag.String("data", "data", "directory of the block store, known peers and account key")
+	p2pAddr := flag.String("p2p", ":7379", "address accepting connections from other nodes")
+	seeds := flag.String("seeds", "", "comma separated addresses of nodes to discover other nodes from")
+	maxPeers := flag.Int("maxpeers", 8, "maximum number of peers to connect to")
+	mine := flag.Bool("mine", false, "mine blocks with the pending transactions")
+	workers := flag.Int("workers", 0, "number of mining goroutines, one per CPU if 0")
+	flag.Parse()
+
+	store, err := OpenBlockStore(*dataDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer store.Close()
+
+	account, err := OpenAccount(filepath.Join(*dataDir, "account.pem"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	head, err := loadOrCreateChain(store)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("loaded chain at height %d", store.Height())
+
+	node, err := NewNode(head)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer node.Close()
+	node.SetStore(store)
+
+	book, err := OpenAddrBook(filepath.Join(*dataDir, "peers.json"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	node.SetAddrBook(book)
+
+	if *p2pAddr != "" {
+		if err := node.Listen(*p2pAddr); err != nil {
+			log.Fatal(err)
+		}
+	}
+	var seedList []string
+	for _, addr := range strings.Split(*seeds, ",") {
+		if addr != "" {
+			seedList = append(seedList, addr)
+		}
+	}
+	node.Discover(seedList, *maxPeers, 30*time.Second)
+
+	if *mine {
+		go func() {
+			log.Fatal(node.Mine(context.Background(), NewMiner(*workers)))
+		}()
+	}
+
+	server, err := NewServer(node, account)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("listening on %s", *addr)
+	log.Fatal(server.ListenAndServe(*addr))
+}
+
+// loadOrCreateChain loads the chain in the store, or creates and stores a
+// genesis block if the store is empty
+func loadOrCreateChain(store *BlockStore) (*Block, error) {
+	head, err := store.LoadChain()
+	if err != nil || head != nil {
+		return head, err
+	}
+
+	genesis, err := NewGenesisBlock()
+	if err != nil {
+		return nil, err
+	}
+	hash, err := genesis.Hash()
+	if err != nil {
+		return nil, err
+	}
+	if err := store.Put(genesis); err != nil {
+		return nil, err
+	}
+	if err := store.SetHead(hash); err != nil {
+		return nil, err
+	}
+
+	return genesis, nil
+}
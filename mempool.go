@@ -0,0 +1,302 @@
+// transactions waiting to be included in a block
+package main
+
+import (
+	"container/list"
+	"errors"
+	"sync"
+	"time"
+)
+
+// MempoolPolicy limits the transactions a node keeps and puts in a block.
+// Unlike the work policies it is local to each node.
+type MempoolPolicy struct {
+	// transactions waiting longer than MaxAge are dropped
+	MaxAge time.Duration
+	// the oldest transactions are evicted beyond MaxBytes
+	MaxBytes int
+	// a block template holds at most MaxBlockBytes of transactions
+	MaxBlockBytes int
+}
+
+var MempoolLimits = MempoolPolicy{
+	MaxAge:        time.Hour,
+	MaxBytes:      32 << 20,
+	MaxBlockBytes: 1 << 20,
+}
+
+var errKnownTransaction = errors.New("transaction already pending")
+
+// a transaction without a valid proof of work or signature, as opposed to a
+// transaction refused by the policy or the state of a node
+type invalidTransactionError struct {
+	err error
+}
+
+func (e invalidTransactionError) Error() string {
+	return e.err.Error()
+}
+
+type mempoolEntry struct {
+	tx    *Transaction
+	hash  [32]byte
+	size  int
+	added time.Time
+}
+
+// Mempool keeps valid transactions by hash in the order they arrived
+type Mempool struct {
+	policy MempoolPolicy
+
+	mu    sync.Mutex
+	order *list.List // of *mempoolEntry, oldest first
+	txs   map[[32]byte]*list.Element
+	bytes int
+}
+
+func NewMempool(policy MempoolPolicy) *Mempool {
+	return &Mempool{
+		policy: policy,
+		order:  list.New(),
+		txs:    make(map[[32]byte]*list.Element),
+	}
+}
+
+// Add checks the proof of work and the signature of a transaction before
+// queueing it, refusing invalid ones with invalidTransactionError.
+// Transactions already pending are refused with errKnownTransaction, the
+// ones of read-only commands with errReadOnlyTransaction, and the ones of
+// malformed commands with the error decoding them.
+func (m *Mempool) Add(tx *Transaction) error {
+	reached, err := reachThreshold(tx)
+	if err != nil {
+		return err
+	}
+	if !reached {
+		return invalidTransactionError{errors.New("Invalid Proof of Work")}
+	}
+	if err := tx.VerifySignature(); err != nil {
+		return invalidTransactionError{err}
+	}
+	cmd, err := tx.Command()
+	if err != nil {
+		return err
+	}
+	if cmd.ReadOnly() {
+		return errReadOnlyTransaction
+	}
+
+	return m.add(tx)
+}
+
+func (m *Mempool) add(tx *Transaction) error {
+	hash, err := tx.Hash()
+	if err != nil {
+		return err
+	}
+	size := transactionSize(tx)
+	if size > m.policy.MaxBytes {
+		return errors.New("transaction too large")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.txs[hash]; ok {
+		return errKnownTransaction
+	}
+	now := time.Now()
+	m.expire(now)
+	for m.bytes+size > m.policy.MaxBytes {
+		m.evict(m.order.Front())
+	}
+
+	m.txs[hash] = m.order.PushBack(&mempoolEntry{tx, hash, size, now})
+	m.bytes += size
+	return nil
+}
+
+// Return queues again the transactions of a block leaving the main chain.
+// They were checked when first added.
+func (m *Mempool) Return(txs []*Transaction) {
+	for _, tx := range txs {
+		m.add(tx)
+	}
+}
+
+// Remove drops transactions included in a block
+func (m *Mempool) Remove(txs []*Transaction) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, tx := range txs {
+		hash, err := tx.Hash()
+		if err != nil {
+			continue
+		}
+		if e, ok := m.txs[hash]; ok {
+			m.remove(e)
+		}
+	}
+}
+
+// Prune drops the transactions whose sequence number is already used in a
+// state, as they can never be applied on top of it
+func (m *Mempool) Prune(state *State) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for e := m.order.Front(); e != nil; {
+		next := e.Next()
+		tx := e.Value.(*mempoolEntry).tx
+		if tx.Header.Sequence < accountSequence(state, tx.Header.From) {
+			m.remove(e)
+		}
+		e = next
+	}
+}
+
+// NextSequence returns the sequence number following the transactions of
+// an address, both applied in a state and pending
+func (m *Mempool) NextSequence(state *State, address string) uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	next := accountSequence(state, address)
+	for e := m.order.Front(); e != nil; e = e.Next() {
+		tx := e.Value.(*mempoolEntry).tx
+		if tx.Header.From == address && tx.Header.Sequence >= next {
+			next = tx.Header.Sequence + 1
+		}
+	}
+	return next
+}
+
+// Get returns a pending transaction by its hash
+func (m *Mempool) Get(hash [32]byte) (*Transaction, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e, ok := m.txs[hash]
+	if !ok {
+		return nil, false
+	}
+	return e.Value.(*mempoolEntry).tx, true
+}
+
+// Pending returns the pending transactions, oldest first
+func (m *Mempool) Pending() []*Transaction {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.expire(time.Now())
+	txs := make([]*Transaction, 0, len(m.txs))
+	for e := m.order.Front(); e != nil; e = e.Next() {
+		txs = append(txs, e.Value.(*mempoolEntry).tx)
+	}
+	return txs
+}
+
+// Len returns the number of pending transactions
+func (m *Mempool) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return len(m.txs)
+}
+
+// expire drops transactions older than the policy allows, m.mu must be held
+func (m *Mempool) expire(now time.Time) {
+	for e := m.order.Front(); e != nil; e = m.order.Front() {
+		if now.Sub(e.Value.(*mempoolEntry).added) <= m.policy.MaxAge {
+			return
+		}
+		m.evict(e)
+	}
+}
+
+// evict drops a transaction which will never be applied, and the pending
+// transactions of its sender following it as they would wait for it
+// forever. m.mu must be held.
+func (m *Mempool) evict(e *list.Element) {
+	evicted := e.Value.(*mempoolEntry).tx
+	m.remove(e)
+	for e := m.order.Front(); e != nil; {
+		next := e.Next()
+		tx := e.Value.(*mempoolEntry).tx
+		if tx.Header.From == evicted.Header.From && tx.Header.Sequence > evicted.Header.Sequence {
+			m.remove(e)
+		}
+		e = next
+	}
+}
+
+// remove drops a transaction, m.mu must be held
+func (m *Mempool) remove(e *list.Element) {
+	entry := m.order.Remove(e).(*mempoolEntry)
+	delete(m.txs, entry.hash)
+	m.bytes -= entry.size
+}
+
+// transactionSize approximates the space a transaction takes
+func transactionSize(tx *Transaction) int {
+	return len(tx.Header.From) + len(tx.Header.PublicKey) + len(tx.Header.To) + len(tx.Header.What) + len(tx.signature)
+}
+
+// NewBlockTemplate builds a block on top of head with the pending
+// transactions following the sequence of their sender, up to MaxBlockBytes.
+// The block is ready to be worked.
+func NewBlockTemplate(head *Block, pool *Mempool) (*Block, error) {
+	b, err := NewBlock(head)
+	if err != nil {
+		return nil, err
+	}
+
+	state := NewState()
+	if head != nil {
+		state = head.State.Snapshot()
+	}
+	b.Transactions = applyPending(state, pool.Pending(), pool.policy.MaxBlockBytes, b.Header.Time)
+
+	if err := b.HashTransactions(); err != nil {
+		return nil, err
+	}
+	if err := b.UpdateState(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// applyPending applies the pending transactions following the sequence of
+// their sender on a state at the time of a block, oldest first, up to
+// maxBytes, and returns them in the order applied. A transaction arriving
+// before the ones of its sender it follows is applied after them.
+func applyPending(state *State, pending []*Transaction, maxBytes int, at time.Time) []*Transaction {
+	var applied []*Transaction
+	bytes := 0
+	candidates := pending
+	for added := true; added; {
+		added = false
+		rest := candidates[:0]
+		for _, tx := range candidates {
+			size := transactionSize(tx)
+			if bytes+size > maxBytes {
+				continue
+			}
+			// a transaction out of sequence would make the whole block
+			// invalid, a failing command only has an error as its result
+			if _, err := applyTransaction(state, tx, at); err != nil {
+				// it may follow a transaction still to be taken
+				if tx.Header.Sequence > accountSequence(state, tx.Header.From) {
+					rest = append(rest, tx)
+				}
+				continue
+			}
+			applied = append(applied, tx)
+			bytes += size
+			added = true
+		}
+		candidates = rest
+	}
+	return applied
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestMempool(t *testing.T) {
+	Convey("A mempool", t, func() {
+		pool := NewMempool(MempoolLimits)
+
+		Convey("queues worked and signed transactions once", func() {
+			tx, err := newTestTransaction(NewCommand(SET, "foo", "bar"))
+			So(err, ShouldBeNil)
+
+			So(pool.Add(tx), ShouldBeNil)
+			So(pool.Add(tx), ShouldEqual, errKnownTransaction)
+			So(pool.Pending(), ShouldResemble, []*Transaction{tx})
+
+			hash, err := tx.Hash()
+			So(err, ShouldBeNil)
+			got, ok := pool.Get(hash)
+			So(ok, ShouldBeTrue)
+			So(got, ShouldEqual, tx)
+
+			Convey("until they are included in a block", func() {
+				pool.Remove([]*Transaction{tx})
+				So(pool.Pending(), ShouldBeEmpty)
+				_, ok := pool.Get(hash)
+				So(ok, ShouldBeFalse)
+			})
+		})
+
+		Convey("rejects transactions without a signature", func() {
+			tx, err := NewTransactionFromCommand("alice", NewCommand(SET, "foo", "bar"))
+			So(err, ShouldBeNil)
+			So(Work(tx), ShouldBeNil)
+
+			So(pool.Add(tx), ShouldNotBeNil)
+			tx.SignWith([]byte("garbage"))
+			So(pool.Add(tx), ShouldNotBeNil)
+			So(pool.Len(), ShouldEqual, 0)
+		})
+
+		Convey("rejects transactions without proof of work", func() {
+			tx, err := newTestTransaction(NewCommand(SET, "foo", "bar"))
+			So(err, ShouldBeNil)
+			for reached, _ := reachThreshold(tx); reached; reached, _ = reachThreshold(tx) {
+				tx.NextTry()
+			}
+
+			So(pool.Add(tx), ShouldNotBeNil)
+			So(pool.Len(), ShouldEqual, 0)
+		})
+
+		Convey("rejects transactions of malformed commands", func() {
+			for _, cmd := range []Command{
+				{OP: SET, Key: "x"},
+				{OP: RENAME, Key: "x"},
+				{OP: DBSIZE, Key: "x"},
+				{OP: OP(1000), Key: "x"},
+				NewExecCommand(NewCommand(GET, "x"), Command{OP: SET, Key: "x"}),
+			} {
+				tx, err := newTestTransaction(cmd)
+				So(err, ShouldBeNil)
+				So(pool.Add(tx), ShouldNotBeNil)
+			}
+			So(pool.Len(), ShouldEqual, 0)
+
+			genesis, err := NewGenesisBlock()
+			So(err, ShouldBeNil)
+			node, err := NewNode(genesis)
+			So(err, ShouldBeNil)
+			defer node.Close()
+			tx, err := newTestTransaction(Command{OP: SET, Key: "x"})
+			So(err, ShouldBeNil)
+			So(node.Submit(tx), ShouldResemble, errWrongArity("set"))
+			So(node.Pending(), ShouldBeEmpty)
+			_, err = NewBlockTemplate(node.Head(), node.Mempool())
+			So(err, ShouldBeNil)
+		})
+
+		Convey("evicts the oldest transactions beyond its size", func() {
+			var txs []*Transaction
+			for _, val := range []string{"a", "b", "c"} {
+				tx, err := newTestTransaction(NewCommand(SET, "foo", val))
+				So(err, ShouldBeNil)
+				txs = append(txs, tx)
+			}
+			policy := MempoolLimits
+			policy.MaxBytes = transactionSize(txs[1]) + transactionSize(txs[2])
+			pool := NewMempool(policy)
+
+			for _, tx := range txs {
+				So(pool.Add(tx), ShouldBeNil)
+			}
+			So(pool.Pending(), ShouldResemble, txs[1:])
+		})
+
+		Convey("evicts the transactions following an evicted one", func() {
+			account, err := NewAccount()
+			So(err, ShouldBeNil)
+			first, err := newTestTransactionFrom(account, 0, NewCommand(SET, "foo", "a"))
+			So(err, ShouldBeNil)
+			second, err := newTestTransactionFrom(account, 1, NewCommand(SET, "foo", "b"))
+			So(err, ShouldBeNil)
+			other, err := newTestTransaction(NewCommand(SET, "foo", "c"))
+			So(err, ShouldBeNil)
+			policy := MempoolLimits
+			policy.MaxBytes = transactionSize(first) + transactionSize(second)
+			pool := NewMempool(policy)
+
+			So(pool.Add(first), ShouldBeNil)
+			So(pool.Add(second), ShouldBeNil)
+			So(pool.Add(other), ShouldBeNil)
+			So(pool.Pending(), ShouldResemble, []*Transaction{other})
+		})
+
+		Convey("drops transactions waiting too long", func() {
+			policy := MempoolLimits
+			policy.MaxAge = 10 * time.Millisecond
+			pool := NewMempool(policy)
+			tx, err := newTestTransaction(NewCommand(SET, "foo", "bar"))
+			So(err, ShouldBeNil)
+
+			So(pool.Add(tx), ShouldBeNil)
+			So(pool.Len(), ShouldEqual, 1)
+			time.Sleep(20 * time.Millisecond)
+			So(pool.Pending(), ShouldBeEmpty)
+		})
+	})
+
+	Convey("A block template", t, func() {
+		genesis, err := NewGenesisBlock()
+		So(err, ShouldBeNil)
+		pool := NewMempool(MempoolLimits)
+
+		set, err := newTestTransaction(NewCommand(SET, "foo", "bar"))
+		So(err, ShouldBeNil)
+		incr, err := newTestTransaction(NewCommand(INCR, "foo"))
+		So(err, ShouldBeNil)
+		other, err := newTestTransaction(NewCommand(SET, "baz", "qux"))
+		So(err, ShouldBeNil)
+		for _, tx := range []*Transaction{set, incr, other} {
+			So(pool.Add(tx), ShouldBeNil)
+		}
+
+		Convey("keeps the error of transactions which fail", func() {
+			b, err := NewBlockTemplate(genesis, pool)
+			So(err, ShouldBeNil)
+			So(b.Transactions, ShouldResemble, []*Transaction{set, incr, other})
+			So(valueOf(b.State, "foo").Val, ShouldEqual, "bar")
+			hash, err := incr.ReadableHash()
+			So(err, ShouldBeNil)
+			So(valueOf(b.State, resultKey(string(hash))).Val, ShouldResemble, failedWith(errNoPerm))
+
+			Convey("and is valid once worked", func() {
+				So(Work(b), ShouldBeNil)
+				So(b.Verify(), ShouldBeNil)
+			})
+		})
+
+		Convey("takes the transactions of an account in order", func() {
+			account, err := NewAccount()
+			So(err, ShouldBeNil)
+			second, err := newTestTransactionFrom(account, 1, NewCommand(INCR, "counter"))
+			So(err, ShouldBeNil)
+			first, err := newTestTransactionFrom(account, 0, NewCommand(SET, "counter", "1"))
+			So(err, ShouldBeNil)
+			So(pool.Add(second), ShouldBeNil)
+			So(pool.Add(first), ShouldBeNil)
+			So(pool.NextSequence(genesis.State, first.Header.From), ShouldEqual, 2)
+
+			b, err := NewBlockTemplate(genesis, pool)
+			So(err, ShouldBeNil)
+			So(b.Transactions, ShouldResemble, []*Transaction{set, incr, other, first, second})
+			So(valueOf(b.State, "counter").Val, ShouldEqual, "2")
+			So(Work(b), ShouldBeNil)
+			So(b.Verify(), ShouldBeNil)
+		})
+
+		Convey("holds transactions up to a size", func() {
+			policy := MempoolLimits
+			policy.MaxBlockBytes = transactionSize(set)
+			pool := NewMempool(policy)
+			So(pool.Add(set), ShouldBeNil)
+			So(pool.Add(other), ShouldBeNil)
+
+			b, err := NewBlockTemplate(genesis, pool)
+			So(err, ShouldBeNil)
+			So(b.Transactions, ShouldResemble, []*Transaction{set})
+		})
+	})
+
+	Convey("A mining node", t, func() {
+		genesis, err := NewGenesisBlock()
+		So(err, ShouldBeNil)
+		node, err := NewNode(genesis)
+		So(err, ShouldBeNil)
+		defer node.Close()
+
+		tx, err := newTestTransaction(NewCommand(SET, "foo", "bar"))
+		So(err, ShouldBeNil)
+		So(node.Submit(tx), ShouldBeNil)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		result := make(chan error, 1)
+		go func() {
+			result <- node.Mine(ctx, NewMiner(2))
+		}()
+
+		So(eventually(5*time.Second, func() bool { return node.Height() >= 1 }), ShouldBeTrue)
+		cancel()
+		So(<-result, ShouldEqual, context.Canceled)
+		So(valueOf(node.State(), "foo").Val, ShouldEqual, "bar")
+		So(node.Pending(), ShouldBeEmpty)
+	})
+}
@@ -0,0 +1,117 @@
+// merkle tree over the transactions of a block
+//
+// A level with an odd number of nodes promotes its last node to the next
+// level as is, instead of pairing it with a copy of itself. Duplicating the
+// last node would give [a, b, c] and [a, b, c, c] the same root
+// (CVE-2012-2459).
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+)
+
+// a sibling on the path from a transaction up to the merkle root
+type MerkleSibling struct {
+	Hash [32]byte
+	Left bool // the sibling is the left child of their parent
+}
+
+// TransactionProof returns the sibling hashes on the path from the
+// transaction at index to the merkle root of the block
+func (b *Block) TransactionProof(index int) ([]MerkleSibling, error) {
+	if index < 0 || index >= len(b.Transactions) {
+		return nil, errors.New("transaction index out of range")
+	}
+
+	leaves, err := transactionHashes(b.Transactions)
+	if err != nil {
+		return nil, err
+	}
+
+	tree := merkleTree(leaves)
+	path := make([]MerkleSibling, 0, len(tree)-1)
+	for _, level := range tree[:len(tree)-1] {
+		if index%2 == 0 {
+			// a promoted node has no sibling on this level
+			if index+1 < len(level) {
+				path = append(path, MerkleSibling{Hash: level[index+1]})
+			}
+		} else {
+			path = append(path, MerkleSibling{Hash: level[index-1], Left: true})
+		}
+		index /= 2
+	}
+
+	return path, nil
+}
+
+// VerifyTransactionProof checks that a transaction hash is included under
+// the merkle root of a block
+func VerifyTransactionProof(txHash [32]byte, path []MerkleSibling, root [32]byte) bool {
+	hash := txHash
+	for _, sibling := range path {
+		if sibling.Left {
+			hash = hashPair(sibling.Hash, hash)
+		} else {
+			hash = hashPair(hash, sibling.Hash)
+		}
+	}
+
+	return hash == root
+}
+
+// merkleTree returns every level of the tree from the leaves up to the root
+func merkleTree(leaves [][32]byte) [][][32]byte {
+	tree := [][][32]byte{leaves}
+	for level := leaves; len(level) > 1; {
+		next := make([][32]byte, (len(level)+1)/2)
+		for i := range next {
+			if 2*i+1 < len(level) {
+				next[i] = hashPair(level[2*i], level[2*i+1])
+			} else {
+				next[i] = level[2*i]
+			}
+		}
+		tree = append(tree, next)
+		level = next
+	}
+
+	return tree
+}
+
+// merkleRoot returns the root of the transactions, the hash of the only
+// transaction for a single transaction, or zero for an empty block
+func merkleRoot(transactions []*Transaction) ([32]byte, error) {
+	if len(transactions) == 0 {
+		return [32]byte{}, nil
+	}
+
+	leaves, err := transactionHashes(transactions)
+	if err != nil {
+		return [32]byte{}, err
+	}
+
+	tree := merkleTree(leaves)
+	return tree[len(tree)-1][0], nil
+}
+
+func transactionHashes(transactions []*Transaction) ([][32]byte, error) {
+	hashes := make([][32]byte, len(transactions))
+	for i, tx := range transactions {
+		hash, err := tx.Hash()
+		if err != nil {
+			return nil, err
+		}
+		hashes[i] = hash
+	}
+
+	return hashes, nil
+}
+
+func hashPair(left, right [32]byte) [32]byte {
+	combine := make([]byte, 0, 64)
+	combine = append(combine, left[:]...)
+	combine = append(combine, right[:]...)
+	return sha256.Sum256(combine)
+}
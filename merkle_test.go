@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestMerkle(t *testing.T) {
+	Convey("A block with transactions", t, func() {
+		b, err := NewBlock(nil)
+		So(err, ShouldBeNil)
+		for i := 0; i < 4; i++ {
+			tx, err := NewTransactionFromCommand("alice", NewCommand(SET, "foo", fmt.Sprint(i)))
+			So(err, ShouldBeNil)
+			b.Transactions = append(b.Transactions, tx)
+		}
+		So(b.HashTransactions(), ShouldBeNil)
+
+		Convey("can prove each transaction is included", func() {
+			for i, tx := range b.Transactions {
+				path, err := b.TransactionProof(i)
+				So(err, ShouldBeNil)
+				So(len(path), ShouldEqual, 2)
+
+				hash, err := tx.Hash()
+				So(err, ShouldBeNil)
+				So(VerifyTransactionProof(hash, path, b.Header.RootHash), ShouldBeTrue)
+			}
+		})
+
+		Convey("proofs fail for other transactions or roots", func() {
+			path, err := b.TransactionProof(1)
+			So(err, ShouldBeNil)
+
+			hash, err := b.Transactions[2].Hash()
+			So(err, ShouldBeNil)
+			So(VerifyTransactionProof(hash, path, b.Header.RootHash), ShouldBeFalse)
+
+			hash, err = b.Transactions[1].Hash()
+			So(err, ShouldBeNil)
+			So(VerifyTransactionProof(hash, path, [32]byte{}), ShouldBeFalse)
+
+			path[0].Left = !path[0].Left
+			So(VerifyTransactionProof(hash, path, b.Header.RootHash), ShouldBeFalse)
+		})
+
+		Convey("with an odd number of transactions can prove each of them", func() {
+			tx, err := NewTransactionFromCommand("alice", NewCommand(SET, "foo", "4"))
+			So(err, ShouldBeNil)
+			b.Transactions = append(b.Transactions, tx)
+			So(b.HashTransactions(), ShouldBeNil)
+
+			for i, tx := range b.Transactions {
+				path, err := b.TransactionProof(i)
+				So(err, ShouldBeNil)
+
+				hash, err := tx.Hash()
+				So(err, ShouldBeNil)
+				So(VerifyTransactionProof(hash, path, b.Header.RootHash), ShouldBeTrue)
+			}
+
+			path, err := b.TransactionProof(4)
+			So(err, ShouldBeNil)
+			So(len(path), ShouldEqual, 1)
+		})
+
+		Convey("returns error for an index out of range", func() {
+			_, err := b.TransactionProof(4)
+			So(err, ShouldNotBeNil)
+			_, err = b.TransactionProof(-1)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
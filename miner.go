@@ -0,0 +1,188 @@
+// proof of work on every core
+//
+// The nonce space is interleaved between workers: worker i of n tries the
+// nonces i, i+n, i+2n... Workers only hash through HashWithNonce, which
+// leaves the workable untouched, so the winning nonce is set once every
+// worker has stopped.
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// workers check for cancellation every this many nonces
+const minerCheckInterval = 1024
+
+var errNonceSpaceExhausted = errors.New("no nonce reaches the target")
+
+// Miner searches nonces on several goroutines
+type Miner struct {
+	workers int
+	hashes  uint64 // accessed atomically
+
+	mu      sync.Mutex
+	started time.Time
+	stopped time.Time
+}
+
+// NewMiner returns a miner running workers goroutines, or one per CPU if
+// workers is not positive
+func NewMiner(workers int) *Miner {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	return &Miner{workers: workers}
+}
+
+// Mine searches a nonce reaching the target of workable until one is found
+// or ctx is done. The nonce found is set on workable and returned.
+func (m *Miner) Mine(ctx context.Context, workable Workable) (uint64, error) {
+	target := workable.Target()
+
+	m.mu.Lock()
+	atomic.StoreUint64(&m.hashes, 0)
+	m.started = time.Now()
+	m.stopped = time.Time{}
+	m.mu.Unlock()
+	defer func() {
+		m.mu.Lock()
+		m.stopped = time.Now()
+		m.mu.Unlock()
+	}()
+
+	search, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		once    sync.Once
+		found   bool
+		nonce   uint64
+		failure error
+		wg      sync.WaitGroup
+	)
+	stop := func(n uint64, err error) {
+		once.Do(func() {
+			found, nonce, failure = err == nil, n, err
+			cancel()
+		})
+	}
+
+	step := uint64(m.workers)
+	for i := 0; i < m.workers; i++ {
+		wg.Add(1)
+		go func(n uint64) {
+			defer wg.Done()
+			var tried uint64
+			for {
+				if tried%minerCheckInterval == 0 {
+					atomic.AddUint64(&m.hashes, tried)
+					tried = 0
+					if search.Err() != nil {
+						return
+					}
+				}
+
+				hash, err := workable.HashWithNonce(n)
+				tried++
+				if err != nil {
+					atomic.AddUint64(&m.hashes, tried)
+					stop(0, err)
+					return
+				}
+				if meetsTarget(hash, target) {
+					atomic.AddUint64(&m.hashes, tried)
+					stop(n, nil)
+					return
+				}
+
+				if n+step < n {
+					atomic.AddUint64(&m.hashes, tried)
+					return
+				}
+				n += step
+			}
+		}(uint64(i))
+	}
+	wg.Wait()
+
+	if found {
+		workable.SetNonce(nonce)
+		return nonce, nil
+	}
+	if failure != nil {
+		return 0, failure
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return 0, errNonceSpaceExhausted
+}
+
+// HashRate returns the hashes per second of the running or last search
+func (m *Miner) HashRate() float64 {
+	m.mu.Lock()
+	started, stopped := m.started, m.stopped
+	m.mu.Unlock()
+
+	if started.IsZero() {
+		return 0
+	}
+	if stopped.IsZero() {
+		stopped = time.Now()
+	}
+	elapsed := stopped.Sub(started).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(atomic.LoadUint64(&m.hashes)) / elapsed
+}
+
+// Mine works blocks built from the mempool on top of the head and adds them
+// to the node until ctx is done. Work on a block stops as soon as another
+// block changes the head.
+func (n *Node) Mine(ctx context.Context, miner *Miner) error {
+	for {
+		// taken before the head, so a head changing in between isn't missed
+		changed := n.HeadChanged()
+		b, err := NewBlockTemplate(n.Head(), n.pool)
+		if err != nil {
+			return err
+		}
+
+		search, cancel := context.WithCancel(ctx)
+		go func() {
+			select {
+			case <-changed:
+				cancel()
+			case <-search.Done():
+			}
+		}()
+		_, err = miner.Mine(search, b)
+		cancel()
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err == context.Canceled {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		hash, err := b.Hash()
+		if err != nil {
+			return err
+		}
+		if err := n.AddBlock(b); err != nil {
+			log.Printf("mined block %s refused: %v", readableHash(hash), err)
+			continue
+		}
+		log.Printf("mined block %s with %d transactions at %.0f hashes/s", readableHash(hash), len(b.Transactions), miner.HashRate())
+	}
+}
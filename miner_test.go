@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestMiner(t *testing.T) {
+	Convey("A miner", t, func() {
+		miner := NewMiner(4)
+
+		Convey("finds a nonce reaching the target", func() {
+			header := BlockHeader{Bits: 0x2000ffff}
+			nonce, err := miner.Mine(context.Background(), &header)
+			So(err, ShouldBeNil)
+			So(header.Nonce, ShouldEqual, nonce)
+			reached, err := reachThreshold(&header)
+			So(err, ShouldBeNil)
+			So(reached, ShouldBeTrue)
+			So(miner.HashRate(), ShouldBeGreaterThan, 0)
+		})
+
+		Convey("stops when cancelled", func() {
+			header := BlockHeader{Bits: 0x1c00ffff}
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+
+			_, err := miner.Mine(ctx, &header)
+			So(err, ShouldResemble, context.DeadlineExceeded)
+			So(header.Nonce, ShouldEqual, 0)
+			So(miner.HashRate(), ShouldBeGreaterThan, 0)
+		})
+
+		Convey("stops when a competing block arrives", func() {
+			genesis, err := NewGenesisBlock()
+			So(err, ShouldBeNil)
+			node, err := NewNode(genesis)
+			So(err, ShouldBeNil)
+			defer node.Close()
+
+			b, err := NewBlock(node.Head())
+			So(err, ShouldBeNil)
+			So(b.UpdateState(), ShouldBeNil)
+			b.Header.Bits = 0x1c00ffff
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			changed := node.HeadChanged()
+			go func() {
+				select {
+				case <-changed:
+					cancel()
+				case <-ctx.Done():
+				}
+			}()
+
+			result := make(chan error, 1)
+			go func() {
+				_, err := miner.Mine(ctx, b)
+				result <- err
+			}()
+
+			competing, err := mineBlock(node)
+			So(err, ShouldBeNil)
+			So(node.AddBlock(competing), ShouldBeNil)
+
+			select {
+			case err := <-result:
+				So(err, ShouldEqual, context.Canceled)
+			case <-time.After(5 * time.Second):
+				So("mining went on", ShouldBeEmpty)
+			}
+		})
+	})
+}
@@ -0,0 +1,83 @@
+// commands applied all together
+//
+// MULTI queues commands on a connection until EXEC sends them in a single
+// transaction. The commands are applied on a fork of the state, which only
+// replaces the state once all of them succeed, so a block applies either
+// every command of an EXEC or none.
+//
+// WATCH makes an EXEC carry the hashes of the values of keys. Once in a
+// block the EXEC is only applied if they still hold the same values, so it
+// is aborted by writes from any account, mined before it.
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+// executeExec applies the commands of an EXEC with apply and returns their
+// results in order. The state is left untouched when one fails, and when a
+// watched key changed, as nil. Reads run on the state itself, which may be
+// shared with other goroutines.
+func (cmd Command) executeExec(state *State, apply func(Command, *State) (interface{}, error)) (interface{}, error) {
+	changed, err := watchedKeysChanged(state, cmd.Watch)
+	if err != nil || changed {
+		return nil, err
+	}
+
+	fork := state
+	if !cmd.ReadOnly() {
+		fork = state.fork()
+	}
+	rets := make([]interface{}, 0, len(cmd.Commands))
+	for _, c := range cmd.Commands {
+		c.TX, c.at = cmd.TX, cmd.at
+		ret, err := apply(c, fork)
+		if err != nil {
+			return nil, err
+		}
+		rets = append(rets, ret)
+	}
+	if fork != state {
+		state.join(fork)
+	}
+	return rets, nil
+}
+
+// watchHash returns the hash of the value of a key, empty for a missing key
+func watchHash(state *State, key string) (string, error) {
+	if strings.HasPrefix(key, reservedPrefix) {
+		return "", errReservedKey
+	}
+	v, ok := state.Get(key)
+	if !ok {
+		return "", nil
+	}
+	encoded, err := v.encode()
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256(encoded)
+	return hex.EncodeToString(hash[:]), nil
+}
+
+// watchedKeysChanged reports whether a key no longer has the value hashed
+// when it was watched
+func watchedKeysChanged(state *State, watched map[string]string) (bool, error) {
+	for key, expected := range watched {
+		hash, err := watchHash(state, key)
+		if err != nil {
+			return false, err
+		}
+		if hash != expected {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// NewExecCommand returns an EXEC of commands
+func NewExecCommand(commands ...Command) Command {
+	return Command{OP: EXEC, Commands: commands}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestExec(t *testing.T) {
+	Convey("An EXEC", t, func() {
+		state := newStateFrom(map[string]*Value{"counter": {Val: "1"}, "list": {Val: List{"a"}}})
+		state.freeze()
+
+		Convey("applies its commands in order", func() {
+			cmd := NewExecCommand(
+				NewCommand(INCR, "counter"),
+				NewCommand(RPUSH, "list", "b"),
+				NewCommand(GET, "counter"))
+			So(cmd.Keys(), ShouldResemble, []string{"counter", "list", "counter"})
+			So(cmd.ReadOnly(), ShouldBeFalse)
+
+			ret, err := cmd.Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldResemble, []interface{}{int64(2), int64(2), "2"})
+			So(valueOf(state, "list").Val, ShouldResemble, List{"a", "b"})
+			So(state.Changed(), ShouldHaveLength, 2)
+		})
+
+		Convey("leaves the state untouched when a command fails", func() {
+			state.Set("other", &Value{Val: "1"})
+			counter := valueOf(state, "counter")
+			ret, err := NewExecCommand(
+				NewCommand(INCR, "counter"),
+				NewCommand(DEL, "list"),
+				NewCommand(LPUSH, "counter", "x")).Execute(state)
+			So(err, ShouldEqual, errWrongType)
+			So(ret, ShouldBeNil)
+
+			So(valueOf(state, "counter"), ShouldEqual, counter)
+			So(counter.Val, ShouldEqual, "1")
+			So(state.Has("list"), ShouldBeTrue)
+			So(state.Changed(), ShouldResemble, []string{"other"})
+		})
+
+		Convey("is only applied while its watched keys keep their values", func() {
+			hash, err := watchHash(state, "counter")
+			So(err, ShouldBeNil)
+			So(hash, ShouldNotBeEmpty)
+			missing, err := watchHash(state, "missing")
+			So(err, ShouldBeNil)
+			So(missing, ShouldBeEmpty)
+
+			cmd := NewExecCommand(NewCommand(INCR, "counter"))
+			cmd.Watch = map[string]string{"counter": hash, "missing": missing}
+			ret, err := cmd.Execute(state.Snapshot())
+			So(err, ShouldBeNil)
+			So(ret, ShouldResemble, []interface{}{int64(2)})
+
+			state.Set("missing", &Value{Val: "1"})
+			ret, err = cmd.Execute(state)
+			So(err, ShouldBeNil)
+			So(ret, ShouldBeNil)
+			So(valueOf(state, "counter").Val, ShouldEqual, "1")
+
+			cmd.Watch = map[string]string{sequenceKey("alice"): ""}
+			_, err = cmd.Execute(state)
+			So(err, ShouldEqual, errReservedKey)
+		})
+
+		Convey("leaves a shared state alone when it only reads", func() {
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				for i := 0; i < 100; i++ {
+					state.Snapshot()
+				}
+			}()
+			for i := 0; i < 100; i++ {
+				ret, err := NewExecCommand(NewCommand(GET, "counter")).Execute(state)
+				So(err, ShouldBeNil)
+				So(ret, ShouldResemble, []interface{}{"1"})
+			}
+			<-done
+			So(state.Changed(), ShouldBeEmpty)
+		})
+
+		Convey("is read only when its commands are", func() {
+			So(NewExecCommand(NewCommand(GET, "counter"), NewCommand(LLEN, "list")).ReadOnly(), ShouldBeTrue)
+			So(NewExecCommand().ReadOnly(), ShouldBeTrue)
+		})
+
+		Convey("checks the permissions of each command", func() {
+			_, err := applyCommand(state, NewExecCommand(NewCommand(SET, "user:1", "a")), "alice")
+			So(err, ShouldBeNil)
+			_, err = applyCommand(state, NewExecCommand(
+				NewCommand(SET, "mine", "b"),
+				NewCommand(SET, "user:2", "b")), "bob")
+			So(err, ShouldEqual, errNoPerm)
+			So(state.Has("mine"), ShouldBeFalse)
+			owner, _ := keyOwner(state, "user:*")
+			So(owner, ShouldEqual, "alice")
+
+			_, err = applyCommand(state, NewExecCommand(NewCommand(GET, sequenceKey("alice"))), "alice")
+			So(err, ShouldEqual, errReservedKey)
+		})
+	})
+
+	Convey("A transaction of an EXEC", t, func() {
+		genesis, err := NewGenesisBlock()
+		So(err, ShouldBeNil)
+		account, err := NewAccount()
+		So(err, ShouldBeNil)
+		start := genesis.Header.Time.Add(time.Hour)
+		b, err := newTimedBlock(genesis, start, account, NewExecCommand(
+			NewCommand(SET, "foo", "bar", "EX", "10"),
+			NewCommand(GETSET, "foo", "baz")))
+		So(err, ShouldBeNil)
+
+		Convey("stores the results of its commands", func() {
+			So(valueOf(b.State, "foo").Val, ShouldEqual, "baz")
+			retKey, err := b.Transactions[0].ReadableHash()
+			So(err, ShouldBeNil)
+			So(valueOf(b.State, resultKey(string(retKey))).Val, ShouldResemble, []interface{}{"OK", "bar"})
+
+			cmd, err := b.Transactions[0].Command()
+			So(err, ShouldBeNil)
+			So(cmd.Commands, ShouldHaveLength, 2)
+		})
+
+		Convey("keeps the error of a failing command instead of its changes", func() {
+			next, err := newTimedBlock(b, start.Add(time.Second), account, NewExecCommand(
+				NewCommand(SET, "foo", "qux"),
+				NewCommand(INCR, "foo")))
+			So(err, ShouldBeNil)
+
+			So(valueOf(next.State, "foo").Val, ShouldEqual, "baz")
+			retKey, err := next.Transactions[0].ReadableHash()
+			So(err, ShouldBeNil)
+			So(valueOf(next.State, resultKey(string(retKey))).Val, ShouldResemble, failedWith(errNotInteger))
+			So(accountSequence(next.State, next.Transactions[0].Header.From), ShouldEqual, 2)
+		})
+
+		Convey("keeps infinite scores it reads", func() {
+			next, err := newTimedBlock(b, start.Add(time.Second), account, NewExecCommand(
+				NewCommand(ZADD, "z", "inf", "m"),
+				NewCommand(ZSCORE, "z", "m")))
+			So(err, ShouldBeNil)
+			retKey, err := next.Transactions[0].ReadableHash()
+			So(err, ShouldBeNil)
+			So(valueOf(next.State, resultKey(string(retKey))).Val, ShouldResemble, []interface{}{int64(1), "inf"})
+		})
+
+		Convey("is aborted by a write mined before it in the same block", func() {
+			hash, err := watchHash(b.State, "foo")
+			So(err, ShouldBeNil)
+			exec := NewExecCommand(NewCommand(SET, "foo", "mine"))
+			exec.Watch = map[string]string{"foo": hash}
+			conflicting, err := newTestTransactionFrom(account, 1, NewCommand(SET, "foo", "theirs"))
+			So(err, ShouldBeNil)
+			tx, err := newTestTransactionFrom(account, 2, exec)
+			So(err, ShouldBeNil)
+
+			next, err := NewBlock(b)
+			So(err, ShouldBeNil)
+			next.Header.Time = start.Add(time.Second)
+			next.Transactions = []*Transaction{conflicting, tx}
+			So(next.UpdateState(), ShouldBeNil)
+			So(valueOf(next.State, "foo").Val, ShouldEqual, "theirs")
+			retKey, err := tx.ReadableHash()
+			So(err, ShouldBeNil)
+			So(valueOf(next.State, resultKey(string(retKey))).Val, ShouldBeNil)
+			So(accountSequence(next.State, tx.Header.From), ShouldEqual, 3)
+		})
+
+		Convey("is mined with its error when a command fails", func() {
+			pool := NewMempool(MempoolLimits)
+			failing, err := newTestTransactionFrom(account, 1, NewExecCommand(
+				NewCommand(SET, "new", "1"),
+				NewCommand(INCR, "foo")))
+			So(err, ShouldBeNil)
+			So(pool.Add(failing), ShouldBeNil)
+			tx, err := newTestTransaction(NewCommand(SET, "other", "1"))
+			So(err, ShouldBeNil)
+			So(pool.Add(tx), ShouldBeNil)
+
+			template, err := NewBlockTemplate(b, pool)
+			So(err, ShouldBeNil)
+			So(template.Transactions, ShouldResemble, []*Transaction{failing, tx})
+			So(template.State.Has("new"), ShouldBeFalse)
+			So(template.State.Has("other"), ShouldBeTrue)
+		})
+	})
+}
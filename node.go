@@ -0,0 +1,340 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"log"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+)
+
+// a node keeps the local view of the blockchain and the transactions
+// waiting to be included in a block, and gossips both with its peers
+type Node struct {
+	id uint64
+
+	mu      sync.RWMutex
+	genesis [32]byte
+	head    *Block
+	height  int
+	blocks  map[[32]byte]*chainEntry // every known valid block
+	hashes  [][32]byte               // hashes of the main chain by height
+	pool    *Mempool
+	store   *BlockStore
+	// closed and replaced whenever the head changes
+	headChanged chan struct{}
+
+	listener net.Listener
+	peers    map[*Peer]struct{}
+	addrBook *AddrBook
+	sync     *syncer
+	closed   bool
+	quit     chan struct{}
+}
+
+var errOrphanBlock = errors.New("parent block is unknown")
+
+// a block in the tree of known blocks
+type chainEntry struct {
+	block  *Block
+	height int
+	work   *big.Int // cumulative proof of work from the genesis block
+}
+
+// a block failing verification, as opposed to a block which can't be
+// added to the chain yet
+type invalidBlockError struct {
+	err error
+}
+
+func (e invalidBlockError) Error() string {
+	return e.err.Error()
+}
+
+func (n *Node) Head() *Block {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	return n.head
+}
+
+// HeadChanged returns a channel closed when the head next changes, for
+// example to stop mining on top of a stale head
+func (n *Node) HeadChanged() <-chan struct{} {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	return n.headChanged
+}
+
+// Height returns the number of blocks on top of the genesis block
+func (n *Node) Height() int {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	return n.height
+}
+
+// State returns the state of the current head block
+func (n *Node) State() *State {
+	head := n.Head()
+	if head == nil {
+		return NewState()
+	}
+
+	return head.State
+}
+
+// Block returns a known block by its hash
+func (n *Node) Block(hash [32]byte) (*Block, bool) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	entry, ok := n.blocks[hash]
+	if !ok {
+		return nil, false
+	}
+	return entry.block, true
+}
+
+// AddBlock verifies a block on top of any known block and adds it to the
+// tree of blocks. The head follows the branch with the most cumulative
+// work, so the main chain is reorganized when the block makes another
+// branch heavier. Blocks with an unknown parent are refused with
+// errOrphanBlock, and blocks too far ahead of the clock of the node with
+// errFutureBlock.
+func (n *Node) AddBlock(b *Block) error {
+	hash, err := b.Hash()
+	if err != nil {
+		return err
+	}
+
+	n.mu.Lock()
+	if _, ok := n.blocks[hash]; ok {
+		n.mu.Unlock()
+		return nil
+	}
+	if n.head == nil {
+		n.mu.Unlock()
+		return errors.New("node has no genesis block")
+	}
+	parent, ok := n.blocks[b.Header.Prev]
+	n.mu.Unlock()
+	if !ok {
+		return errOrphanBlock
+	}
+
+	// the state of a block is replayed on top of the state of its parent,
+	// whichever branch it is on
+	b.Previous = parent.block
+	err = b.Verify()
+	if err == errFutureBlock {
+		return err
+	}
+	if err != nil {
+		return invalidBlockError{err}
+	}
+	entry := &chainEntry{
+		block:  b,
+		height: parent.height + 1,
+		work:   new(big.Int).Add(parent.work, blockWork(b)),
+	}
+
+	n.mu.Lock()
+	if _, ok := n.blocks[hash]; ok {
+		n.mu.Unlock()
+		return nil
+	}
+	if n.store != nil {
+		if err := n.store.Put(b); err != nil {
+			n.mu.Unlock()
+			return err
+		}
+	}
+	n.blocks[hash] = entry
+	// the first block seen wins between branches of equal work
+	if entry.work.Cmp(n.blocks[n.hashes[n.height]].work) <= 0 {
+		n.mu.Unlock()
+		return nil
+	}
+	if err := n.setHead(hash, entry); err != nil {
+		n.mu.Unlock()
+		return err
+	}
+	n.mu.Unlock()
+
+	n.announce(invItem{invBlock, hash}, nil)
+	return nil
+}
+
+// setHead makes a block the head of the main chain. The blocks of the old
+// main chain after the common ancestor are rolled back, returning their
+// transactions to the pending pool, and the transactions of the new branch
+// leave it. n.mu must be held.
+func (n *Node) setHead(hash [32]byte, entry *chainEntry) error {
+	var branch [][32]byte
+	for cursor, e := hash, entry; e.height >= len(n.hashes) || n.hashes[e.height] != cursor; e = n.blocks[cursor] {
+		branch = append(branch, cursor)
+		cursor = e.block.Header.Prev
+	}
+	ancestor := entry.height - len(branch)
+
+	if n.store != nil {
+		if err := n.store.SetHead(hash); err != nil {
+			return err
+		}
+	}
+
+	orphaned := append([][32]byte{}, n.hashes[ancestor+1:]...)
+	n.hashes = n.hashes[:ancestor+1]
+	for i := len(branch) - 1; i >= 0; i-- {
+		n.hashes = append(n.hashes, branch[i])
+	}
+	n.head = entry.block
+	n.height = entry.height
+	close(n.headChanged)
+	n.headChanged = make(chan struct{})
+
+	for _, h := range orphaned {
+		n.pool.Return(n.blocks[h].block.Transactions)
+	}
+	for _, h := range branch {
+		n.pool.Remove(n.blocks[h].block.Transactions)
+	}
+	n.pool.Prune(n.head.State)
+	if len(orphaned) > 0 {
+		log.Printf("reorganized %d blocks, new head %s at height %d", len(orphaned), readableHash(hash), n.height)
+	}
+	return nil
+}
+
+// SetStore makes the node persist the blocks it adds to a store already
+// holding its chain
+func (n *Node) SetStore(store *BlockStore) {
+	n.store = store
+}
+
+// Submit queues a worked transaction for inclusion in a future block and
+// announces it to peers
+func (n *Node) Submit(tx *Transaction) error {
+	return n.submit(tx, nil)
+}
+
+// submit adds a transaction to the mempool. The node lock is held so it
+// can't be queued again while the block including it becomes the head.
+func (n *Node) submit(tx *Transaction, from *Peer) error {
+	hash, err := tx.Hash()
+	if err != nil {
+		return err
+	}
+
+	n.mu.RLock()
+	if tx.Header.Sequence < accountSequence(n.headState(), tx.Header.From) {
+		n.mu.RUnlock()
+		return errors.New("transaction sequence already used")
+	}
+	err = n.pool.Add(tx)
+	n.mu.RUnlock()
+	if err == errKnownTransaction {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	n.announce(invItem{invTransaction, hash}, from)
+	return nil
+}
+
+// Pending returns the transactions waiting for a block, oldest first
+func (n *Node) Pending() []*Transaction {
+	return n.pool.Pending()
+}
+
+// NextSequence returns the sequence number of the next transaction from an
+// address, following the ones on the main chain and the pending ones
+func (n *Node) NextSequence(address string) uint64 {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	return n.pool.NextSequence(n.headState(), address)
+}
+
+// PendingState returns the state of the head with the pending transactions
+// applied, as the next block would now
+func (n *Node) PendingState() *State {
+	n.mu.RLock()
+	state := n.headState().Snapshot()
+	pending := n.pool.Pending()
+	n.mu.RUnlock()
+
+	applyPending(state, pending, n.pool.policy.MaxBytes, time.Now())
+	return state
+}
+
+// headState returns the state of the head, n.mu must be held
+func (n *Node) headState() *State {
+	if n.head == nil {
+		return NewState()
+	}
+	return n.head.State
+}
+
+// Mempool returns the transactions waiting for a block
+func (n *Node) Mempool() *Mempool {
+	return n.pool
+}
+
+// Transaction returns a pending transaction by its hash
+func (n *Node) Transaction(hash [32]byte) (*Transaction, bool) {
+	return n.pool.Get(hash)
+}
+
+// NewNode creates a node on top of a chain. The first block of the chain
+// is taken as the genesis block.
+func NewNode(head *Block) (*Node, error) {
+	var id [8]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, err
+	}
+
+	n := &Node{
+		id:          binary.BigEndian.Uint64(id[:]),
+		head:        head,
+		height:      -1,
+		blocks:      make(map[[32]byte]*chainEntry),
+		pool:        NewMempool(MempoolLimits),
+		peers:       make(map[*Peer]struct{}),
+		addrBook:    newAddrBook(""),
+		quit:        make(chan struct{}),
+		headChanged: make(chan struct{}),
+	}
+	n.sync = newSyncer(n)
+
+	var chain []*Block
+	for b := head; b != nil; b = b.Previous {
+		chain = append(chain, b)
+	}
+	for i, j := 0, len(chain)-1; i < j; i, j = i+1, j-1 {
+		chain[i], chain[j] = chain[j], chain[i]
+	}
+	work := new(big.Int)
+	for height, b := range chain {
+		hash, err := b.Hash()
+		if err != nil {
+			return nil, err
+		}
+		work = new(big.Int).Add(work, blockWork(b))
+		n.blocks[hash] = &chainEntry{b, height, work}
+		n.hashes = append(n.hashes, hash)
+		n.height = height
+	}
+	if len(n.hashes) > 0 {
+		n.genesis = n.hashes[0]
+	}
+
+	return n, nil
+}
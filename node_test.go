@@ -0,0 +1,249 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// mineBlock works a block with the pending transactions on top of the head
+func mineBlock(n *Node) (*Block, error) {
+	b, err := NewBlock(n.Head())
+	if err != nil {
+		return nil, err
+	}
+	b.Transactions = n.Pending()
+	if err := b.HashTransactions(); err != nil {
+		return nil, err
+	}
+	if err := b.UpdateState(); err != nil {
+		return nil, err
+	}
+	if err := Work(b); err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// the accounts sending the transactions of tests by address
+var testAccounts = map[string]*Account{}
+
+// newTestTransaction returns a worked and signed transaction, the first
+// one of a new account
+func newTestTransaction(cmd Command) (*Transaction, error) {
+	account, err := NewAccount()
+	if err != nil {
+		return nil, err
+	}
+	return newTestTransactionFrom(account, 0, cmd)
+}
+
+// newTestTransactionFrom returns a worked and signed transaction of an
+// account with a sequence number
+func newTestTransactionFrom(account *Account, sequence uint64, cmd Command) (*Transaction, error) {
+	tx, err := NewAccountTransaction(account, cmd)
+	if err != nil {
+		return nil, err
+	}
+	testAccounts[tx.Header.From] = account
+	tx.Header.Sequence = sequence
+	if err := Work(tx); err != nil {
+		return nil, err
+	}
+	return tx, signTestTransaction(tx)
+}
+
+// signTestTransaction signs a transaction again after it is changed
+func signTestTransaction(tx *Transaction) error {
+	return Sign(tx, testAccounts[tx.Header.From])
+}
+
+func TestNode(t *testing.T) {
+	Convey("A node", t, func() {
+		genesis, err := NewGenesisBlock()
+		So(err, ShouldBeNil)
+		node, err := NewNode(genesis)
+		So(err, ShouldBeNil)
+		So(node.Height(), ShouldEqual, 0)
+
+		Convey("drops pending transactions whose sequence number gets used", func() {
+			account, err := NewAccount()
+			So(err, ShouldBeNil)
+			tx, err := newTestTransactionFrom(account, 0, NewCommand(SET, "foo", "bar"))
+			So(err, ShouldBeNil)
+			conflicting, err := newTestTransactionFrom(account, 0, NewCommand(SET, "foo", "baz"))
+			So(err, ShouldBeNil)
+			So(node.Submit(tx), ShouldBeNil)
+			So(node.Submit(conflicting), ShouldBeNil)
+			So(node.NextSequence(tx.Header.From), ShouldEqual, 1)
+
+			b, err := NewBlockTemplate(node.Head(), node.Mempool())
+			So(err, ShouldBeNil)
+			So(b.Transactions, ShouldResemble, []*Transaction{tx})
+			So(Work(b), ShouldBeNil)
+			So(node.AddBlock(b), ShouldBeNil)
+			So(node.Pending(), ShouldBeEmpty)
+		})
+
+		Convey("queues worked transactions once", func() {
+			tx, err := newTestTransaction(NewCommand(SET, "foo", "bar"))
+			So(err, ShouldBeNil)
+
+			So(node.Submit(tx), ShouldBeNil)
+			So(node.Submit(tx), ShouldBeNil)
+			So(len(node.Pending()), ShouldEqual, 1)
+		})
+
+		Convey("rejects transactions without proof of work", func() {
+			tx, err := NewTransactionFromCommand("alice", NewCommand(SET, "foo", "bar"))
+			So(err, ShouldBeNil)
+			for reached, _ := reachThreshold(tx); reached; reached, _ = reachThreshold(tx) {
+				tx.NextTry()
+			}
+
+			So(node.Submit(tx), ShouldNotBeNil)
+			So(node.Pending(), ShouldBeEmpty)
+		})
+
+		Convey("refuses blocks ahead of its clock without calling them invalid", func() {
+			b, err := NewBlock(genesis)
+			So(err, ShouldBeNil)
+			b.Header.Time = time.Now().Add(maxFutureBlockTime + time.Minute)
+			So(b.UpdateState(), ShouldBeNil)
+			So(Work(b), ShouldBeNil)
+
+			So(node.AddBlock(b), ShouldEqual, errFutureBlock)
+			So(node.Head(), ShouldEqual, genesis)
+		})
+
+		Convey("can add a block extending its head", func() {
+			tx, err := newTestTransaction(NewCommand(SET, "foo", "bar"))
+			So(err, ShouldBeNil)
+			So(node.Submit(tx), ShouldBeNil)
+
+			b, err := mineBlock(node)
+			So(err, ShouldBeNil)
+			So(node.AddBlock(b), ShouldBeNil)
+
+			So(node.Head(), ShouldEqual, b)
+			So(node.Height(), ShouldEqual, 1)
+			So(valueOf(node.State(), "foo").Val, ShouldEqual, "bar")
+			So(node.Pending(), ShouldBeEmpty)
+
+			Convey("and refuses transactions reusing a sequence number", func() {
+				replay, err := newTestTransactionFrom(testAccounts[tx.Header.From], 0, NewCommand(SET, "foo", "baz"))
+				So(err, ShouldBeNil)
+				So(node.Submit(replay), ShouldNotBeNil)
+				So(node.Pending(), ShouldBeEmpty)
+				So(node.NextSequence(tx.Header.From), ShouldEqual, 1)
+			})
+
+			Convey("and keeps the first block seen between branches of equal work", func() {
+				other, err := NewBlock(genesis)
+				So(err, ShouldBeNil)
+				So(other.UpdateState(), ShouldBeNil)
+				So(Work(other), ShouldBeNil)
+
+				So(node.AddBlock(other), ShouldBeNil)
+				So(node.Head(), ShouldEqual, b)
+				hash, err := other.Hash()
+				So(err, ShouldBeNil)
+				_, ok := node.Block(hash)
+				So(ok, ShouldBeTrue)
+			})
+		})
+
+		Convey("with two competing branches", func() {
+			a, err := newTestTransaction(NewCommand(SET, "foo", "a"))
+			So(err, ShouldBeNil)
+			shared, err := newTestTransaction(NewCommand(SET, "bar", "shared"))
+			So(err, ShouldBeNil)
+			So(node.Submit(a), ShouldBeNil)
+			So(node.Submit(shared), ShouldBeNil)
+			light, err := mineBlock(node)
+			So(err, ShouldBeNil)
+			So(node.AddBlock(light), ShouldBeNil)
+			So(valueOf(node.State(), "foo").Val, ShouldEqual, "a")
+
+			b, err := newTestTransaction(NewCommand(SET, "foo", "b"))
+			So(err, ShouldBeNil)
+			heavy, err := NewBlock(genesis)
+			So(err, ShouldBeNil)
+			heavy.Transactions = []*Transaction{b, shared}
+			So(heavy.HashTransactions(), ShouldBeNil)
+			So(heavy.UpdateState(), ShouldBeNil)
+			So(Work(heavy), ShouldBeNil)
+			So(node.AddBlock(heavy), ShouldBeNil)
+			So(node.Head(), ShouldEqual, light)
+
+			tip, err := NewBlock(heavy)
+			So(err, ShouldBeNil)
+			So(tip.UpdateState(), ShouldBeNil)
+			So(Work(tip), ShouldBeNil)
+
+			Convey("switch to the heavier one", func() {
+				So(node.AddBlock(tip), ShouldBeNil)
+				So(node.Head(), ShouldEqual, tip)
+				So(node.Height(), ShouldEqual, 2)
+				So(valueOf(node.State(), "foo").Val, ShouldEqual, "b")
+
+				Convey("returning the orphaned transactions to the pending pool", func() {
+					pending := node.Pending()
+					So(len(pending), ShouldEqual, 1)
+					So(pending[0], ShouldEqual, a)
+				})
+
+				Convey("and back when the other one gets heavier", func() {
+					// the pending transaction is already on this branch
+					next, err := NewBlock(light)
+					So(err, ShouldBeNil)
+					So(next.UpdateState(), ShouldBeNil)
+					So(Work(next), ShouldBeNil)
+					So(node.AddBlock(next), ShouldBeNil)
+					So(node.Head(), ShouldEqual, tip)
+
+					last, err := NewBlock(next)
+					So(err, ShouldBeNil)
+					So(last.UpdateState(), ShouldBeNil)
+					So(Work(last), ShouldBeNil)
+					So(node.AddBlock(last), ShouldBeNil)
+
+					So(node.Head(), ShouldEqual, last)
+					So(node.Height(), ShouldEqual, 3)
+					So(valueOf(node.State(), "foo").Val, ShouldEqual, "a")
+					pending := node.Pending()
+					So(len(pending), ShouldEqual, 1)
+					So(pending[0], ShouldEqual, b)
+				})
+			})
+		})
+
+		Convey("refuses blocks whose parent is unknown", func() {
+			parent, err := NewBlock(genesis)
+			So(err, ShouldBeNil)
+			So(parent.UpdateState(), ShouldBeNil)
+			So(Work(parent), ShouldBeNil)
+			b, err := NewBlock(parent)
+			So(err, ShouldBeNil)
+			So(b.UpdateState(), ShouldBeNil)
+			So(Work(b), ShouldBeNil)
+
+			So(node.AddBlock(b), ShouldEqual, errOrphanBlock)
+			So(node.Head(), ShouldEqual, genesis)
+		})
+
+		Convey("refuses invalid blocks", func() {
+			b, err := NewBlock(genesis)
+			So(err, ShouldBeNil)
+			So(b.UpdateState(), ShouldBeNil)
+			for reached, _ := reachThreshold(b); reached; reached, _ = reachThreshold(b) {
+				b.NextTry()
+			}
+
+			So(node.AddBlock(b), ShouldNotBeNil)
+			So(node.Head(), ShouldEqual, genesis)
+		})
+	})
+}
@@ -0,0 +1,728 @@
+// peer to peer networking between nodes
+//
+// Messages are length prefixed JSON envelopes. Both sides of a connection
+// start with a version message carrying their chain head and height, and
+// acknowledge the other side's version with a verack. New transactions and
+// blocks are announced by hash in inv messages; a peer asks for the ones it
+// doesn't have yet with getdata. A node behind its peers downloads their
+// headers with getheaders before fetching the blocks themselves.
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	ProtocolVersion = 1
+
+	maxMessageSize   = 32 * 1024 * 1024
+	handshakeTimeout = 10 * time.Second
+	writeTimeout     = 10 * time.Second
+	peerSendQueue    = 256
+	maxInvItems      = 50000
+	maxAddrItems     = 1000
+	maxKnownItems    = 2 * maxInvItems
+	banDuration      = 24 * time.Hour
+)
+
+const (
+	msgVersion  = "version"
+	msgVerack   = "verack"
+	msgInv      = "inv"
+	msgGetData  = "getdata"
+	msgTx       = "tx"
+	msgBlock    = "block"
+	msgNotFound = "notfound"
+	msgGetAddr  = "getaddr"
+	msgAddr     = "addr"
+
+	msgGetHeaders = "getheaders"
+	msgHeaders    = "headers"
+)
+
+const (
+	invTransaction = "tx"
+	invBlock       = "block"
+)
+
+var (
+	errPeerClosed     = errors.New("peer closed")
+	errSelfConnection = errors.New("connected to self")
+)
+
+type message struct {
+	Type    string
+	Payload json.RawMessage
+}
+
+type versionMessage struct {
+	Version    int
+	ID         uint64
+	Genesis    [32]byte
+	Head       [32]byte
+	Height     int
+	ListenPort int // zero if the node doesn't accept connections
+}
+
+type addrMessage struct {
+	Addrs []string
+}
+
+type invItem struct {
+	Type string
+	Hash [32]byte
+}
+
+type invMessage struct {
+	Items []invItem
+}
+
+func newMessage(t string, payload interface{}) (message, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return message{}, err
+	}
+	return message{t, data}, nil
+}
+
+func readMessage(r io.Reader) (message, error) {
+	var length [4]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return message{}, err
+	}
+	n := binary.BigEndian.Uint32(length[:])
+	if n > maxMessageSize {
+		return message{}, errors.New("message too large")
+	}
+
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return message{}, err
+	}
+	var msg message
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return message{}, err
+	}
+	return msg, nil
+}
+
+func writeMessage(w io.Writer, msg message) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	frame := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(frame, uint32(len(data)))
+	copy(frame[4:], data)
+
+	_, err = w.Write(frame)
+	return err
+}
+
+// a connection to another node
+type Peer struct {
+	node     *Node
+	conn     net.Conn
+	inbound  bool
+	dialAddr string
+	send     chan message
+	quit     chan struct{}
+	ready    chan struct{}
+	closeErr error
+	once     sync.Once
+
+	mu         sync.Mutex
+	version    *versionMessage
+	verack     bool
+	known      map[[32]byte]bool
+	listenAddr string
+}
+
+func newPeer(node *Node, conn net.Conn, dialAddr string) *Peer {
+	return &Peer{
+		node:     node,
+		conn:     conn,
+		inbound:  dialAddr == "",
+		dialAddr: dialAddr,
+		send:     make(chan message, peerSendQueue),
+		quit:     make(chan struct{}),
+		ready:    make(chan struct{}),
+		known:    make(map[[32]byte]bool),
+	}
+}
+
+func (p *Peer) Addr() string {
+	return p.conn.RemoteAddr().String()
+}
+
+// ListenAddr returns the address other nodes can connect to the peer on.
+// It is the dialed address for outbound peers, and the advertised port on
+// the remote host for inbound ones.
+func (p *Peer) ListenAddr() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.listenAddr
+}
+
+// Height returns the chain height the peer announced during the handshake
+func (p *Peer) Height() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.version == nil {
+		return -1
+	}
+	return p.version.Height
+}
+
+// Head returns the chain head the peer announced during the handshake
+func (p *Peer) Head() [32]byte {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.version == nil {
+		return [32]byte{}
+	}
+	return p.version.Head
+}
+
+// setHeight records how far the chain of the peer goes, as learned from
+// the headers it sent after the handshake
+func (p *Peer) setHeight(height int, head [32]byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.version != nil {
+		p.version.Height = height
+		p.version.Head = head
+	}
+}
+
+func (p *Peer) Close() {
+	p.closeWith(errPeerClosed)
+}
+
+func (p *Peer) closeWith(err error) {
+	p.once.Do(func() {
+		p.closeErr = err
+		close(p.quit)
+		p.conn.Close()
+	})
+}
+
+// Send queues a message. A peer which can't keep up is disconnected.
+func (p *Peer) Send(t string, payload interface{}) {
+	msg, err := newMessage(t, payload)
+	if err != nil {
+		return
+	}
+
+	select {
+	case p.send <- msg:
+	case <-p.quit:
+	default:
+		p.closeWith(errors.New("send queue full"))
+	}
+}
+
+// markKnown remembers a hash the peer has. Past maxKnownItems the hashes
+// remembered so far are forgotten, which at worst announces them again.
+func (p *Peer) markKnown(hash [32]byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.known) >= maxKnownItems {
+		p.known = make(map[[32]byte]bool)
+	}
+	p.known[hash] = true
+}
+
+func (p *Peer) knows(hash [32]byte) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.known[hash]
+}
+
+func (p *Peer) run() {
+	go p.writeLoop()
+	p.Send(msgVersion, p.node.versionMessage())
+
+	r := bufio.NewReader(p.conn)
+	p.conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	for {
+		msg, err := readMessage(r)
+		if err != nil {
+			p.closeWith(err)
+			break
+		}
+		if err := p.handle(msg); err != nil {
+			p.closeWith(err)
+			break
+		}
+	}
+
+	p.node.removePeer(p)
+}
+
+func (p *Peer) writeLoop() {
+	w := bufio.NewWriter(p.conn)
+	for {
+		select {
+		case msg := <-p.send:
+			p.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			if err := writeMessage(w, msg); err != nil {
+				p.closeWith(err)
+				return
+			}
+			// batch queued messages into a single write
+			if len(p.send) == 0 {
+				if err := w.Flush(); err != nil {
+					p.closeWith(err)
+					return
+				}
+			}
+		case <-p.quit:
+			return
+		}
+	}
+}
+
+func (p *Peer) isReady() bool {
+	select {
+	case <-p.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+func (p *Peer) isClosed() bool {
+	select {
+	case <-p.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+func (p *Peer) handle(msg message) error {
+	switch msg.Type {
+	case msgVersion:
+		var version versionMessage
+		if err := json.Unmarshal(msg.Payload, &version); err != nil {
+			return err
+		}
+		if err := p.node.checkVersion(&version); err != nil {
+			return err
+		}
+		listenAddr := p.dialAddr
+		if p.inbound && version.ListenPort > 0 {
+			host, _, err := net.SplitHostPort(p.Addr())
+			if err != nil {
+				return err
+			}
+			listenAddr = net.JoinHostPort(host, strconv.Itoa(version.ListenPort))
+		}
+		if listenAddr != "" && p.node.addrBook.IsBanned(listenAddr) {
+			return fmt.Errorf("peer %s is banned", listenAddr)
+		}
+
+		p.mu.Lock()
+		if p.version != nil {
+			p.mu.Unlock()
+			return errors.New("duplicate version message")
+		}
+		p.version = &version
+		p.listenAddr = listenAddr
+		p.mu.Unlock()
+
+		p.Send(msgVerack, struct{}{})
+		return p.completeHandshake()
+	case msgVerack:
+		p.mu.Lock()
+		p.verack = true
+		p.mu.Unlock()
+		return p.completeHandshake()
+	}
+
+	if !p.isReady() {
+		return fmt.Errorf("unexpected %s message before handshake", msg.Type)
+	}
+	return p.node.handleMessage(p, msg)
+}
+
+func (p *Peer) completeHandshake() error {
+	p.mu.Lock()
+	done := p.version != nil && p.verack
+	p.mu.Unlock()
+	if !done || p.isReady() {
+		return nil
+	}
+
+	if err := p.node.addPeer(p); err != nil {
+		return err
+	}
+	p.conn.SetReadDeadline(time.Time{})
+	close(p.ready)
+
+	if addr := p.ListenAddr(); addr != "" {
+		p.node.addrBook.MarkSeen(addr)
+	}
+	if !p.inbound {
+		p.Send(msgGetAddr, struct{}{})
+	}
+	p.node.sync.start()
+	return nil
+}
+
+// waitReady blocks until the handshake is complete or the peer is closed
+func (p *Peer) waitReady() error {
+	select {
+	case <-p.ready:
+		return nil
+	case <-p.quit:
+		return p.closeErr
+	}
+}
+
+// Listen accepts connections from other nodes on addr
+func (n *Node) Listen(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	n.mu.Lock()
+	if n.closed {
+		n.mu.Unlock()
+		l.Close()
+		return errPeerClosed
+	}
+	n.listener = l
+	n.mu.Unlock()
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go newPeer(n, conn, "").run()
+		}
+	}()
+	return nil
+}
+
+// ListenAddr returns the address the node accepts connections on
+func (n *Node) ListenAddr() string {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	if n.listener == nil {
+		return ""
+	}
+	return n.listener.Addr().String()
+}
+
+// Connect dials another node and waits for the handshake to complete
+func (n *Node) Connect(addr string) (*Peer, error) {
+	if n.addrBook.IsBanned(addr) {
+		return nil, fmt.Errorf("peer %s is banned", addr)
+	}
+
+	conn, err := net.DialTimeout("tcp", addr, handshakeTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	p := newPeer(n, conn, addr)
+	go p.run()
+	if err := p.waitReady(); err != nil {
+		if err == errSelfConnection {
+			n.addrBook.Remove(addr)
+		}
+		return nil, err
+	}
+	return p, nil
+}
+
+func (n *Node) Peers() []*Peer {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	peers := make([]*Peer, 0, len(n.peers))
+	for p := range n.peers {
+		peers = append(peers, p)
+	}
+	return peers
+}
+
+// Close stops listening and disconnects every peer
+func (n *Node) Close() error {
+	n.mu.Lock()
+	if !n.closed {
+		close(n.quit)
+	}
+	n.closed = true
+	l := n.listener
+	peers := make([]*Peer, 0, len(n.peers))
+	for p := range n.peers {
+		peers = append(peers, p)
+	}
+	n.mu.Unlock()
+
+	for _, p := range peers {
+		p.Close()
+	}
+	if l != nil {
+		l.Close()
+	}
+	return n.addrBook.Save()
+}
+
+func (n *Node) versionMessage() versionMessage {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	var head [32]byte
+	if n.head != nil {
+		head, _ = n.head.Hash()
+	}
+	var port int
+	if n.listener != nil {
+		if addr, ok := n.listener.Addr().(*net.TCPAddr); ok {
+			port = addr.Port
+		}
+	}
+	return versionMessage{
+		Version:    ProtocolVersion,
+		ID:         n.id,
+		Genesis:    n.genesis,
+		Head:       head,
+		Height:     n.height,
+		ListenPort: port,
+	}
+}
+
+func (n *Node) checkVersion(version *versionMessage) error {
+	if version.Version != ProtocolVersion {
+		return fmt.Errorf("unsupported protocol version %d", version.Version)
+	}
+	if version.ID == n.id {
+		return errSelfConnection
+	}
+	if version.Genesis != n.genesis {
+		return errors.New("different genesis block")
+	}
+	return nil
+}
+
+func (n *Node) addPeer(p *Peer) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.closed {
+		return errPeerClosed
+	}
+	for other := range n.peers {
+		if other.version.ID == p.version.ID {
+			return errors.New("already connected")
+		}
+	}
+	n.peers[p] = struct{}{}
+	return nil
+}
+
+func (n *Node) removePeer(p *Peer) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	delete(n.peers, p)
+}
+
+// announce sends an inventory item to every peer which doesn't know it yet
+func (n *Node) announce(item invItem, from *Peer) {
+	if from != nil {
+		from.markKnown(item.Hash)
+	}
+	for _, p := range n.Peers() {
+		if p.knows(item.Hash) {
+			continue
+		}
+		p.markKnown(item.Hash)
+		p.Send(msgInv, invMessage{[]invItem{item}})
+	}
+}
+
+// has reports whether the node already has the inventory item
+func (n *Node) has(item invItem) bool {
+	switch item.Type {
+	case invTransaction:
+		_, ok := n.Transaction(item.Hash)
+		return ok
+	case invBlock:
+		_, ok := n.Block(item.Hash)
+		return ok
+	}
+	return true
+}
+
+func (n *Node) handleMessage(p *Peer, msg message) error {
+	switch msg.Type {
+	case msgInv:
+		var inv invMessage
+		if err := json.Unmarshal(msg.Payload, &inv); err != nil {
+			return err
+		}
+		if len(inv.Items) > maxInvItems {
+			return errors.New("too many inventory items")
+		}
+
+		wanted := make([]invItem, 0, len(inv.Items))
+		for _, item := range inv.Items {
+			p.markKnown(item.Hash)
+			if !n.has(item) {
+				wanted = append(wanted, item)
+			}
+		}
+		if len(wanted) > 0 {
+			p.Send(msgGetData, invMessage{wanted})
+		}
+	case msgGetData:
+		var inv invMessage
+		if err := json.Unmarshal(msg.Payload, &inv); err != nil {
+			return err
+		}
+		if len(inv.Items) > maxInvItems {
+			return errors.New("too many inventory items")
+		}
+
+		missing := make([]invItem, 0)
+		for _, item := range inv.Items {
+			switch item.Type {
+			case invTransaction:
+				if tx, ok := n.Transaction(item.Hash); ok {
+					p.Send(msgTx, transactionRecord{tx.Header, tx.signature})
+					continue
+				}
+			case invBlock:
+				if b, ok := n.Block(item.Hash); ok {
+					data, err := encodeBlock(b)
+					if err != nil {
+						return err
+					}
+					p.Send(msgBlock, json.RawMessage(data))
+					continue
+				}
+			}
+			missing = append(missing, item)
+		}
+		if len(missing) > 0 {
+			p.Send(msgNotFound, invMessage{missing})
+		}
+	case msgTx:
+		var record transactionRecord
+		if err := json.Unmarshal(msg.Payload, &record); err != nil {
+			return err
+		}
+		tx := &Transaction{Header: record.Header, signature: record.Signature}
+		// transactions already seen or applied are common while they are
+		// gossiped, only invalid ones get the peer disconnected
+		if err := n.submit(tx, p); err != nil {
+			if _, ok := err.(invalidTransactionError); ok {
+				return err
+			}
+		}
+	case msgBlock:
+		b, err := decodeBlock(msg.Payload)
+		if err != nil {
+			return err
+		}
+		hash, err := b.Hash()
+		if err != nil {
+			return err
+		}
+		p.markKnown(hash)
+		if n.sync.receiveBlock(p, b, hash) {
+			return nil
+		}
+		// a block we can't link to our chain means the peer is ahead of
+		// us, but invalid blocks get the peer banned. A block too far in
+		// the future may only be ahead of our clock, it is just dropped.
+		err = n.AddBlock(b)
+		if _, ok := err.(invalidBlockError); ok {
+			n.ban(p)
+			return err
+		}
+		if err == errOrphanBlock {
+			n.sync.requestHeadersFrom(p)
+		}
+	case msgGetAddr:
+		addrs := n.addrBook.Addresses(maxAddrItems)
+		requester := p.ListenAddr()
+		for i, addr := range addrs {
+			if addr == requester {
+				addrs = append(addrs[:i], addrs[i+1:]...)
+				break
+			}
+		}
+		p.Send(msgAddr, addrMessage{addrs})
+	case msgAddr:
+		var addr addrMessage
+		if err := json.Unmarshal(msg.Payload, &addr); err != nil {
+			return err
+		}
+		if len(addr.Addrs) > maxAddrItems {
+			return errors.New("too many addresses")
+		}
+		for _, a := range addr.Addrs {
+			if _, _, err := net.SplitHostPort(a); err == nil {
+				n.addrBook.Add(a)
+			}
+		}
+	case msgGetHeaders:
+		var getHeaders getHeadersMessage
+		if err := json.Unmarshal(msg.Payload, &getHeaders); err != nil {
+			return err
+		}
+		if len(getHeaders.Locator) > maxInvItems {
+			return errors.New("too many locator hashes")
+		}
+		p.Send(msgHeaders, headersMessage{n.headersAfter(getHeaders.Locator)})
+	case msgHeaders:
+		var headers headersMessage
+		if err := json.Unmarshal(msg.Payload, &headers); err != nil {
+			return err
+		}
+		if err := n.sync.receiveHeaders(p, headers.Headers); err != nil {
+			if _, ok := err.(invalidBlockError); ok {
+				n.ban(p)
+			}
+			return err
+		}
+	case msgNotFound:
+		var inv invMessage
+		if err := json.Unmarshal(msg.Payload, &inv); err != nil {
+			return err
+		}
+		if len(inv.Items) > maxInvItems {
+			return errors.New("too many inventory items")
+		}
+		n.sync.notFound(p, inv.Items)
+	default:
+		return fmt.Errorf("unknown message type %s", msg.Type)
+	}
+
+	return nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// eventually polls cond until it holds or the timeout expires
+func eventually(timeout time.Duration, cond func() bool) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return cond()
+}
+
+func startTestNodes(genesis *Block, count int) ([]*Node, error) {
+	nodes := make([]*Node, count)
+	for i := range nodes {
+		node, err := NewNode(genesis)
+		if err != nil {
+			return nil, err
+		}
+		if err := node.Listen("127.0.0.1:0"); err != nil {
+			return nil, err
+		}
+		nodes[i] = node
+	}
+	return nodes, nil
+}
+
+func closeTestNodes(nodes []*Node) {
+	for _, node := range nodes {
+		node.Close()
+	}
+}
+
+func TestPeer(t *testing.T) {
+	Convey("Nodes on the same genesis block", t, func() {
+		genesis, err := NewGenesisBlock()
+		So(err, ShouldBeNil)
+		nodes, err := startTestNodes(genesis, 3)
+		So(err, ShouldBeNil)
+		defer closeTestNodes(nodes)
+
+		Convey("can connect after a handshake exchanging their heads", func() {
+			peer, err := nodes[1].Connect(nodes[0].ListenAddr())
+			So(err, ShouldBeNil)
+
+			genesisHash, err := genesis.Hash()
+			So(err, ShouldBeNil)
+			So(peer.Height(), ShouldEqual, 0)
+			So(peer.Head(), ShouldEqual, genesisHash)
+
+			So(eventually(time.Second, func() bool { return len(nodes[0].Peers()) == 1 }), ShouldBeTrue)
+
+			Convey("only once", func() {
+				_, err := nodes[1].Connect(nodes[0].ListenAddr())
+				So(err, ShouldNotBeNil)
+				So(len(nodes[1].Peers()), ShouldEqual, 1)
+			})
+		})
+
+		Convey("can't connect to themselves", func() {
+			_, err := nodes[0].Connect(nodes[0].ListenAddr())
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("connected in a line", func() {
+			_, err := nodes[1].Connect(nodes[0].ListenAddr())
+			So(err, ShouldBeNil)
+			_, err = nodes[2].Connect(nodes[1].ListenAddr())
+			So(err, ShouldBeNil)
+
+			Convey("gossip transactions to every node", func() {
+				tx, err := newTestTransaction(NewCommand(SET, "foo", "bar"))
+				So(err, ShouldBeNil)
+				So(nodes[0].Submit(tx), ShouldBeNil)
+
+				for _, node := range nodes {
+					n := node
+					So(eventually(5*time.Second, func() bool { return len(n.Pending()) == 1 }), ShouldBeTrue)
+				}
+
+				Convey("and the blocks including them", func() {
+					b, err := mineBlock(nodes[2])
+					So(err, ShouldBeNil)
+					So(nodes[2].AddBlock(b), ShouldBeNil)
+
+					for _, node := range nodes {
+						n := node
+						So(eventually(5*time.Second, func() bool { return n.Height() == 1 }), ShouldBeTrue)
+						So(valueOf(n.State(), "foo").Val, ShouldEqual, "bar")
+						So(n.Pending(), ShouldBeEmpty)
+					}
+				})
+			})
+		})
+	})
+
+	Convey("Nodes on different genesis blocks", t, func() {
+		genesis, err := NewGenesisBlock()
+		So(err, ShouldBeNil)
+		other, err := NewBlock(nil)
+		So(err, ShouldBeNil)
+		So(other.UpdateState(), ShouldBeNil)
+
+		nodes, err := startTestNodes(genesis, 1)
+		So(err, ShouldBeNil)
+		defer closeTestNodes(nodes)
+		node, err := NewNode(other)
+		So(err, ShouldBeNil)
+		defer node.Close()
+
+		Convey("refuse to connect", func() {
+			_, err := node.Connect(nodes[0].ListenAddr())
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	Convey("A node", t, func() {
+		genesis, err := NewGenesisBlock()
+		So(err, ShouldBeNil)
+		nodes, err := startTestNodes(genesis, 1)
+		So(err, ShouldBeNil)
+		defer closeTestNodes(nodes)
+
+		Convey("disconnects peers sending messages before the handshake", func() {
+			conn, err := net.Dial("tcp", nodes[0].ListenAddr())
+			So(err, ShouldBeNil)
+			defer conn.Close()
+
+			msg, err := newMessage(msgInv, invMessage{})
+			So(err, ShouldBeNil)
+			So(writeMessage(conn, msg), ShouldBeNil)
+
+			// the version message of the node, then the connection is closed
+			_, err = readMessage(conn)
+			So(err, ShouldBeNil)
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			_, err = readMessage(conn)
+			So(err, ShouldNotBeNil)
+			So(nodes[0].Peers(), ShouldBeEmpty)
+		})
+	})
+
+	Convey("A peer", t, func() {
+		peer := newPeer(nil, nil, "")
+
+		Convey("remembers a bounded number of known hashes", func() {
+			var hash [32]byte
+			for i := 0; i <= maxKnownItems; i++ {
+				binary.BigEndian.PutUint64(hash[:], uint64(i))
+				peer.markKnown(hash)
+			}
+			So(len(peer.known), ShouldBeLessThanOrEqualTo, maxKnownItems)
+			So(peer.knows(hash), ShouldBeTrue)
+		})
+	})
+}
@@ -1,28 +1,62 @@
 package main
 
-import "encoding/binary"
+import (
+	"context"
+	"math/big"
+)
 
 type Workable interface {
 	Hash() ([32]byte, error)
 	NextTry()
+	// the hash must not exceed the target
+	Target() *big.Int
+	// HashWithNonce hashes the workable as if it had another nonce without
+	// changing it, so nonces can be tried from several goroutines at once
+	HashWithNonce(nonce uint64) ([32]byte, error)
+	SetNonce(nonce uint64)
 }
 
-var ProofOfWorkThreshold = [32]byte{1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+// TransactionPolicy decides the target of transactions. It is kept well
+// above the target of blocks, as the work on a transaction only has to
+// make flooding the network costly. Commands carrying more data need more
+// work.
+type TransactionPolicy struct {
+	// target of a command up to FreeBytes long, in compact form
+	Bits      uint32
+	FreeBytes int
+	// the target halves for every BytesPerDoubling bytes of the command
+	// beyond FreeBytes, up to MaxDoublings times. Zero disables weighting
+	// by size.
+	BytesPerDoubling int
+	MaxDoublings     int
+}
 
-func Work(workable Workable) error {
-	for {
-		reached, err := reachThreshold(workable)
-		if err != nil {
-			return err
-		}
-		if reached {
-			break
-		}
-
-		workable.NextTry()
+// TransactionWork is the policy every node of a network must agree on
+var TransactionWork = TransactionPolicy{
+	Bits:             0x20100000,
+	FreeBytes:        256,
+	BytesPerDoubling: 1024,
+	MaxDoublings:     16,
+}
+
+// Target returns the target of a transaction with a command size bytes long
+func (p TransactionPolicy) Target(size int) *big.Int {
+	target := compactToBig(p.Bits)
+	if p.BytesPerDoubling <= 0 || size <= p.FreeBytes {
+		return target
 	}
 
-	return nil
+	doublings := (size - p.FreeBytes + p.BytesPerDoubling - 1) / p.BytesPerDoubling
+	if doublings > p.MaxDoublings {
+		doublings = p.MaxDoublings
+	}
+	return target.Rsh(target, uint(doublings))
+}
+
+// Work finds a proof of work for workable on every core
+func Work(workable Workable) error {
+	_, err := NewMiner(0).Mine(context.Background(), workable)
+	return err
 }
 
 func reachThreshold(workable Workable) (bool, error) {
@@ -31,5 +65,23 @@ func reachThreshold(workable Workable) (bool, error) {
 		return false, err
 	}
 
-	return binary.BigEndian.Uint64(hash[:]) < binary.BigEndian.Uint64(ProofOfWorkThreshold[:]), nil
+	return meetsTarget(hash, workable.Target()), nil
+}
+
+func meetsTarget(hash [32]byte, target *big.Int) bool {
+	if target.Sign() <= 0 {
+		return false
+	}
+	return new(big.Int).SetBytes(hash[:]).Cmp(target) <= 0
+}
+
+// blockWork returns the expected number of hashes needed to find a block,
+// 2^256 / (target + 1)
+func blockWork(b *Block) *big.Int {
+	target := b.Target()
+	if target.Sign() <= 0 {
+		return new(big.Int)
+	}
+	work := new(big.Int).Lsh(big.NewInt(1), 256)
+	return work.Div(work, target.Add(target, big.NewInt(1)))
 }
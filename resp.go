@@ -0,0 +1,396 @@
+// RESP (REdis Serialization Protocol) encoding and decoding
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+const (
+	maxBulkLength  = 512 * 1024 * 1024
+	maxArrayLength = 1024 * 1024
+	maxInlineSize  = 64 * 1024
+)
+
+// a status reply such as +OK, as opposed to a bulk string
+type simpleString string
+
+// an error reply received from the other side
+type respError string
+
+// the null reply of an aborted EXEC
+type nullArray struct{}
+
+// RESP3 aggregate types, sent as plain arrays to RESP2 clients
+type (
+	respMap  []interface{} // alternating keys and values
+	respSet  []interface{}
+	respPush []interface{}
+)
+
+func (e respError) Error() string {
+	return string(e)
+}
+
+type respReader struct {
+	r *bufio.Reader
+}
+
+func newRespReader(r io.Reader) *respReader {
+	return &respReader{bufio.NewReader(r)}
+}
+
+// ReadCommand reads a request, either as an array of bulk strings or as an
+// inline command separated by spaces.
+func (r *respReader) ReadCommand() ([]string, error) {
+	for {
+		prefix, err := r.r.Peek(1)
+		if err != nil {
+			return nil, err
+		}
+
+		if prefix[0] != '*' {
+			line, err := r.readLine()
+			if err != nil {
+				return nil, err
+			}
+			args := strings.Fields(line)
+			if len(args) == 0 {
+				continue
+			}
+			return args, nil
+		}
+
+		value, err := r.ReadValue()
+		if err != nil {
+			return nil, err
+		}
+		values, ok := value.([]interface{})
+		if !ok {
+			return nil, errors.New("Protocol error: expected array of bulk strings")
+		}
+		if len(values) == 0 {
+			continue
+		}
+
+		args := make([]string, len(values))
+		for i, v := range values {
+			s, ok := v.(string)
+			if !ok {
+				return nil, errors.New("Protocol error: expected array of bulk strings")
+			}
+			args[i] = s
+		}
+		return args, nil
+	}
+}
+
+// ReadValue reads a single RESP2 or RESP3 value. Simple, bulk and verbatim
+// strings are returned as string, integers as int64, errors as respError,
+// nulls as nil, booleans as bool, doubles as float64, arrays as
+// []interface{} and maps, sets and pushes as respMap, respSet and respPush.
+func (r *respReader) ReadValue() (interface{}, error) {
+	line, err := r.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, errors.New("Protocol error: empty line")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return respError(line[1:]), nil
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '(':
+		return line[1:], nil
+	case '_':
+		return nil, nil
+	case '#':
+		return line == "#t", nil
+	case ',':
+		return parseDouble(line[1:])
+	case '$', '=', '!':
+		blob, err := r.readBlob(line[1:])
+		if err != nil || blob == nil {
+			return nil, err
+		}
+		switch line[0] {
+		case '=':
+			if len(*blob) < 4 {
+				return nil, errors.New("Protocol error: bad verbatim string format")
+			}
+			return (*blob)[4:], nil
+		case '!':
+			return respError(*blob), nil
+		}
+		return *blob, nil
+	case '*', '~', '>', '%':
+		n, err := r.readLength(line[1:], maxArrayLength)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		if line[0] == '%' {
+			n *= 2
+		}
+		values := make([]interface{}, n)
+		for i := range values {
+			values[i], err = r.ReadValue()
+			if err != nil {
+				return nil, err
+			}
+		}
+		switch line[0] {
+		case '~':
+			return respSet(values), nil
+		case '>':
+			return respPush(values), nil
+		case '%':
+			return respMap(values), nil
+		}
+		return values, nil
+	}
+
+	return nil, fmt.Errorf("Protocol error: unexpected type byte '%c'", line[0])
+}
+
+func (r *respReader) readBlob(length string) (*string, error) {
+	n, err := r.readLength(length, maxBulkLength)
+	if err != nil || n < 0 {
+		return nil, err
+	}
+	buf := make([]byte, n+2)
+	if _, err := io.ReadFull(r.r, buf); err != nil {
+		return nil, err
+	}
+	if buf[n] != '\r' || buf[n+1] != '\n' {
+		return nil, errors.New("Protocol error: bad bulk string format")
+	}
+	blob := string(buf[:n])
+	return &blob, nil
+}
+
+func (r *respReader) readLength(s string, max int) (int, error) {
+	n, err := strconv.Atoi(s)
+	if err != nil || n > max {
+		return 0, errors.New("Protocol error: invalid length")
+	}
+	if n < 0 {
+		return -1, nil
+	}
+	return n, nil
+}
+
+func (r *respReader) readLine() (string, error) {
+	line, err := r.r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		buf := append([]byte{}, line...)
+		for err == bufio.ErrBufferFull && len(buf) < maxInlineSize {
+			line, err = r.r.ReadSlice('\n')
+			buf = append(buf, line...)
+		}
+		line = buf
+	}
+	if err == bufio.ErrBufferFull {
+		return "", errors.New("Protocol error: too big inline request")
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimRight(string(line), "\r\n"), nil
+}
+
+// a reply writer speaking either RESP2 or RESP3
+type respWriter struct {
+	w     *bufio.Writer
+	proto int
+}
+
+func newRespWriter(w io.Writer) *respWriter {
+	return &respWriter{bufio.NewWriter(w), 2}
+}
+
+// WriteReply encodes a value returned from Command.Execute, downgrading
+// RESP3 types for RESP2 clients
+func (w *respWriter) WriteReply(v interface{}) {
+	switch v := v.(type) {
+	case nil:
+		w.WriteNull()
+	case nullArray:
+		if w.proto < 3 {
+			w.w.WriteString("*-1\r\n")
+			return
+		}
+		w.WriteNull()
+	case simpleString:
+		w.WriteSimpleString(string(v))
+	case string:
+		w.WriteBulkString(v)
+	case int:
+		w.WriteInteger(int64(v))
+	case int64:
+		w.WriteInteger(v)
+	case float64:
+		w.WriteDouble(v)
+	case bool:
+		w.WriteBool(v)
+	case error:
+		w.WriteError(v)
+	case []string:
+		w.writeHeader('*', len(v))
+		for _, s := range v {
+			w.WriteBulkString(s)
+		}
+	case []interface{}:
+		w.writeAggregate('*', v)
+	case respMap:
+		if w.proto < 3 {
+			w.writeAggregate('*', v)
+			return
+		}
+		w.writeHeader('%', len(v)/2)
+		for _, e := range v {
+			w.WriteReply(e)
+		}
+	case respSet:
+		w.writeAggregate('~', v)
+	case respPush:
+		w.writeAggregate('>', v)
+	default:
+		w.WriteBulkString(fmt.Sprint(v))
+	}
+}
+
+func (w *respWriter) WriteSimpleString(s string) {
+	w.w.WriteByte('+')
+	w.w.WriteString(s)
+	w.w.WriteString("\r\n")
+}
+
+// WriteError writes an error reply. Messages without a leading upper case
+// error code (like WRONGTYPE) are prefixed with the generic ERR code.
+func (w *respWriter) WriteError(err error) {
+	msg := strings.Replace(err.Error(), "\r\n", " ", -1)
+	if !hasErrorCode(msg) {
+		msg = "ERR " + msg
+	}
+	w.w.WriteByte('-')
+	w.w.WriteString(msg)
+	w.w.WriteString("\r\n")
+}
+
+func (w *respWriter) WriteInteger(i int64) {
+	w.w.WriteByte(':')
+	w.w.WriteString(strconv.FormatInt(i, 10))
+	w.w.WriteString("\r\n")
+}
+
+// WriteDouble writes a RESP3 double, or a bulk string for RESP2 clients
+func (w *respWriter) WriteDouble(f float64) {
+	if w.proto < 3 {
+		w.WriteBulkString(formatDouble(f))
+		return
+	}
+	w.w.WriteByte(',')
+	w.w.WriteString(formatDouble(f))
+	w.w.WriteString("\r\n")
+}
+
+// WriteBool writes a RESP3 boolean, or 1 and 0 for RESP2 clients
+func (w *respWriter) WriteBool(b bool) {
+	if w.proto < 3 {
+		if b {
+			w.WriteInteger(1)
+		} else {
+			w.WriteInteger(0)
+		}
+		return
+	}
+	if b {
+		w.w.WriteString("#t\r\n")
+	} else {
+		w.w.WriteString("#f\r\n")
+	}
+}
+
+func (w *respWriter) WriteBulkString(s string) {
+	w.writeHeader('$', len(s))
+	w.w.WriteString(s)
+	w.w.WriteString("\r\n")
+}
+
+func (w *respWriter) WriteNull() {
+	if w.proto < 3 {
+		w.w.WriteString("$-1\r\n")
+		return
+	}
+	w.w.WriteString("_\r\n")
+}
+
+func (w *respWriter) Flush() error {
+	return w.w.Flush()
+}
+
+// sets and pushes become plain arrays for RESP2 clients
+func (w *respWriter) writeAggregate(prefix byte, values []interface{}) {
+	if w.proto < 3 {
+		prefix = '*'
+	}
+	w.writeHeader(prefix, len(values))
+	for _, e := range values {
+		w.WriteReply(e)
+	}
+}
+
+func (w *respWriter) writeHeader(prefix byte, n int) {
+	w.w.WriteByte(prefix)
+	w.w.WriteString(strconv.Itoa(n))
+	w.w.WriteString("\r\n")
+}
+
+func formatDouble(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "inf"
+	case math.IsInf(f, -1):
+		return "-inf"
+	case math.IsNaN(f):
+		return "nan"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func parseDouble(s string) (float64, error) {
+	switch strings.ToLower(s) {
+	case "inf", "+inf":
+		return math.Inf(1), nil
+	case "-inf":
+		return math.Inf(-1), nil
+	}
+	return strconv.ParseFloat(s, 64)
+}
+
+func hasErrorCode(msg string) bool {
+	code := msg
+	if i := strings.IndexByte(msg, ' '); i >= 0 {
+		code = msg[:i]
+	}
+	if len(code) < 2 {
+		return false
+	}
+	for _, c := range code {
+		if c < 'A' || c > 'Z' {
+			return false
+		}
+	}
+	return true
+}
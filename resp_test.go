@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestResp(t *testing.T) {
+	Convey("A RESP reader", t, func() {
+		Convey("can read a command sent as an array of bulk strings", func() {
+			r := newRespReader(strings.NewReader("*3\r\n$3\r\nSET\r\n$3\r\nfoo\r\n$4\r\nb\r\nr\r\n"))
+
+			args, err := r.ReadCommand()
+			So(err, ShouldBeNil)
+			So(args, ShouldResemble, []string{"SET", "foo", "b\r\nr"})
+		})
+
+		Convey("can read an inline command", func() {
+			r := newRespReader(strings.NewReader("\r\nGET  foo\r\n"))
+
+			args, err := r.ReadCommand()
+			So(err, ShouldBeNil)
+			So(args, ShouldResemble, []string{"GET", "foo"})
+		})
+
+		Convey("returns error if a command is not made of bulk strings", func() {
+			r := newRespReader(strings.NewReader("*1\r\n:1\r\n"))
+
+			_, err := r.ReadCommand()
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("returns error on an invalid bulk length", func() {
+			r := newRespReader(strings.NewReader("*1\r\n$x\r\n"))
+
+			_, err := r.ReadCommand()
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("can read replies", func() {
+			r := newRespReader(strings.NewReader("+OK\r\n-ERR boom\r\n:42\r\n$-1\r\n*2\r\n$1\r\na\r\n:1\r\n"))
+
+			v, err := r.ReadValue()
+			So(err, ShouldBeNil)
+			So(v, ShouldEqual, "OK")
+
+			v, err = r.ReadValue()
+			So(err, ShouldBeNil)
+			So(v, ShouldEqual, respError("ERR boom"))
+
+			v, err = r.ReadValue()
+			So(err, ShouldBeNil)
+			So(v, ShouldEqual, int64(42))
+
+			v, err = r.ReadValue()
+			So(err, ShouldBeNil)
+			So(v, ShouldBeNil)
+
+			v, err = r.ReadValue()
+			So(err, ShouldBeNil)
+			So(v, ShouldResemble, []interface{}{"a", int64(1)})
+		})
+	})
+
+	Convey("A RESP writer", t, func() {
+		buf := &bytes.Buffer{}
+		w := newRespWriter(buf)
+
+		Convey("encodes command results", func() {
+			w.WriteReply(simpleString("OK"))
+			w.WriteReply("bar")
+			w.WriteReply(int64(2))
+			w.WriteReply(nil)
+			w.WriteReply([]string{"a", "b"})
+			So(w.Flush(), ShouldBeNil)
+
+			So(buf.String(), ShouldEqual, "+OK\r\n$3\r\nbar\r\n:2\r\n$-1\r\n*2\r\n$1\r\na\r\n$1\r\nb\r\n")
+		})
+
+		Convey("downgrades RESP3 types for RESP2 clients", func() {
+			w.WriteReply(respMap{"a", int64(1)})
+			w.WriteReply(respSet{"b"})
+			w.WriteReply(1.5)
+			w.WriteReply(true)
+			So(w.Flush(), ShouldBeNil)
+
+			So(buf.String(), ShouldEqual, "*2\r\n$1\r\na\r\n:1\r\n*1\r\n$1\r\nb\r\n$3\r\n1.5\r\n:1\r\n")
+		})
+
+		Convey("encodes RESP3 types once negotiated", func() {
+			w.proto = 3
+			w.WriteReply(nil)
+			w.WriteReply(respMap{"a", int64(1)})
+			w.WriteReply(respSet{"b"})
+			w.WriteReply(respPush{"message"})
+			w.WriteReply(1.5)
+			w.WriteReply(math.Inf(-1))
+			w.WriteReply(false)
+			So(w.Flush(), ShouldBeNil)
+
+			So(buf.String(), ShouldEqual, "_\r\n%1\r\n$1\r\na\r\n:1\r\n~1\r\n$1\r\nb\r\n>1\r\n$7\r\nmessage\r\n,1.5\r\n,-inf\r\n#f\r\n")
+
+			Convey("which can be read back", func() {
+				r := newRespReader(buf)
+				expected := []interface{}{nil, respMap{"a", int64(1)}, respSet{"b"}, respPush{"message"}, 1.5, math.Inf(-1), false}
+				for _, e := range expected {
+					v, err := r.ReadValue()
+					So(err, ShouldBeNil)
+					So(v, ShouldResemble, e)
+				}
+			})
+		})
+
+		Convey("prefixes errors without an error code with ERR", func() {
+			w.WriteReply(errors.New("boom"))
+			w.WriteReply(errWrongType)
+			So(w.Flush(), ShouldBeNil)
+
+			So(buf.String(), ShouldEqual, "-ERR boom\r\n-"+errWrongType.Error()+"\r\n")
+		})
+	})
+}
@@ -0,0 +1,115 @@
+// per account sequence numbers protecting against replays
+//
+// A transaction carries the number of transactions its sender had applied
+// before it. The count is kept in the state under a reserved key, so a
+// transaction can only be applied once, and after the ones sent before it.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// keys starting with reservedPrefix belong to the chain, commands can't
+// touch them
+const reservedPrefix = "\x00"
+
+var errReservedKey = errors.New("key is reserved")
+
+// reads are answered by each node from its own state, a transaction of a
+// read-only command would only take space in blocks
+var errReadOnlyTransaction = errors.New("read-only command in transaction")
+
+func sequenceKey(address string) string {
+	return reservedPrefix + "seq:" + address
+}
+
+// accountSequence returns the sequence number the next transaction of an
+// address must carry
+func accountSequence(state *State, address string) uint64 {
+	v, ok := state.Get(sequenceKey(address))
+	if !ok {
+		return 0
+	}
+	s, _ := v.Val.(string)
+	seq, _ := strconv.ParseUint(s, 10, 64)
+	return seq
+}
+
+// checkSequence checks a transaction is the next one of its sender
+func checkSequence(state *State, tx *Transaction) error {
+	expected := accountSequence(state, tx.Header.From)
+	if tx.Header.Sequence != expected {
+		return fmt.Errorf("unexpected sequence %d from %s, expecting %d", tx.Header.Sequence, tx.Header.From, expected)
+	}
+	return nil
+}
+
+// resultKey is where the result of a transaction is kept, under its readable
+// hash. It is out of reach of commands so no account can overwrite the result
+// of another, clients read it with RESULT txhash.
+func resultKey(hash string) string {
+	return reservedPrefix + "ret:" + hash
+}
+
+// resultValue is how the result of a transaction is kept in the state. JSON
+// has no infinity, so doubles are kept formatted as they are replied.
+func resultValue(ret interface{}) interface{} {
+	switch v := ret.(type) {
+	case float64:
+		return formatDouble(v)
+	case []interface{}:
+		values := make([]interface{}, len(v))
+		for i, e := range v {
+			values[i] = resultValue(e)
+		}
+		return values
+	}
+	return ret
+}
+
+// a commandError is the result of a transaction whose command failed. It
+// is kept like any other result, as the transaction still counts.
+type commandError struct {
+	Err string
+}
+
+func (e commandError) Error() string {
+	return e.Err
+}
+
+func failedWith(err error) commandError {
+	return commandError{err.Error()}
+}
+
+// applyTransaction runs the command of a transaction on a state at the time
+// of its block and counts it for its sender. A transaction out of sequence
+// or of a read-only command leaves the state untouched and fails, while a
+// failing command only leaves its keys untouched and returns a commandError
+// as its result.
+func applyTransaction(state *State, tx *Transaction, at time.Time) (interface{}, error) {
+	if err := checkSequence(state, tx); err != nil {
+		return nil, err
+	}
+
+	var ret interface{}
+	cmd, err := tx.Command()
+	if err == nil && cmd.ReadOnly() {
+		return nil, errReadOnlyTransaction
+	}
+	if err == nil {
+		cmd.at = at
+		fork := state.fork()
+		ret, err = applyCommand(fork, cmd, tx.Header.From)
+		if err == nil {
+			state.join(fork)
+		}
+	}
+	if err != nil {
+		ret = failedWith(err)
+	}
+	state.Set(sequenceKey(tx.Header.From), &Value{Val: strconv.FormatUint(tx.Header.Sequence+1, 10)})
+	return ret, nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestSequence(t *testing.T) {
+	Convey("Transactions of an account", t, func() {
+		genesis, err := NewGenesisBlock()
+		So(err, ShouldBeNil)
+		account, err := NewAccount()
+		So(err, ShouldBeNil)
+		first, err := newTestTransactionFrom(account, 0, NewCommand(SET, "foo", "1"))
+		So(err, ShouldBeNil)
+		second, err := newTestTransactionFrom(account, 1, NewCommand(INCR, "foo"))
+		So(err, ShouldBeNil)
+
+		block := func(prev *Block, txs ...*Transaction) (*Block, error) {
+			b, err := NewBlock(prev)
+			if err != nil {
+				return nil, err
+			}
+			b.Transactions = txs
+			if err := b.HashTransactions(); err != nil {
+				return nil, err
+			}
+			if err := Work(b); err != nil {
+				return nil, err
+			}
+			return b, nil
+		}
+
+		Convey("are applied in order", func() {
+			b, err := block(genesis, first, second)
+			So(err, ShouldBeNil)
+			So(b.UpdateState(), ShouldBeNil)
+			So(Work(b), ShouldBeNil)
+			So(b.Verify(), ShouldBeNil)
+			So(valueOf(b.State, "foo").Val, ShouldEqual, "2")
+			So(accountSequence(b.State, first.Header.From), ShouldEqual, 2)
+
+			Convey("and only once", func() {
+				replay, err := block(b, second)
+				So(err, ShouldBeNil)
+				So(replay.UpdateState(), ShouldNotBeNil)
+				So(replay.Verify(), ShouldNotBeNil)
+			})
+		})
+
+		Convey("can't be applied out of order", func() {
+			b, err := block(genesis, second, first)
+			So(err, ShouldBeNil)
+			So(b.UpdateState(), ShouldNotBeNil)
+			So(b.Verify(), ShouldNotBeNil)
+		})
+
+		Convey("can't be applied twice in a block", func() {
+			b, err := block(genesis, first, first)
+			So(err, ShouldBeNil)
+			So(b.UpdateState(), ShouldNotBeNil)
+		})
+
+		Convey("can't change the sequence numbers", func() {
+			tx, err := newTestTransactionFrom(account, 0, NewCommand(SET, sequenceKey(first.Header.From), "0"))
+			So(err, ShouldBeNil)
+			state := NewState()
+			ret, err := applyTransaction(state, tx, time.Now())
+			So(err, ShouldBeNil)
+			So(ret, ShouldResemble, failedWith(errReservedKey))
+			So(state.Keys(), ShouldResemble, []string{sequenceKey(first.Header.From)})
+			So(accountSequence(state, first.Header.From), ShouldEqual, 1)
+		})
+
+		Convey("of malformed commands only have an error as their result", func() {
+			malformed, err := newTestTransactionFrom(account, 0, Command{OP: RENAME, Key: "foo"})
+			So(err, ShouldBeNil)
+			b, err := block(genesis, malformed)
+			So(err, ShouldBeNil)
+			So(b.UpdateState(), ShouldBeNil)
+			So(Work(b), ShouldBeNil)
+			So(b.Verify(), ShouldBeNil)
+
+			hash, err := malformed.ReadableHash()
+			So(err, ShouldBeNil)
+			So(valueOf(b.State, resultKey(string(hash))).Val, ShouldResemble, failedWith(errWrongArity("rename")))
+			So(accountSequence(b.State, malformed.Header.From), ShouldEqual, 1)
+		})
+
+		Convey("can't be read-only", func() {
+			read, err := newTestTransactionFrom(account, 0, NewCommand(GET, "foo"))
+			So(err, ShouldBeNil)
+			state := NewState()
+			_, err = applyTransaction(state, read, time.Now())
+			So(err, ShouldEqual, errReadOnlyTransaction)
+			So(state.Len(), ShouldEqual, 0)
+			So(NewMempool(MempoolLimits).Add(read), ShouldEqual, errReadOnlyTransaction)
+		})
+
+		Convey("can't overwrite the results of others", func() {
+			b, err := block(genesis, first)
+			So(err, ShouldBeNil)
+			So(b.UpdateState(), ShouldBeNil)
+			hash, err := first.ReadableHash()
+			So(err, ShouldBeNil)
+			So(valueOf(b.State, resultKey(string(hash))).Val, ShouldEqual, "OK")
+
+			overwrite, err := newTestTransaction(NewCommand(SET, resultKey(string(hash)), "forged"))
+			So(err, ShouldBeNil)
+			state := b.State.Snapshot()
+			ret, err := applyTransaction(state, overwrite, time.Now())
+			So(err, ShouldBeNil)
+			So(ret, ShouldResemble, failedWith(errReservedKey))
+			So(valueOf(state, resultKey(string(hash))).Val, ShouldEqual, "OK")
+		})
+	})
+}
@@ -0,0 +1,596 @@
+// a Redis protocol front end of a node
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type commandSpec struct {
+	op     OP
+	arity  int  // including the command name, -n means at least n
+	write  bool // writes are turned into transactions
+	status bool // string results are status replies instead of bulk strings
+}
+
+var commands = map[string]commandSpec{
+	"set":          {SET, -3, true, true},
+	"get":          {GET, 2, false, false},
+	"incr":         {INCR, 2, true, false},
+	"getset":       {GETSET, 3, true, false},
+	"expire":       {EXPIRE, 3, true, false},
+	"grant":        {GRANT, 3, true, true},
+	"revoke":       {REVOKE, 3, true, true},
+	"setnx":        {SETNX, 3, true, false},
+	"setex":        {SETEX, 4, true, true},
+	"psetex":       {PSETEX, 4, true, true},
+	"mset":         {MSET, -3, true, true},
+	"msetnx":       {MSETNX, -3, true, false},
+	"mget":         {MGET, -2, false, false},
+	"append":       {APPEND, 3, true, false},
+	"strlen":       {STRLEN, 2, false, false},
+	"getrange":     {GETRANGE, 4, false, false},
+	"setrange":     {SETRANGE, 4, true, false},
+	"incrby":       {INCRBY, 3, true, false},
+	"incrbyfloat":  {INCRBYFLOAT, 3, true, false},
+	"decr":         {DECR, 2, true, false},
+	"decrby":       {DECRBY, 3, true, false},
+	"getdel":       {GETDEL, 2, true, false},
+	"getex":        {GETEX, -2, true, false},
+	"lpush":        {LPUSH, -3, true, false},
+	"rpush":        {RPUSH, -3, true, false},
+	"lpop":         {LPOP, -2, true, false},
+	"rpop":         {RPOP, -2, true, false},
+	"lrange":       {LRANGE, 4, false, false},
+	"llen":         {LLEN, 2, false, false},
+	"lindex":       {LINDEX, 3, false, false},
+	"lset":         {LSET, 4, true, true},
+	"linsert":      {LINSERT, 5, true, false},
+	"lrem":         {LREM, 4, true, false},
+	"ltrim":        {LTRIM, 4, true, true},
+	"lmove":        {LMOVE, 5, true, false},
+	"hset":         {HSET, -4, true, false},
+	"hget":         {HGET, 3, false, false},
+	"hmget":        {HMGET, -3, false, false},
+	"hgetall":      {HGETALL, 2, false, false},
+	"hdel":         {HDEL, -3, true, false},
+	"hexists":      {HEXISTS, 3, false, false},
+	"hkeys":        {HKEYS, 2, false, false},
+	"hvals":        {HVALS, 2, false, false},
+	"hlen":         {HLEN, 2, false, false},
+	"hincrby":      {HINCRBY, 4, true, false},
+	"hincrbyfloat": {HINCRBYFLOAT, 4, true, false},
+	"hsetnx":       {HSETNX, 4, true, false},
+	"hscan":        {HSCAN, -3, false, false},
+	"sadd":         {SADD, -3, true, false},
+	"srem":         {SREM, -3, true, false},
+	"sismember":    {SISMEMBER, 3, false, false},
+	"smembers":     {SMEMBERS, 2, false, false},
+	"scard":        {SCARD, 2, false, false},
+	"sinter":       {SINTER, -2, false, false},
+	"sunion":       {SUNION, -2, false, false},
+	"sdiff":        {SDIFF, -2, false, false},
+	"sinterstore":  {SINTERSTORE, -3, true, false},
+	"zadd":         {ZADD, -4, true, false},
+	"zrange":       {ZRANGE, -4, false, false},
+	"zrank":        {ZRANK, -3, false, false},
+	"zscore":       {ZSCORE, 3, false, false},
+	"zincrby":      {ZINCRBY, 4, true, false},
+	"zrem":         {ZREM, -3, true, false},
+	"zcard":        {ZCARD, 2, false, false},
+	"zcount":       {ZCOUNT, 4, false, false},
+	"zpopmin":      {ZPOPMIN, -2, true, false},
+	"zpopmax":      {ZPOPMAX, -2, true, false},
+	"del":          {DEL, -2, true, false},
+	"unlink":       {UNLINK, -2, true, false},
+	"exists":       {EXISTS, -2, false, false},
+	"type":         {TYPE, 2, false, true},
+	"rename":       {RENAME, 3, true, true},
+	"renamenx":     {RENAMENX, 3, true, false},
+	"ttl":          {TTL, 2, false, false},
+	"pttl":         {PTTL, 2, false, false},
+	"expireat":     {EXPIREAT, 3, true, false},
+	"pexpire":      {PEXPIRE, 3, true, false},
+	"persist":      {PERSIST, 2, true, false},
+	"keys":         {KEYS, 2, false, false},
+	"scan":         {SCAN, -2, false, false},
+	"dbsize":       {DBSIZE, 1, false, false},
+}
+
+// commandNames names the commands of the table by their OP
+var commandNames = func() map[OP]string {
+	names := make(map[OP]string, len(commands))
+	for name, spec := range commands {
+		names[spec.op] = name
+	}
+	return names
+}()
+
+var (
+	errServerClosed = errors.New("server closed")
+	errWatchedKey   = errors.New("watched key changed")
+)
+
+// per connection state
+type client struct {
+	id     int64
+	name   string
+	writer *respWriter
+
+	// commands queued since MULTI
+	multi   bool
+	queued  []queuedCommand
+	aborted bool // a command could not be queued
+
+	// hashes of the values of the keys watched, after the pending
+	// transactions
+	watched map[string]string
+}
+
+type queuedCommand struct {
+	spec commandSpec
+	cmd  Command
+}
+
+type Server struct {
+	node    *Node
+	account *Account
+
+	// writes are serialized so they get consecutive sequence numbers
+	writeMu sync.Mutex
+
+	mu       sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	closed   bool
+	lastID   int64
+}
+
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	return s.Serve(l)
+}
+
+// Serve accepts connections on the listener until the server is closed
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		l.Close()
+		return errServerClosed
+	}
+	s.listener = l
+	s.mu.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return errServerClosed
+			}
+			return err
+		}
+
+		s.mu.Lock()
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+
+		go s.handle(conn)
+	}
+}
+
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	for conn := range s.conns {
+		conn.Close()
+	}
+	if s.listener != nil {
+		return s.listener.Close()
+	}
+	return nil
+}
+
+func (s *Server) handle(conn net.Conn) {
+	s.mu.Lock()
+	s.lastID++
+	c := &client{id: s.lastID, writer: newRespWriter(conn)}
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+
+	r := newRespReader(conn)
+	w := c.writer
+	for {
+		args, err := r.ReadCommand()
+		if err != nil {
+			if err != io.EOF {
+				w.WriteError(err)
+				w.Flush()
+			}
+			return
+		}
+
+		name := strings.ToLower(args[0])
+		w.WriteReply(s.dispatch(c, name, args))
+		if err := w.Flush(); err != nil {
+			return
+		}
+		if name == "quit" {
+			return
+		}
+	}
+}
+
+func (s *Server) dispatch(c *client, name string, args []string) interface{} {
+	switch name {
+	case "hello":
+		return s.hello(c, args)
+	case "ping":
+		if len(args) > 2 {
+			return errWrongArity(name)
+		}
+		if len(args) == 2 {
+			return args[1]
+		}
+		return simpleString("PONG")
+	case "echo":
+		if len(args) != 2 {
+			return errWrongArity(name)
+		}
+		return args[1]
+	case "quit":
+		return simpleString("OK")
+	case "result":
+		return s.result(args)
+	case "multi", "exec", "discard", "watch", "unwatch":
+		return s.transaction(c, name, args)
+	}
+
+	spec, cmd, err := parseCommand(name, args)
+	if err != nil {
+		if c.multi {
+			c.aborted = true
+		}
+		return err
+	}
+	if c.multi {
+		c.queued = append(c.queued, queuedCommand{spec, cmd})
+		return simpleString("QUEUED")
+	}
+
+	var ret interface{}
+	if spec.write {
+		ret, err = s.write(cmd)
+	} else {
+		ret, err = s.read(cmd)
+	}
+	if err != nil {
+		return err
+	}
+	return reply(spec, cmd, ret)
+}
+
+// parseCommand returns the command called by args
+func parseCommand(name string, args []string) (commandSpec, Command, error) {
+	spec, ok := commands[name]
+	if !ok {
+		return spec, Command{}, fmt.Errorf("unknown command '%s'", args[0])
+	}
+	if err := checkArity(name, spec, len(args)); err != nil {
+		return spec, Command{}, err
+	}
+
+	// DBSIZE is the only command without a key
+	if len(args) == 1 {
+		return spec, NewCommand(spec.op, ""), nil
+	}
+	return spec, NewCommand(spec.op, args[1], args[2:]...), nil
+}
+
+// checkArity checks the number of arguments of a command, its name included
+func checkArity(name string, spec commandSpec, n int) error {
+	if (spec.arity > 0 && n != spec.arity) || n < -spec.arity {
+		return errWrongArity(name)
+	}
+	return nil
+}
+
+// validate checks a command decoded from a transaction could have been
+// parsed by the server, as commands assume the arguments the table gives
+// them. Transactions come from any sender.
+func (cmd Command) validate() error {
+	if cmd.OP == EXEC {
+		for _, c := range cmd.Commands {
+			if c.OP == EXEC {
+				return errors.New("ERR EXEC inside EXEC is not allowed")
+			}
+			if err := c.validate(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	name, ok := commandNames[cmd.OP]
+	if !ok {
+		return fmt.Errorf("unknown command %d", cmd.OP)
+	}
+	spec := commands[name]
+	// the name and the key, which DBSIZE has not
+	n := 2 + len(cmd.Arguments)
+	if spec.arity == 1 && cmd.Key == "" {
+		n = 1 + len(cmd.Arguments)
+	}
+	return checkArity(name, spec, n)
+}
+
+// reply turns the result of a command into its reply
+func reply(spec commandSpec, cmd Command, ret interface{}) interface{} {
+	if str, ok := ret.(string); ok && spec.status && !repliesValue(cmd) {
+		return simpleString(str)
+	}
+	return ret
+}
+
+// RESULT txhash replies with the result of a transaction in the head state,
+// nil until it is mined, and the error of its command when it failed
+func (s *Server) result(args []string) interface{} {
+	if len(args) != 2 {
+		return errWrongArity("result")
+	}
+	v, ok := s.node.State().Get(resultKey(args[1]))
+	if !ok {
+		return nil
+	}
+	if err, ok := v.Val.(commandError); ok {
+		return err
+	}
+	return v.Val
+}
+
+// MULTI, EXEC [DISCARD], WATCH key [key ...] and UNWATCH
+func (s *Server) transaction(c *client, name string, args []string) interface{} {
+	switch name {
+	case "watch":
+		if len(args) < 2 {
+			return errWrongArity(name)
+		}
+	default:
+		if len(args) != 1 {
+			return errWrongArity(name)
+		}
+	}
+
+	switch name {
+	case "multi":
+		if c.multi {
+			return errors.New("ERR MULTI calls can not be nested")
+		}
+		c.multi = true
+	case "exec":
+		if !c.multi {
+			return errors.New("ERR EXEC without MULTI")
+		}
+		return s.exec(c)
+	case "discard":
+		if !c.multi {
+			return errors.New("ERR DISCARD without MULTI")
+		}
+		c.multi, c.queued, c.aborted = false, nil, false
+		c.watched = nil
+	case "watch":
+		if c.multi {
+			return errors.New("ERR WATCH inside MULTI is not allowed")
+		}
+		if err := s.watch(c, args[1:]); err != nil {
+			return err
+		}
+	case "unwatch":
+		c.watched = nil
+	}
+	return simpleString("OK")
+}
+
+// exec sends the commands queued by a client in a single transaction, or
+// reads them all at once when none writes. Nothing is sent and a null array
+// is returned when a watched key changed.
+func (s *Server) exec(c *client) interface{} {
+	queued, aborted, watched := c.queued, c.aborted, c.watched
+	c.multi, c.queued, c.aborted, c.watched = false, nil, false, nil
+	if aborted {
+		return errors.New("EXECABORT Transaction discarded because of previous errors.")
+	}
+
+	commands := make([]Command, len(queued))
+	for i, q := range queued {
+		commands[i] = q.cmd
+	}
+	cmd := NewExecCommand(commands...)
+	var ret interface{}
+	var err error
+	if cmd.ReadOnly() {
+		// reads are not sent, they run after the pending transactions like
+		// the watched keys were hashed, and are checked on the same state
+		state := s.node.PendingState()
+		changed, werr := watchedKeysChanged(state, watched)
+		if werr != nil {
+			return werr
+		}
+		if changed {
+			return nullArray{}
+		}
+		cmd.at = time.Now()
+		ret, err = cmd.Execute(state)
+	} else {
+		cmd.Watch = watched
+		ret, err = s.write(cmd)
+	}
+	if err == errWatchedKey {
+		return nullArray{}
+	}
+	if err != nil {
+		return err
+	}
+
+	rets := ret.([]interface{})
+	for i, q := range queued {
+		rets[i] = reply(q.spec, q.cmd, rets[i])
+	}
+	return rets
+}
+
+// watch hashes the values of keys after the pending transactions, the
+// state the next writes of the server apply on
+func (s *Server) watch(c *client, keys []string) error {
+	if c.watched == nil {
+		c.watched = make(map[string]string)
+	}
+	state := s.node.PendingState()
+	for _, key := range keys {
+		if _, ok := c.watched[key]; ok {
+			continue
+		}
+		hash, err := watchHash(state, key)
+		if err != nil {
+			return err
+		}
+		c.watched[key] = hash
+	}
+	return nil
+}
+
+// HELLO [protover [AUTH username password] [SETNAME clientname]]
+func (s *Server) hello(c *client, args []string) interface{} {
+	proto := c.writer.proto
+	if len(args) > 1 {
+		v, err := strconv.Atoi(args[1])
+		if err != nil {
+			return errors.New("Protocol version is not an integer or out of range")
+		}
+		if v < 2 || v > 3 {
+			return errors.New("NOPROTO unsupported protocol version")
+		}
+		proto = v
+	}
+
+	name := c.name
+	for i := 2; i < len(args); i++ {
+		switch strings.ToLower(args[i]) {
+		case "auth":
+			if i+2 >= len(args) {
+				return errors.New("syntax error")
+			}
+			return errors.New("AUTH <password> called without any password configured for the default user")
+		case "setname":
+			if i+1 >= len(args) {
+				return errors.New("syntax error")
+			}
+			name = args[i+1]
+			i++
+		default:
+			return errors.New("syntax error")
+		}
+	}
+
+	c.writer.proto = proto
+	c.name = name
+
+	return respMap{
+		"server", "bcdis",
+		"version", Version,
+		"proto", int64(proto),
+		"id", c.id,
+		"mode", "standalone",
+		"role", "master",
+		"modules", []interface{}{},
+	}
+}
+
+// read runs a command on the head state
+func (s *Server) read(cmd Command) (interface{}, error) {
+	// reads like TTL happen at the time of the node
+	cmd.at = time.Now()
+	return cmd.Execute(s.node.State())
+}
+
+// write turns a command into a signed and worked transaction and queues it
+// in the node. The result is what the command returns when applied after
+// the pending transactions, as the ones of the server are applied in order.
+// An EXEC whose watched keys already changed is not queued.
+func (s *Server) write(cmd Command) (interface{}, error) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	tx, err := NewAccountTransaction(s.account, cmd)
+	if err != nil {
+		return nil, err
+	}
+	tx.Header.Sequence = s.node.NextSequence(tx.Header.From)
+
+	cmd.TX, cmd.at = tx, time.Now()
+	ret, err := applyCommand(s.node.PendingState(), cmd, tx.Header.From)
+	if err != nil {
+		return nil, err
+	}
+	if cmd.OP == EXEC && ret == nil {
+		return nil, errWatchedKey
+	}
+
+	if err := Work(tx); err != nil {
+		return nil, err
+	}
+	if err := Sign(tx, s.account); err != nil {
+		return nil, err
+	}
+	if err := s.node.Submit(tx); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// repliesValue reports whether a command with status replies replies with a
+// value instead, like SET with the GET option
+func repliesValue(cmd Command) bool {
+	if cmd.OP != SET {
+		return false
+	}
+	for _, option := range cmd.Arguments[1:] {
+		if strings.EqualFold(option, "GET") {
+			return true
+		}
+	}
+	return false
+}
+
+func errWrongArity(name string) error {
+	return fmt.Errorf("wrong number of arguments for '%s' command", name)
+}
+
+func NewServer(node *Node, account *Account) (*Server, error) {
+	return &Server{
+		node:    node,
+		account: account,
+		conns:   make(map[net.Conn]struct{}),
+	}, nil
+}
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type testClient struct {
+	conn net.Conn
+	r    *respReader
+}
+
+func (c *testClient) Do(args ...string) (interface{}, error) {
+	req := fmt.Sprintf("*%d\r\n", len(args))
+	for _, arg := range args {
+		req += fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := c.conn.Write([]byte(req)); err != nil {
+		return nil, err
+	}
+
+	return c.r.ReadValue()
+}
+
+func startTestServer(node *Node, account *Account) (*Server, *testClient, error) {
+	server, err := NewServer(node, account)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, nil, err
+	}
+	go server.Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		server.Close()
+		return nil, nil, err
+	}
+
+	return server, &testClient{conn, newRespReader(conn)}, nil
+}
+
+func TestServer(t *testing.T) {
+	Convey("A server", t, func() {
+		account, err := NewAccount()
+		So(err, ShouldBeNil)
+		head, err := NewBlock(nil)
+		So(err, ShouldBeNil)
+		tx, err := NewAccountTransaction(account, NewCommand(SET, "foo", "1"))
+		So(err, ShouldBeNil)
+		head.Transactions = append(head.Transactions, tx)
+		tx, err = NewTransactionFromCommand("alice", NewCommand(SET, "owned", "1"))
+		So(err, ShouldBeNil)
+		head.Transactions = append(head.Transactions, tx)
+		tx, err = NewTransactionFromCommand("alice", NewCommand(INCR, "foo"))
+		So(err, ShouldBeNil)
+		tx.Header.Sequence = 1
+		head.Transactions = append(head.Transactions, tx)
+		So(head.UpdateState(), ShouldBeNil)
+
+		node, err := NewNode(head)
+		So(err, ShouldBeNil)
+		server, client, err := startTestServer(node, account)
+		So(err, ShouldBeNil)
+		defer server.Close()
+
+		Convey("answers PING", func() {
+			ret, err := client.Do("PING")
+			So(err, ShouldBeNil)
+			So(ret, ShouldEqual, "PONG")
+		})
+
+		Convey("serves reads from the head state", func() {
+			ret, err := client.Do("GET", "foo")
+			So(err, ShouldBeNil)
+			So(ret, ShouldEqual, "1")
+
+			ret, err = client.Do("get", "missing")
+			So(err, ShouldBeNil)
+			So(ret, ShouldBeNil)
+
+			So(node.Pending(), ShouldBeEmpty)
+		})
+
+		Convey("replies with the results of mined transactions", func() {
+			for i, expected := range []interface{}{"OK", "OK", respError(errNoPerm.Error())} {
+				hash, err := head.Transactions[i].ReadableHash()
+				So(err, ShouldBeNil)
+				ret, err := client.Do("RESULT", string(hash))
+				So(err, ShouldBeNil)
+				So(ret, ShouldEqual, expected)
+			}
+
+			ret, err := client.Do("RESULT", "missing")
+			So(err, ShouldBeNil)
+			So(ret, ShouldBeNil)
+			ret, err = client.Do("RESULT")
+			So(err, ShouldBeNil)
+			So(ret, ShouldEqual, respError("ERR wrong number of arguments for 'result' command"))
+		})
+
+		Convey("turns writes into worked and signed transactions", func() {
+			ret, err := client.Do("SET", "bar", "baz")
+			So(err, ShouldBeNil)
+			So(ret, ShouldEqual, "OK")
+
+			ret, err = client.Do("INCR", "foo")
+			So(err, ShouldBeNil)
+			So(ret, ShouldEqual, int64(2))
+
+			pending := node.Pending()
+			So(len(pending), ShouldEqual, 2)
+
+			reached, err := reachThreshold(pending[0])
+			So(err, ShouldBeNil)
+			So(reached, ShouldBeTrue)
+			So(Verify(pending[0], server.account), ShouldBeNil)
+
+			So(pending[0].VerifySignature(), ShouldBeNil)
+			So(pending[0].Header.Sequence, ShouldEqual, 1)
+			So(pending[1].Header.Sequence, ShouldEqual, 2)
+
+			cmd, err := pending[1].Command()
+			So(err, ShouldBeNil)
+			So(cmd.OP, ShouldEqual, INCR)
+			So(cmd.Key, ShouldEqual, "foo")
+
+			Convey("without touching the head state", func() {
+				So(valueOf(head.State, "foo").Val, ShouldEqual, "1")
+				ok := head.State.Has("bar")
+				So(ok, ShouldBeFalse)
+			})
+		})
+
+		Convey("replies to string commands like Redis", func() {
+			ret, err := client.Do("SET", "foo", "2", "GET")
+			So(err, ShouldBeNil)
+			So(ret, ShouldEqual, "1")
+
+			ret, err = client.Do("SETNX", "foo", "3")
+			So(err, ShouldBeNil)
+			So(ret, ShouldEqual, int64(0))
+
+			ret, err = client.Do("MGET", "foo", "missing")
+			So(err, ShouldBeNil)
+			So(ret, ShouldResemble, []interface{}{"1", nil})
+
+			ret, err = client.Do("MSET", "a", "1", "b")
+			So(err, ShouldBeNil)
+			So(ret, ShouldEqual, respError("ERR wrong number of arguments for 'mset' command"))
+		})
+
+		Convey("replies to list commands like Redis", func() {
+			ret, err := client.Do("RPUSH", "list", "a", "b")
+			So(err, ShouldBeNil)
+			So(ret, ShouldEqual, int64(2))
+
+			// writes follow the pending ones, not yet applied to the head
+			ret, err = client.Do("LSET", "list", "0", "b")
+			So(err, ShouldBeNil)
+			So(ret, ShouldEqual, "OK")
+			ret, err = client.Do("LRANGE", "list", "0", "-1")
+			So(err, ShouldBeNil)
+			So(ret, ShouldResemble, []interface{}{})
+
+			ret, err = client.Do("LRANGE", "foo", "0", "-1")
+			So(err, ShouldBeNil)
+			So(ret, ShouldEqual, respError(errWrongType.Error()))
+		})
+
+		Convey("replies to keyspace commands like Redis", func() {
+			ret, err := client.Do("TYPE", "foo")
+			So(err, ShouldBeNil)
+			So(ret, ShouldEqual, "string")
+
+			ret, err = client.Do("TTL", "foo")
+			So(err, ShouldBeNil)
+			So(ret, ShouldEqual, int64(-1))
+
+			ret, err = client.Do("EXPIRE", "foo", "10")
+			So(err, ShouldBeNil)
+			So(ret, ShouldEqual, int64(1))
+			ret, err = client.Do("PEXPIRE", "missing", "10")
+			So(err, ShouldBeNil)
+			So(ret, ShouldEqual, int64(0))
+
+			keys, err := client.Do("KEYS", "*")
+			So(err, ShouldBeNil)
+			So(keys, ShouldContain, "foo")
+
+			ret, err = client.Do("DBSIZE")
+			So(err, ShouldBeNil)
+			So(ret, ShouldEqual, int64(len(keys.([]interface{}))))
+		})
+
+		Convey("checks writes against the pending ones", func() {
+			ret, err := client.Do("SET", "bar", "1")
+			So(err, ShouldBeNil)
+			So(ret, ShouldEqual, "OK")
+			ret, err = client.Do("LPUSH", "bar", "x")
+			So(err, ShouldBeNil)
+			So(ret, ShouldEqual, respError(errWrongType.Error()))
+			ret, err = client.Do("SET", "baz", "1")
+			So(err, ShouldBeNil)
+			So(ret, ShouldEqual, "OK")
+
+			b, err := NewBlockTemplate(node.Head(), node.Mempool())
+			So(err, ShouldBeNil)
+			So(b.Transactions, ShouldResemble, node.Pending())
+			So(len(b.Transactions), ShouldEqual, 2)
+		})
+
+		Convey("does not queue writes that fail", func() {
+			ret, err := client.Do("RENAME", "missing", "foo")
+			So(err, ShouldBeNil)
+			So(ret, ShouldEqual, respError("ERR no such key"))
+
+			ret, err = client.Do("SET", "owned", "2")
+			So(err, ShouldBeNil)
+			So(ret, ShouldEqual, respError(errNoPerm.Error()))
+
+			So(node.Pending(), ShouldBeEmpty)
+		})
+
+		Convey("sends the commands queued by MULTI in a single transaction", func() {
+			ret, err := client.Do("MULTI")
+			So(err, ShouldBeNil)
+			So(ret, ShouldEqual, "OK")
+			ret, err = client.Do("MULTI")
+			So(err, ShouldBeNil)
+			So(ret, ShouldEqual, respError("ERR MULTI calls can not be nested"))
+
+			for _, args := range [][]string{{"SET", "bar", "1"}, {"INCR", "foo"}, {"GET", "foo"}} {
+				ret, err = client.Do(args...)
+				So(err, ShouldBeNil)
+				So(ret, ShouldEqual, "QUEUED")
+			}
+			So(node.Pending(), ShouldBeEmpty)
+
+			ret, err = client.Do("EXEC")
+			So(err, ShouldBeNil)
+			So(ret, ShouldResemble, []interface{}{"OK", int64(2), "2"})
+
+			pending := node.Pending()
+			So(len(pending), ShouldEqual, 1)
+			cmd, err := pending[0].Command()
+			So(err, ShouldBeNil)
+			So(cmd.OP, ShouldEqual, EXEC)
+			So(cmd.Commands, ShouldHaveLength, 3)
+
+			ret, err = client.Do("EXEC")
+			So(err, ShouldBeNil)
+			So(ret, ShouldEqual, respError("ERR EXEC without MULTI"))
+		})
+
+		Convey("sends nothing when a queued command fails", func() {
+			client.Do("MULTI")
+			client.Do("SET", "bar", "1")
+			client.Do("LPUSH", "foo", "x")
+			ret, err := client.Do("EXEC")
+			So(err, ShouldBeNil)
+			So(ret, ShouldEqual, respError(errWrongType.Error()))
+
+			client.Do("MULTI")
+			ret, err = client.Do("FOO")
+			So(err, ShouldBeNil)
+			So(ret, ShouldEqual, respError("ERR unknown command 'FOO'"))
+			client.Do("SET", "bar", "1")
+			ret, err = client.Do("EXEC")
+			So(err, ShouldBeNil)
+			So(ret, ShouldEqual, respError("EXECABORT Transaction discarded because of previous errors."))
+
+			client.Do("MULTI")
+			client.Do("SET", "bar", "1")
+			ret, err = client.Do("DISCARD")
+			So(err, ShouldBeNil)
+			So(ret, ShouldEqual, "OK")
+
+			So(node.Pending(), ShouldBeEmpty)
+		})
+
+		Convey("reads the commands queued by MULTI without a transaction", func() {
+			client.Do("MULTI")
+			client.Do("GET", "foo")
+			client.Do("TYPE", "foo")
+			ret, err := client.Do("EXEC")
+			So(err, ShouldBeNil)
+			So(ret, ShouldResemble, []interface{}{"1", "string"})
+			So(node.Pending(), ShouldBeEmpty)
+
+			Convey("after the pending writes its watched keys are hashed from", func() {
+				_, err := client.Do("SET", "foo", "5")
+				So(err, ShouldBeNil)
+				client.Do("WATCH", "foo")
+				client.Do("MULTI")
+				client.Do("GET", "foo")
+				ret, err := client.Do("EXEC")
+				So(err, ShouldBeNil)
+				So(ret, ShouldResemble, []interface{}{"5"})
+				So(len(node.Pending()), ShouldEqual, 1)
+			})
+		})
+
+		Convey("aborts EXEC when a watched key was written", func() {
+			conn, err := net.Dial("tcp", client.conn.RemoteAddr().String())
+			So(err, ShouldBeNil)
+			other := &testClient{conn, newRespReader(conn)}
+			defer conn.Close()
+
+			ret, err := client.Do("WATCH", "foo", "bar")
+			So(err, ShouldBeNil)
+			So(ret, ShouldEqual, "OK")
+			_, err = other.Do("SET", "foo", "5")
+			So(err, ShouldBeNil)
+
+			client.Do("MULTI")
+			ret, err = client.Do("WATCH", "foo")
+			So(err, ShouldBeNil)
+			So(ret, ShouldEqual, respError("ERR WATCH inside MULTI is not allowed"))
+			client.Do("INCR", "foo")
+			ret, err = client.Do("EXEC")
+			So(err, ShouldBeNil)
+			So(ret, ShouldBeNil)
+			So(len(node.Pending()), ShouldEqual, 1)
+
+			Convey("or written by another node", func() {
+				client.Do("WATCH", "foo")
+				address, err := account.Address()
+				So(err, ShouldBeNil)
+				tx, err := newTestTransactionFrom(account, node.NextSequence(string(address)), NewCommand(SET, "foo", "7"))
+				So(err, ShouldBeNil)
+				So(node.Submit(tx), ShouldBeNil)
+
+				client.Do("MULTI")
+				client.Do("INCR", "foo")
+				ret, err = client.Do("EXEC")
+				So(err, ShouldBeNil)
+				So(ret, ShouldBeNil)
+				So(len(node.Pending()), ShouldEqual, 2)
+			})
+
+			Convey("and runs it otherwise", func() {
+				client.Do("WATCH", "bar")
+				_, err = other.Do("SET", "baz", "1")
+				So(err, ShouldBeNil)
+				client.Do("MULTI")
+				client.Do("INCR", "foo")
+				ret, err = client.Do("EXEC")
+				So(err, ShouldBeNil)
+				So(ret, ShouldResemble, []interface{}{int64(6)})
+				pending := node.Pending()
+				So(len(pending), ShouldEqual, 3)
+				cmd, err := pending[2].Command()
+				So(err, ShouldBeNil)
+				So(cmd.Watch, ShouldContainKey, "bar")
+			})
+		})
+
+		Convey("speaks RESP2 until HELLO negotiates RESP3", func() {
+			ret, err := client.Do("GET", "missing")
+			So(err, ShouldBeNil)
+			So(ret, ShouldBeNil)
+
+			ret, err = client.Do("HELLO", "3", "SETNAME", "test")
+			So(err, ShouldBeNil)
+			hello, ok := ret.(respMap)
+			So(ok, ShouldBeTrue)
+			So(hello[0:6], ShouldResemble, respMap{"server", "bcdis", "version", Version, "proto", int64(3)})
+			ret, err = client.Do("HGETALL", "missing")
+			So(err, ShouldBeNil)
+			So(ret, ShouldHaveSameTypeAs, respMap{})
+
+			_, err = client.conn.Write([]byte("GET missing\r\n"))
+			So(err, ShouldBeNil)
+			line, err := client.r.readLine()
+			So(err, ShouldBeNil)
+			So(line, ShouldEqual, "_")
+
+			ret, err = client.Do("HELLO", "2")
+			So(err, ShouldBeNil)
+			So(ret, ShouldHaveSameTypeAs, []interface{}{})
+		})
+
+		Convey("rejects unsupported protocol versions", func() {
+			ret, err := client.Do("HELLO", "4")
+			So(err, ShouldBeNil)
+			So(ret, ShouldEqual, respError("NOPROTO unsupported protocol version"))
+		})
+
+		Convey("returns error on unknown command or wrong arity", func() {
+			ret, err := client.Do("FOO")
+			So(err, ShouldBeNil)
+			So(ret, ShouldEqual, respError("ERR unknown command 'FOO'"))
+
+			ret, err = client.Do("GET")
+			So(err, ShouldBeNil)
+			So(ret, ShouldEqual, respError("ERR wrong number of arguments for 'get' command"))
+		})
+	})
+}
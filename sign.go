@@ -33,6 +33,10 @@ func Sign(signable Signable, account *Account) error {
 }
 
 func Verify(signable Signable, account *Account) error {
+	return verifyWithKey(signable, account.Public())
+}
+
+func verifyWithKey(signable Signable, key *ecdsa.PublicKey) error {
 	hash, err := signable.Hash()
 	if err != nil {
 		return err
@@ -49,7 +53,7 @@ func Verify(signable Signable, account *Account) error {
 		return err
 	}
 
-	ok := ecdsa.Verify(account.Public(), hash[:], ecdsaSignature.R, ecdsaSignature.S)
+	ok := ecdsa.Verify(key, hash[:], ecdsaSignature.R, ecdsaSignature.S)
 	if !ok {
 		return errors.New("Verification Failed")
 	}
@@ -0,0 +1,278 @@
+// the keys of the chain at a block
+//
+// A State is a persistent hash trie: changing a key copies the nodes on its
+// path and shares the others, so a block takes a snapshot of the state of
+// its parent in constant time and the two share memory. Values are shared
+// too, commands changing one in place get their own copy with Mutable.
+package main
+
+const (
+	stateBits  = 5
+	stateWidth = 1 << stateBits
+)
+
+type stateEntry struct {
+	key   string
+	hash  uint64
+	value *Value
+}
+
+// a stateNode is either a branch indexed by the next bits of the hash of
+// keys, or a leaf holding entries with the same hash. Nodes are never
+// changed once in a trie.
+type stateNode struct {
+	children *[stateWidth]*stateNode
+	entries  []stateEntry
+}
+
+type State struct {
+	root *stateNode
+	size int
+	// keys set (true) or deleted since the last snapshot. The values set
+	// belong to this state, others may be shared with snapshots.
+	changed map[string]bool
+}
+
+func NewState() *State {
+	return &State{changed: make(map[string]bool)}
+}
+
+// newStateFrom returns a state holding values
+func newStateFrom(values map[string]*Value) *State {
+	s := NewState()
+	for key, v := range values {
+		s.Set(key, v)
+	}
+	return s
+}
+
+// Snapshot returns a copy of a state sharing its nodes and values. Both
+// copy a value before changing it from then on. The snapshot of a nil state,
+// of a block not applied, is empty.
+func (s *State) Snapshot() *State {
+	if s == nil {
+		return NewState()
+	}
+	if len(s.changed) > 0 {
+		s.freeze()
+	}
+	return s.fork()
+}
+
+// fork returns a copy of a state to apply changes which may be given up.
+// Unlike a snapshot it leaves the changes of the state alone, the copy is
+// joined back with join.
+func (s *State) fork() *State {
+	return &State{root: s.root, size: s.size, changed: make(map[string]bool)}
+}
+
+// join takes the keys of a fork of the state
+func (s *State) join(fork *State) {
+	s.root, s.size = fork.root, fork.size
+	for key, set := range fork.changed {
+		s.changed[key] = set
+	}
+}
+
+// freeze gives up the values of a state and forgets its changes. The state
+// of a block is frozen before it is published, so snapshots of it can be
+// taken concurrently.
+func (s *State) freeze() {
+	s.changed = make(map[string]bool)
+}
+
+// Changed returns the keys set or deleted since the last snapshot
+func (s *State) Changed() []string {
+	keys := make([]string, 0, len(s.changed))
+	for key := range s.changed {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// Len returns the number of keys
+func (s *State) Len() int {
+	return s.size
+}
+
+// Get returns the value of a key. It may be shared with other states and
+// must not be changed.
+func (s *State) Get(key string) (*Value, bool) {
+	h := hashKey(key)
+	n := s.root
+	for shift := uint(0); n != nil; shift += stateBits {
+		if n.children == nil {
+			for _, e := range n.entries {
+				if e.key == key {
+					return e.value, true
+				}
+			}
+			return nil, false
+		}
+		n = n.children[(h>>shift)%stateWidth]
+	}
+	return nil, false
+}
+
+// Has reports whether a key is set
+func (s *State) Has(key string) bool {
+	_, ok := s.Get(key)
+	return ok
+}
+
+// Mutable returns the value of a key to be changed in place, copying it
+// first if it may be shared
+func (s *State) Mutable(key string) (*Value, bool) {
+	v, ok := s.Get(key)
+	if !ok {
+		return nil, false
+	}
+	if s.changed[key] {
+		return v, true
+	}
+	v = v.clone()
+	s.Set(key, v)
+	return v, true
+}
+
+// Set sets the value of a key, which now belongs to the state
+func (s *State) Set(key string, v *Value) {
+	var added bool
+	s.root, added = stateInsert(s.root, hashKey(key), 0, key, v)
+	if added {
+		s.size++
+	}
+	s.changed[key] = true
+}
+
+// Delete removes a key
+func (s *State) Delete(key string) {
+	var removed bool
+	s.root, removed = stateRemove(s.root, hashKey(key), 0, key)
+	if removed {
+		s.size--
+		s.changed[key] = false
+	}
+}
+
+// Range calls f for every key until it returns false, in no particular
+// order
+func (s *State) Range(f func(key string, v *Value) bool) {
+	stateRange(s.root, f)
+}
+
+// Keys returns every key, in no particular order
+func (s *State) Keys() []string {
+	keys := make([]string, 0, s.size)
+	s.Range(func(key string, _ *Value) bool {
+		keys = append(keys, key)
+		return true
+	})
+	return keys
+}
+
+// hashKey is 64 bits FNV-1a, the same on every node
+func hashKey(key string) uint64 {
+	h := uint64(14695981039346656037)
+	for i := 0; i < len(key); i++ {
+		h ^= uint64(key[i])
+		h *= 1099511628211
+	}
+	return h
+}
+
+func stateInsert(n *stateNode, h uint64, shift uint, key string, v *Value) (*stateNode, bool) {
+	entry := stateEntry{key, h, v}
+	if n == nil {
+		return &stateNode{entries: []stateEntry{entry}}, true
+	}
+
+	if n.children == nil {
+		for i, e := range n.entries {
+			if e.key == key {
+				entries := append([]stateEntry(nil), n.entries...)
+				entries[i] = entry
+				return &stateNode{entries: entries}, false
+			}
+		}
+		// keys of the same hash share a leaf, others are split apart
+		if n.entries[0].hash == h || shift >= 64 {
+			entries := append(append([]stateEntry(nil), n.entries...), entry)
+			return &stateNode{entries: entries}, true
+		}
+		branch := &stateNode{children: new([stateWidth]*stateNode)}
+		branch.children[(n.entries[0].hash>>shift)%stateWidth] = n
+		return stateInsert(branch, h, shift, key, v)
+	}
+
+	children := *n.children
+	i := (h >> shift) % stateWidth
+	child, added := stateInsert(children[i], h, shift+stateBits, key, v)
+	children[i] = child
+	return &stateNode{children: &children}, added
+}
+
+func stateRemove(n *stateNode, h uint64, shift uint, key string) (*stateNode, bool) {
+	if n == nil {
+		return nil, false
+	}
+
+	if n.children == nil {
+		for i, e := range n.entries {
+			if e.key != key {
+				continue
+			}
+			if len(n.entries) == 1 {
+				return nil, true
+			}
+			entries := append(append([]stateEntry(nil), n.entries[:i]...), n.entries[i+1:]...)
+			return &stateNode{entries: entries}, true
+		}
+		return n, false
+	}
+
+	i := (h >> shift) % stateWidth
+	child, removed := stateRemove(n.children[i], h, shift+stateBits, key)
+	if !removed {
+		return n, false
+	}
+	children := *n.children
+	children[i] = child
+
+	// a branch left with a single leaf is replaced by the leaf
+	var last *stateNode
+	count := 0
+	for _, c := range children {
+		if c != nil {
+			last = c
+			count++
+		}
+	}
+	switch {
+	case count == 0:
+		return nil, true
+	case count == 1 && last.children == nil:
+		return last, true
+	}
+	return &stateNode{children: &children}, true
+}
+
+func stateRange(n *stateNode, f func(key string, v *Value) bool) bool {
+	if n == nil {
+		return true
+	}
+	if n.children == nil {
+		for _, e := range n.entries {
+			if !f(e.key, e.value) {
+				return false
+			}
+		}
+		return true
+	}
+	for _, c := range n.children {
+		if !stateRange(c, f) {
+			return false
+		}
+	}
+	return true
+}
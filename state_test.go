@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// valueOf returns the value of a key, nil if missing
+func valueOf(state *State, key string) *Value {
+	v, _ := state.Get(key)
+	return v
+}
+
+func TestState(t *testing.T) {
+	Convey("A state", t, func() {
+		state := NewState()
+		for i := 0; i < 1000; i++ {
+			state.Set(fmt.Sprintf("key%d", i), &Value{Val: fmt.Sprint(i)})
+		}
+
+		Convey("holds many keys", func() {
+			So(state.Len(), ShouldEqual, 1000)
+			So(state.Keys(), ShouldHaveLength, 1000)
+			So(valueOf(state, "key42").Val, ShouldEqual, "42")
+			So(state.Has("missing"), ShouldBeFalse)
+
+			state.Set("key42", &Value{Val: "x"})
+			So(state.Len(), ShouldEqual, 1000)
+			So(valueOf(state, "key42").Val, ShouldEqual, "x")
+		})
+
+		Convey("collapses when keys are deleted", func() {
+			state.Delete("missing")
+			So(state.Len(), ShouldEqual, 1000)
+			for i := 0; i < 999; i++ {
+				state.Delete(fmt.Sprintf("key%d", i))
+			}
+			So(state.Len(), ShouldEqual, 1)
+			So(state.root.children, ShouldBeNil)
+			So(valueOf(state, "key999").Val, ShouldEqual, "999")
+
+			state.Delete("key999")
+			So(state.root, ShouldBeNil)
+		})
+
+		Convey("shares its keys with snapshots", func() {
+			snapshot := state.Snapshot()
+			So(state.Changed(), ShouldBeEmpty)
+
+			snapshot.Set("key1", &Value{Val: "x"})
+			snapshot.Delete("key2")
+			v, _ := snapshot.Mutable("key3")
+			v.UpdateVal("y")
+			So(snapshot.Changed(), ShouldHaveLength, 3)
+
+			So(valueOf(state, "key1").Val, ShouldEqual, "1")
+			So(valueOf(state, "key2").Val, ShouldEqual, "2")
+			So(valueOf(state, "key3").Val, ShouldEqual, "3")
+			So(valueOf(snapshot, "key4"), ShouldEqual, valueOf(state, "key4"))
+			So(snapshot.Len(), ShouldEqual, 999)
+		})
+	})
+
+	Convey("The state of a block", t, func() {
+		genesis, err := NewGenesisBlock()
+		So(err, ShouldBeNil)
+		account, err := NewAccount()
+		So(err, ShouldBeNil)
+		start := genesis.Header.Time.Add(time.Hour)
+		parent, err := newTimedBlock(genesis, start, account,
+			NewCommand(SET, "counter", "1"),
+			NewCommand(RPUSH, "list", "a", "b"),
+			NewCommand(HSET, "hash", "f", "v"),
+			NewCommand(SET, "other", "1"))
+		So(err, ShouldBeNil)
+
+		Convey("is not changed by its children", func() {
+			child, err := newTimedBlock(parent, start.Add(time.Second), account,
+				NewCommand(INCR, "counter"),
+				NewCommand(EXPIRE, "counter", "10"),
+				NewCommand(LSET, "list", "0", "z"),
+				NewCommand(RPUSH, "list", "c"),
+				NewCommand(HSET, "hash", "f", "w"))
+			So(err, ShouldBeNil)
+
+			So(valueOf(child.State, "counter").Val, ShouldEqual, "2")
+			So(valueOf(parent.State, "counter").Val, ShouldEqual, "1")
+			So(valueOf(parent.State, "counter").WillExpire, ShouldBeFalse)
+			So(valueOf(child.State, "list").Val, ShouldResemble, List{"z", "b", "c"})
+			So(valueOf(parent.State, "list").Val, ShouldResemble, List{"a", "b"})
+			So(valueOf(parent.State, "hash").Val, ShouldResemble, Hash{"f": "v"})
+
+			So(valueOf(child.State, "other"), ShouldEqual, valueOf(parent.State, "other"))
+			So(parent.VerifyState(), ShouldBeNil)
+		})
+	})
+}
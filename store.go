@@ -0,0 +1,467 @@
+// an append-only block store on disk
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	blockLogFile    = "blocks.log"
+	heightIndexFile = "heights"
+	headFile        = "HEAD"
+
+	// length and crc32 of the payload
+	recordHeaderSize = 8
+	maxRecordSize    = 64 * 1024 * 1024
+)
+
+var errBlockNotFound = errors.New("block not found")
+
+// BlockStore keeps every block in an append-only log keyed by its hash,
+// along with an index from height to the hash of the block on the main
+// chain and a pointer to the head of that chain.
+type BlockStore struct {
+	dir string
+
+	mu      sync.Mutex
+	log     *os.File
+	size    int64
+	offsets map[[32]byte]int64
+	prevs   map[[32]byte][32]byte
+	heights [][32]byte
+	head    [32]byte
+	hasHead bool
+}
+
+// the on-disk and on-wire form of a block
+type blockRecord struct {
+	Header       BlockHeader
+	Signature    []byte
+	Transactions []transactionRecord
+}
+
+type transactionRecord struct {
+	Header    TransactionHeader
+	Signature []byte
+}
+
+func encodeBlock(b *Block) ([]byte, error) {
+	record := blockRecord{
+		Header:       b.Header,
+		Signature:    b.signature,
+		Transactions: make([]transactionRecord, len(b.Transactions)),
+	}
+	for i, tx := range b.Transactions {
+		record.Transactions[i] = transactionRecord{tx.Header, tx.signature}
+	}
+
+	return json.Marshal(record)
+}
+
+func decodeBlock(data []byte) (*Block, error) {
+	var record blockRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, err
+	}
+
+	b := &Block{
+		Header:       record.Header,
+		signature:    record.Signature,
+		Transactions: make([]*Transaction, len(record.Transactions)),
+	}
+	for i, tx := range record.Transactions {
+		b.Transactions[i] = &Transaction{Header: tx.Header, signature: tx.Signature}
+	}
+
+	return b, nil
+}
+
+// OpenBlockStore opens or creates a store in dir. A record torn by a crash
+// in the middle of a write is truncated from the end of the log, any other
+// record which can't be read fails opening the store.
+func OpenBlockStore(dir string) (*BlockStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(filepath.Join(dir, blockLogFile), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &BlockStore{
+		dir:     dir,
+		log:     f,
+		offsets: make(map[[32]byte]int64),
+		prevs:   make(map[[32]byte][32]byte),
+	}
+	if err := s.scan(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := s.loadHead(); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// scan reads every record in the log. A record which is incomplete or fails
+// its checksum is truncated when it runs to the end of the log, as only the
+// last write may have been torn.
+func (s *BlockStore) scan() error {
+	info, err := s.log.Stat()
+	if err != nil {
+		return err
+	}
+	if _, err := s.log.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	r := bufio.NewReader(s.log)
+
+	var offset int64
+	for {
+		data, err := readRecord(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			torn, terr := s.tornRecord(offset, info.Size())
+			if terr != nil {
+				return terr
+			}
+			if !torn {
+				return fmt.Errorf("corrupted block log at offset %d: %v", offset, err)
+			}
+			if err := s.log.Truncate(offset); err != nil {
+				return err
+			}
+			break
+		}
+
+		b, err := decodeBlock(data)
+		if err != nil {
+			return err
+		}
+		hash, err := b.Hash()
+		if err != nil {
+			return err
+		}
+		s.offsets[hash] = offset
+		s.prevs[hash] = b.Header.Prev
+
+		offset += int64(recordHeaderSize + len(data))
+	}
+
+	s.size = offset
+	_, err = s.log.Seek(offset, io.SeekStart)
+	return err
+}
+
+// tornRecord reports whether the record at offset runs to the end of a log
+// of size bytes
+func (s *BlockStore) tornRecord(offset, size int64) (bool, error) {
+	var header [recordHeaderSize]byte
+	if _, err := s.log.ReadAt(header[:], offset); err == io.EOF {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+	length := int64(binary.BigEndian.Uint32(header[0:4]))
+	return offset+recordHeaderSize+length >= size, nil
+}
+
+func readRecord(r io.Reader) ([]byte, error) {
+	var header [recordHeaderSize]byte
+	n, err := io.ReadFull(r, header[:])
+	if err == io.EOF {
+		return nil, io.EOF
+	}
+	if err != nil {
+		return nil, fmt.Errorf("torn record header after %d bytes", n)
+	}
+
+	length := binary.BigEndian.Uint32(header[0:4])
+	if length > maxRecordSize {
+		return nil, errors.New("record too large")
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, errors.New("torn record")
+	}
+	if crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, errors.New("record checksum mismatch")
+	}
+
+	return data, nil
+}
+
+// loadHead reads the head pointer and the height index, rebuilding the
+// index from the blocks' Prev links if a crash left it out of date
+func (s *BlockStore) loadHead() error {
+	data, err := ioutil.ReadFile(filepath.Join(s.dir, headFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(data) != 32 {
+		return errors.New("corrupted head pointer")
+	}
+	copy(s.head[:], data)
+	s.hasHead = true
+
+	if _, ok := s.offsets[s.head]; !ok {
+		return fmt.Errorf("head block %s is missing from the log", readableHash(s.head))
+	}
+
+	index, err := ioutil.ReadFile(filepath.Join(s.dir, heightIndexFile))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(index) > 0 && len(index)%32 == 0 {
+		heights := make([][32]byte, len(index)/32)
+		for i := range heights {
+			copy(heights[i][:], index[i*32:])
+		}
+		if heights[len(heights)-1] == s.head {
+			s.heights = heights
+			return nil
+		}
+	}
+
+	return s.setHead(s.head)
+}
+
+// Put appends a block to the log. Blocks already in the store are ignored.
+func (s *BlockStore) Put(b *Block) error {
+	hash, err := b.Hash()
+	if err != nil {
+		return err
+	}
+	data, err := encodeBlock(b)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.offsets[hash]; ok {
+		return nil
+	}
+
+	record := make([]byte, recordHeaderSize+len(data))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(data)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(data))
+	copy(record[recordHeaderSize:], data)
+
+	if _, err := s.log.WriteAt(record, s.size); err != nil {
+		return err
+	}
+	if err := s.log.Sync(); err != nil {
+		return err
+	}
+
+	s.offsets[hash] = s.size
+	s.prevs[hash] = b.Header.Prev
+	s.size += int64(len(record))
+	return nil
+}
+
+func (s *BlockStore) Has(hash [32]byte) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, ok := s.offsets[hash]
+	return ok
+}
+
+// Get reads a block from the log. The Previous pointer and State of the
+// returned block are not set.
+func (s *BlockStore) Get(hash [32]byte) (*Block, error) {
+	s.mu.Lock()
+	offset, ok := s.offsets[hash]
+	s.mu.Unlock()
+	if !ok {
+		return nil, errBlockNotFound
+	}
+
+	data, err := readRecord(io.NewSectionReader(s.log, offset, maxRecordSize+recordHeaderSize))
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeBlock(data)
+}
+
+// SetHead points the head of the main chain to a stored block and rewrites
+// the height index to follow it
+func (s *BlockStore) SetHead(hash [32]byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.setHead(hash)
+}
+
+func (s *BlockStore) setHead(hash [32]byte) error {
+	if prev, ok := s.prevs[hash]; ok && s.hasHead && prev == s.head {
+		return s.extendHead(hash)
+	}
+
+	var heights [][32]byte
+	for cursor := hash; ; {
+		prev, ok := s.prevs[cursor]
+		if !ok {
+			return fmt.Errorf("block %s is missing from the log", readableHash(cursor))
+		}
+		heights = append(heights, cursor)
+		if prev == [32]byte{} {
+			break
+		}
+		cursor = prev
+	}
+	for i, j := 0, len(heights)-1; i < j; i, j = i+1, j-1 {
+		heights[i], heights[j] = heights[j], heights[i]
+	}
+
+	index := make([]byte, 0, 32*len(heights))
+	for _, h := range heights {
+		index = append(index, h[:]...)
+	}
+	if err := writeFileAtomic(filepath.Join(s.dir, heightIndexFile), index); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(filepath.Join(s.dir, headFile), hash[:]); err != nil {
+		return err
+	}
+
+	s.heights = heights
+	s.head = hash
+	s.hasHead = true
+	return nil
+}
+
+// extendHead moves the head to a child of the current head, appending to
+// the height index instead of rewriting it. loadHead rebuilds an index left
+// longer than the chain by a crash before the head pointer is written.
+func (s *BlockStore) extendHead(hash [32]byte) error {
+	f, err := os.OpenFile(filepath.Join(s.dir, heightIndexFile), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(hash[:]); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(filepath.Join(s.dir, headFile), hash[:]); err != nil {
+		return err
+	}
+
+	s.heights = append(s.heights, hash)
+	s.head = hash
+	return nil
+}
+
+// Head returns the hash of the head block, or false if no head is set
+func (s *BlockStore) Head() ([32]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.head, s.hasHead
+}
+
+// Height returns the height of the head block, or -1 for an empty store
+func (s *BlockStore) Height() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.heights) - 1
+}
+
+// HashAt returns the hash of the main chain block at the given height
+func (s *BlockStore) HashAt(height int) ([32]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if height < 0 || height >= len(s.heights) {
+		return [32]byte{}, errBlockNotFound
+	}
+	return s.heights[height], nil
+}
+
+// LoadChain reads the main chain from genesis to head, verifies each block
+// and rebuilds its state. The genesis block is trusted as is. It returns
+// nil if the store has no head.
+func (s *BlockStore) LoadChain() (*Block, error) {
+	s.mu.Lock()
+	heights := append([][32]byte{}, s.heights...)
+	s.mu.Unlock()
+
+	var previous *Block
+	for height, hash := range heights {
+		b, err := s.Get(hash)
+		if err != nil {
+			return nil, err
+		}
+		b.Previous = previous
+
+		// blocks keep the state they are verified with, the genesis block
+		// has nothing to check it against
+		if height > 0 {
+			if err := b.Verify(); err != nil {
+				return nil, fmt.Errorf("block %s at height %d: %s", readableHash(hash), height, err)
+			}
+		} else if err := b.UpdateState(); err != nil {
+			return nil, err
+		}
+
+		previous = b
+	}
+
+	return previous, nil
+}
+
+func (s *BlockStore) Close() error {
+	return s.log.Close()
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
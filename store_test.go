@@ -0,0 +1,169 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestBlockStore(t *testing.T) {
+	Convey("A block store", t, func() {
+		dir, err := ioutil.TempDir("", "bcdis-store")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		store, err := OpenBlockStore(dir)
+		So(err, ShouldBeNil)
+		defer func() { store.Close() }()
+
+		genesis, err := NewBlock(nil)
+		So(err, ShouldBeNil)
+		So(genesis.UpdateState(), ShouldBeNil)
+		genesisHash, err := genesis.Hash()
+		So(err, ShouldBeNil)
+
+		child, err := NewBlock(genesis)
+		So(err, ShouldBeNil)
+		for _, cmd := range []Command{NewCommand(SET, "foo", "bar"), NewCommand(INCR, "count")} {
+			tx, err := newTestTransaction(cmd)
+			So(err, ShouldBeNil)
+			child.Transactions = append(child.Transactions, tx)
+		}
+		So(child.HashTransactions(), ShouldBeNil)
+		So(child.UpdateState(), ShouldBeNil)
+		So(Work(child), ShouldBeNil)
+		childHash, err := child.Hash()
+		So(err, ShouldBeNil)
+
+		Convey("is empty when created", func() {
+			_, ok := store.Head()
+			So(ok, ShouldBeFalse)
+			So(store.Height(), ShouldEqual, -1)
+
+			head, err := store.LoadChain()
+			So(err, ShouldBeNil)
+			So(head, ShouldBeNil)
+		})
+
+		Convey("can store and read blocks by hash", func() {
+			So(store.Put(genesis), ShouldBeNil)
+			So(store.Put(child), ShouldBeNil)
+			So(store.Has(childHash), ShouldBeTrue)
+
+			b, err := store.Get(childHash)
+			So(err, ShouldBeNil)
+			hash, err := b.Hash()
+			So(err, ShouldBeNil)
+			So(hash, ShouldEqual, childHash)
+			So(len(b.Transactions), ShouldEqual, 2)
+
+			_, err = store.Get([32]byte{1})
+			So(err, ShouldEqual, errBlockNotFound)
+
+			Convey("and index them by height once the head is set", func() {
+				So(store.SetHead(childHash), ShouldBeNil)
+				So(store.Height(), ShouldEqual, 1)
+
+				hash, err := store.HashAt(0)
+				So(err, ShouldBeNil)
+				So(hash, ShouldEqual, genesisHash)
+				hash, err = store.HashAt(1)
+				So(err, ShouldBeNil)
+				So(hash, ShouldEqual, childHash)
+
+				Convey("and reload the verified chain after a restart", func() {
+					So(store.Close(), ShouldBeNil)
+					store, err = OpenBlockStore(dir)
+					So(err, ShouldBeNil)
+
+					head, ok := store.Head()
+					So(ok, ShouldBeTrue)
+					So(head, ShouldEqual, childHash)
+
+					b, err := store.LoadChain()
+					So(err, ShouldBeNil)
+					hash, err := b.Hash()
+					So(err, ShouldBeNil)
+					So(hash, ShouldEqual, childHash)
+					So(b.Previous, ShouldNotBeNil)
+					So(valueOf(b.State, "foo").Val, ShouldEqual, "bar")
+					So(valueOf(b.State, "count").Val, ShouldEqual, "1")
+				})
+
+				Convey("and rebuild a stale height index", func() {
+					So(store.Close(), ShouldBeNil)
+					So(ioutil.WriteFile(filepath.Join(dir, heightIndexFile), genesisHash[:], 0644), ShouldBeNil)
+
+					store, err = OpenBlockStore(dir)
+					So(err, ShouldBeNil)
+
+					So(store.Height(), ShouldEqual, 1)
+				})
+
+				Convey("and truncate a record torn by a crash", func() {
+					So(store.Close(), ShouldBeNil)
+
+					path := filepath.Join(dir, blockLogFile)
+					info, err := os.Stat(path)
+					So(err, ShouldBeNil)
+					f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+					So(err, ShouldBeNil)
+					_, err = f.Write([]byte{0, 0, 1, 0, 1, 2, 3, 4, '{'})
+					So(err, ShouldBeNil)
+					So(f.Close(), ShouldBeNil)
+
+					store, err = OpenBlockStore(dir)
+					So(err, ShouldBeNil)
+
+					truncated, err := os.Stat(path)
+					So(err, ShouldBeNil)
+					So(truncated.Size(), ShouldEqual, info.Size())
+
+					head, err := store.LoadChain()
+					So(err, ShouldBeNil)
+					So(valueOf(head.State, "foo").Val, ShouldEqual, "bar")
+				})
+
+				Convey("and refuse to truncate a corrupted record before the last one", func() {
+					So(store.Close(), ShouldBeNil)
+
+					path := filepath.Join(dir, blockLogFile)
+					info, err := os.Stat(path)
+					So(err, ShouldBeNil)
+					f, err := os.OpenFile(path, os.O_WRONLY, 0644)
+					So(err, ShouldBeNil)
+					// the checksum of the first record
+					_, err = f.WriteAt([]byte{0, 0, 0, 0}, 4)
+					So(err, ShouldBeNil)
+					So(f.Close(), ShouldBeNil)
+
+					_, err = OpenBlockStore(dir)
+					So(err, ShouldNotBeNil)
+
+					kept, err := os.Stat(path)
+					So(err, ShouldBeNil)
+					So(kept.Size(), ShouldEqual, info.Size())
+				})
+			})
+		})
+
+		Convey("refuses to load a chain with an invalid block", func() {
+			child.Header.Nonce++
+			for reached, _ := reachThreshold(child); reached; reached, _ = reachThreshold(child) {
+				child.Header.Nonce++
+			}
+			childHash, err := child.Hash()
+			So(err, ShouldBeNil)
+
+			So(store.Put(genesis), ShouldBeNil)
+			So(store.Put(child), ShouldBeNil)
+			So(store.SetHead(childHash), ShouldBeNil)
+
+			_, err = store.LoadChain()
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
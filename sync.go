@@ -0,0 +1,492 @@
+// downloading the chain from peers
+//
+// A node behind its peers first asks the best of them for the headers
+// following its chain with getheaders. Headers are checked to link to each
+// other and to carry enough proof of work, which is cheap, before any block
+// is downloaded. The blocks are then requested from every peer having them
+// in parallel and applied in chain order as they arrive. Blocks applied are
+// persisted by the node's store, so a restarted node carries on from where
+// it stopped.
+package main
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	maxHeadersPerMessage = 2000
+	maxLocatorHashes     = 64
+
+	// blocks requested from a single peer at once, and blocks requested
+	// ahead of the one to be applied next
+	maxBlocksInFlight   = 16
+	blockDownloadWindow = 1024
+
+	syncRequestTimeout   = 10 * time.Second
+	syncInterval         = 100 * time.Millisecond
+	syncProgressInterval = 10 * time.Second
+)
+
+type getHeadersMessage struct {
+	// hashes of the requester's chain from its tip back to genesis, the
+	// first one known to the receiver is where the headers start from
+	Locator [][32]byte
+}
+
+type headersMessage struct {
+	Headers []BlockHeader
+}
+
+type blockRequest struct {
+	peer *Peer
+	sent time.Time
+}
+
+type downloadedBlock struct {
+	block *Block
+	from  *Peer
+}
+
+// syncer tracks the headers of blocks to download and the blocks requested
+// from each peer
+type syncer struct {
+	node *Node
+	once sync.Once
+
+	mu          sync.Mutex
+	headerPeer  *Peer
+	headerSent  time.Time
+	base        int        // height of the block the queued headers build on
+	hashes      [][32]byte // headers of blocks to download, in chain order
+	last        BlockHeader
+	queued      map[[32]byte]bool
+	requests    map[[32]byte]*blockRequest
+	received    map[[32]byte]downloadedBlock
+	unavailable map[[32]byte]map[*Peer]bool
+
+	// blocks are applied by one goroutine at a time
+	applying sync.Mutex
+}
+
+func newSyncer(node *Node) *syncer {
+	s := &syncer{node: node}
+	s.reset()
+	return s
+}
+
+// reset drops every header and block being downloaded, s.mu must be held
+func (s *syncer) reset() {
+	s.headerPeer = nil
+	s.clearQueue()
+}
+
+// clearQueue drops the headers queued and the blocks downloaded for them,
+// s.mu must be held
+func (s *syncer) clearQueue() {
+	s.hashes = nil
+	s.queued = make(map[[32]byte]bool)
+	s.requests = make(map[[32]byte]*blockRequest)
+	s.received = make(map[[32]byte]downloadedBlock)
+	s.unavailable = make(map[[32]byte]map[*Peer]bool)
+}
+
+// start runs the sync loop once the node has its first peer
+func (s *syncer) start() {
+	s.once.Do(func() { go s.run() })
+}
+
+func (s *syncer) run() {
+	ticker := time.NewTicker(syncInterval)
+	defer ticker.Stop()
+
+	logged := time.Now()
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.node.quit:
+			return
+		}
+
+		s.tick()
+		if time.Since(logged) >= syncProgressInterval {
+			if height, target := s.node.SyncProgress(); height < target {
+				log.Printf("synchronizing: height %d of %d", height, target)
+			}
+			logged = time.Now()
+		}
+	}
+}
+
+// tipHeight returns the height of the last queued header, or the height of
+// the node when nothing is queued. s.mu must be held.
+func (s *syncer) tipHeight(height int) int {
+	if len(s.hashes) == 0 {
+		return height
+	}
+	return s.base + len(s.hashes)
+}
+
+// tick asks for more headers when a peer is ahead of what we know, gives up
+// on requests left unanswered, and requests blocks from idle peers
+func (s *syncer) tick() {
+	height := s.node.Height()
+	peers := s.node.Peers()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.headerPeer != nil && (s.headerPeer.isClosed() || time.Since(s.headerSent) > syncRequestTimeout) {
+		s.headerPeer = nil
+	}
+	if s.headerPeer == nil {
+		var best *Peer
+		for _, p := range peers {
+			if p.Height() > s.tipHeight(height) && (best == nil || p.Height() > best.Height()) {
+				best = p
+			}
+		}
+		if best != nil {
+			s.requestHeaders(best)
+		}
+	}
+
+	for hash, req := range s.requests {
+		if req.peer.isClosed() || time.Since(req.sent) > syncRequestTimeout {
+			s.markUnavailable(hash, req.peer)
+			delete(s.requests, hash)
+		}
+	}
+	s.requestBlocks(peers)
+}
+
+// requestHeadersFrom asks a peer for headers unless another peer is
+// already being asked
+func (s *syncer) requestHeadersFrom(p *Peer) {
+	s.start()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.headerPeer == nil {
+		s.requestHeaders(p)
+	}
+}
+
+// requestHeaders asks a peer for the headers following the last one we
+// know, s.mu must be held
+func (s *syncer) requestHeaders(p *Peer) {
+	locator := s.node.locator()
+	if len(s.hashes) > 0 {
+		locator = append([][32]byte{s.hashes[len(s.hashes)-1]}, locator...)
+	}
+
+	s.headerPeer = p
+	s.headerSent = time.Now()
+	p.Send(msgGetHeaders, getHeadersMessage{locator})
+}
+
+// receiveHeaders queues the headers following the last one we know. When
+// they build on another branch than the queued headers, that branch is
+// downloaded instead. Headers which don't link to each other, change the
+// target when they shouldn't or lack proof of work are invalid.
+func (s *syncer) receiveHeaders(p *Peer, headers []BlockHeader) error {
+	if len(headers) > maxHeadersPerMessage {
+		return errors.New("too many headers")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if p != s.headerPeer {
+		return nil
+	}
+	s.headerPeer = nil
+
+	head := s.node.Head()
+	if head == nil {
+		return errors.New("node has no genesis block")
+	}
+	tip, err := head.Hash()
+	if err != nil {
+		return err
+	}
+	height := s.tipHeight(s.node.Height())
+	parent := head.Header
+	if len(s.hashes) > 0 {
+		tip = s.hashes[len(s.hashes)-1]
+		parent = s.last
+	}
+
+	linked := false
+	for i := range headers {
+		header := &headers[i]
+		hash, err := header.Hash()
+		if err != nil {
+			return err
+		}
+		if _, ok := s.node.Block(hash); ok || s.queued[hash] {
+			continue
+		}
+		if header.Prev != tip {
+			if linked {
+				return invalidBlockError{errors.New("headers are not linked")}
+			}
+			b, ok := s.node.Block(header.Prev)
+			if !ok {
+				// nothing to build the headers on, stop asking the peer
+				p.setHeight(height, tip)
+				return nil
+			}
+			s.clearQueue()
+			tip, parent = header.Prev, b.Header
+			height, _ = s.node.blockHeight(header.Prev)
+		}
+		if err := checkHeaderBits(header, &parent, height+1); err != nil {
+			return invalidBlockError{err}
+		}
+		reached, err := reachThreshold(header)
+		if err != nil {
+			return err
+		}
+		if !reached {
+			return invalidBlockError{errors.New("Invalid Proof of Work")}
+		}
+
+		linked = true
+		if len(s.hashes) == 0 {
+			s.base = height
+		}
+		s.hashes = append(s.hashes, hash)
+		s.queued[hash] = true
+		s.last = *header
+		tip, parent = hash, *header
+		height++
+	}
+	p.setHeight(height, tip)
+
+	if len(headers) == maxHeadersPerMessage {
+		s.requestHeaders(p)
+	}
+	s.requestBlocks(s.node.Peers())
+	return nil
+}
+
+// requestBlocks spreads the blocks not requested yet over the peers having
+// them, s.mu must be held
+func (s *syncer) requestBlocks(peers []*Peer) {
+	inFlight := make(map[*Peer]int)
+	for _, req := range s.requests {
+		inFlight[req.peer]++
+	}
+
+	batches := make(map[*Peer][]invItem)
+	window := s.hashes
+	if len(window) > blockDownloadWindow {
+		window = window[:blockDownloadWindow]
+	}
+	for i, hash := range window {
+		if _, ok := s.requests[hash]; ok {
+			continue
+		}
+		if _, ok := s.received[hash]; ok {
+			continue
+		}
+
+		var idlest *Peer
+		tried, available := 0, 0
+		for _, p := range peers {
+			if p.isClosed() || p.Height() < s.base+i+1 {
+				continue
+			}
+			if s.unavailable[hash][p] {
+				tried++
+				continue
+			}
+			available++
+			if inFlight[p] < maxBlocksInFlight && (idlest == nil || inFlight[p] < inFlight[idlest]) {
+				idlest = p
+			}
+		}
+		if idlest == nil {
+			// every peer failed to deliver the block, try them again later
+			if tried > 0 && available == 0 {
+				delete(s.unavailable, hash)
+			}
+			continue
+		}
+
+		s.requests[hash] = &blockRequest{idlest, time.Now()}
+		inFlight[idlest]++
+		batches[idlest] = append(batches[idlest], invItem{invBlock, hash})
+	}
+
+	for p, items := range batches {
+		p.Send(msgGetData, invMessage{items})
+	}
+}
+
+// markUnavailable avoids asking a peer for a block again, s.mu must be held
+func (s *syncer) markUnavailable(hash [32]byte, p *Peer) {
+	if s.unavailable[hash] == nil {
+		s.unavailable[hash] = make(map[*Peer]bool)
+	}
+	s.unavailable[hash][p] = true
+}
+
+// notFound gives up on blocks a peer doesn't have, so they are requested
+// from someone else
+func (s *syncer) notFound(p *Peer, items []invItem) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, item := range items {
+		if item.Type != invBlock || !s.queued[item.Hash] {
+			continue
+		}
+		s.markUnavailable(item.Hash, p)
+		if req, ok := s.requests[item.Hash]; ok && req.peer == p {
+			delete(s.requests, item.Hash)
+		}
+	}
+}
+
+// receiveBlock takes a block being downloaded, applies every block which is
+// next in line and requests more. It reports whether the block was being
+// downloaded.
+func (s *syncer) receiveBlock(p *Peer, b *Block, hash [32]byte) bool {
+	s.mu.Lock()
+	if !s.queued[hash] {
+		s.mu.Unlock()
+		return false
+	}
+	delete(s.requests, hash)
+	if _, ok := s.received[hash]; !ok {
+		s.received[hash] = downloadedBlock{b, p}
+	}
+	s.mu.Unlock()
+
+	s.apply()
+
+	s.mu.Lock()
+	s.requestBlocks(s.node.Peers())
+	s.mu.Unlock()
+	return true
+}
+
+func (s *syncer) apply() {
+	s.applying.Lock()
+	defer s.applying.Unlock()
+
+	for {
+		s.mu.Lock()
+		if len(s.hashes) == 0 {
+			s.mu.Unlock()
+			return
+		}
+		hash := s.hashes[0]
+		next, ok := s.received[hash]
+		s.mu.Unlock()
+		if !ok {
+			return
+		}
+
+		err := s.node.AddBlock(next.block)
+
+		s.mu.Lock()
+		if err != nil {
+			// the blocks queued after this one can't be applied either
+			log.Printf("failed to apply block %s: %s", readableHash(hash), err)
+			s.reset()
+			s.mu.Unlock()
+			if _, ok := err.(invalidBlockError); ok {
+				s.node.ban(next.from)
+			}
+			return
+		}
+		s.hashes = s.hashes[1:]
+		s.base++
+		delete(s.queued, hash)
+		delete(s.received, hash)
+		delete(s.unavailable, hash)
+		s.mu.Unlock()
+	}
+}
+
+// SyncProgress returns the height of the node and the height of the best
+// chain it knows of from its peers
+func (n *Node) SyncProgress() (height, target int) {
+	height = n.Height()
+	peers := n.Peers()
+
+	n.sync.mu.Lock()
+	target = n.sync.tipHeight(height)
+	n.sync.mu.Unlock()
+	if target < height {
+		target = height
+	}
+
+	for _, p := range peers {
+		if p.Height() > target {
+			target = p.Height()
+		}
+	}
+	return height, target
+}
+
+// blockHeight returns the height of a known block on any branch
+func (n *Node) blockHeight(hash [32]byte) (int, bool) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	entry, ok := n.blocks[hash]
+	if !ok {
+		return 0, false
+	}
+	return entry.height, true
+}
+
+// locator lists hashes of the main chain from the head back to genesis,
+// one by one near the head and exponentially sparser further back
+func (n *Node) locator() [][32]byte {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	locator := make([][32]byte, 0, maxLocatorHashes)
+	step := 1
+	for height := len(n.hashes) - 1; height > 0 && len(locator) < maxLocatorHashes-1; height -= step {
+		locator = append(locator, n.hashes[height])
+		if len(locator) >= 10 {
+			step *= 2
+		}
+	}
+	return append(locator, n.genesis)
+}
+
+// headersAfter returns the headers of the main chain following the first
+// locator hash on it
+func (n *Node) headersAfter(locator [][32]byte) []BlockHeader {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	for _, hash := range locator {
+		entry, ok := n.blocks[hash]
+		if !ok || entry.height >= len(n.hashes) || n.hashes[entry.height] != hash {
+			continue
+		}
+		height := entry.height
+
+		end := height + 1 + maxHeadersPerMessage
+		if end > len(n.hashes) {
+			end = len(n.hashes)
+		}
+		headers := make([]BlockHeader, 0, end-height-1)
+		for _, h := range n.hashes[height+1 : end] {
+			headers = append(headers, n.blocks[h].block.Header)
+		}
+		return headers
+	}
+	return []BlockHeader{}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// the account writing the heights of test chains
+var chainAccount, _ = NewAccount()
+
+// mineChain works length blocks on top of head, each setting a key to its
+// height. Blocks are timed BlockWork.BlockTime apart to keep the target.
+func mineChain(head *Block, length int) (*Block, error) {
+	height := -1
+	for b := head; b != nil; b = b.Previous {
+		height++
+	}
+	address, err := chainAccount.Address()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := 1; i <= length; i++ {
+		sequence := accountSequence(head.State, string(address))
+		tx, err := newTestTransactionFrom(chainAccount, sequence, NewCommand(SET, "height", fmt.Sprint(height+i)))
+		if err != nil {
+			return nil, err
+		}
+		b, err := NewBlock(head)
+		if err != nil {
+			return nil, err
+		}
+		b.Header.Time = head.Header.Time.Add(BlockWork.BlockTime)
+		b.Transactions = []*Transaction{tx}
+		if err := b.HashTransactions(); err != nil {
+			return nil, err
+		}
+		if err := b.UpdateState(); err != nil {
+			return nil, err
+		}
+		if err := Work(b); err != nil {
+			return nil, err
+		}
+		head = b
+	}
+	return head, nil
+}
+
+// mineEmptyChain works length blocks without transactions, which are
+// cheaper to apply
+func mineEmptyChain(head *Block, length int) (*Block, error) {
+	for i := 0; i < length; i++ {
+		b, err := NewBlock(head)
+		if err != nil {
+			return nil, err
+		}
+		b.Header.Time = head.Header.Time.Add(BlockWork.BlockTime)
+		if err := b.UpdateState(); err != nil {
+			return nil, err
+		}
+		if err := Work(b); err != nil {
+			return nil, err
+		}
+		head = b
+	}
+	return head, nil
+}
+
+func TestSync(t *testing.T) {
+	Convey("A fresh node", t, func() {
+		genesis, err := NewGenesisBlock()
+		So(err, ShouldBeNil)
+		node, err := NewNode(genesis)
+		So(err, ShouldBeNil)
+		defer node.Close()
+
+		Convey("ignores locator hashes of side branches taller than its chain", func() {
+			tall, err := mineEmptyChain(genesis, 3)
+			So(err, ShouldBeNil)
+			hash, err := tall.Hash()
+			So(err, ShouldBeNil)
+			node.mu.Lock()
+			node.blocks[hash] = &chainEntry{block: tall, height: 3, work: blockWork(tall)}
+			node.mu.Unlock()
+
+			So(node.headersAfter([][32]byte{hash}), ShouldBeEmpty)
+			So(node.headersAfter([][32]byte{hash, node.genesis}), ShouldBeEmpty)
+		})
+
+		Convey("downloads the chain from every peer having it", func() {
+			head, err := mineChain(genesis, 50)
+			So(err, ShouldBeNil)
+			var peers []*Node
+			for i := 0; i < 3; i++ {
+				peer, err := NewNode(head)
+				So(err, ShouldBeNil)
+				So(peer.Listen("127.0.0.1:0"), ShouldBeNil)
+				peers = append(peers, peer)
+			}
+			defer closeTestNodes(peers)
+
+			for _, peer := range peers {
+				_, err := node.Connect(peer.ListenAddr())
+				So(err, ShouldBeNil)
+			}
+
+			So(eventually(10*time.Second, func() bool { return node.Height() == 50 }), ShouldBeTrue)
+			So(valueOf(node.State(), "height").Val, ShouldEqual, "50")
+			So(node.Head().Header.StateRoot, ShouldEqual, head.Header.StateRoot)
+
+			height, target := node.SyncProgress()
+			So(height, ShouldEqual, 50)
+			So(target, ShouldEqual, 50)
+		})
+
+		Convey("downloads headers in several batches", func() {
+			head, err := mineEmptyChain(genesis, maxHeadersPerMessage+10)
+			So(err, ShouldBeNil)
+			peers, err := startTestNodes(head, 1)
+			So(err, ShouldBeNil)
+			defer closeTestNodes(peers)
+
+			_, err = node.Connect(peers[0].ListenAddr())
+			So(err, ShouldBeNil)
+
+			So(eventually(30*time.Second, func() bool { return node.Height() == maxHeadersPerMessage+10 }), ShouldBeTrue)
+		})
+
+		Convey("reports progress towards the height of its peers", func() {
+			head, err := mineChain(genesis, 5)
+			So(err, ShouldBeNil)
+			peers, err := startTestNodes(head, 1)
+			So(err, ShouldBeNil)
+			defer closeTestNodes(peers)
+
+			height, target := node.SyncProgress()
+			So(height, ShouldEqual, 0)
+			So(target, ShouldEqual, 0)
+
+			_, err = node.Connect(peers[0].ListenAddr())
+			So(err, ShouldBeNil)
+
+			So(eventually(5*time.Second, func() bool {
+				height, target := node.SyncProgress()
+				return height == 5 && target == 5
+			}), ShouldBeTrue)
+		})
+
+		Convey("bans peers sending headers without proof of work", func() {
+			So(node.Listen("127.0.0.1:0"), ShouldBeNil)
+			conn, err := net.Dial("tcp", node.ListenAddr())
+			So(err, ShouldBeNil)
+			defer conn.Close()
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+			version := node.versionMessage()
+			version.ID++
+			version.Height = 1
+			msg, err := newMessage(msgVersion, version)
+			So(err, ShouldBeNil)
+			So(writeMessage(conn, msg), ShouldBeNil)
+			msg, err = newMessage(msgVerack, struct{}{})
+			So(err, ShouldBeNil)
+			So(writeMessage(conn, msg), ShouldBeNil)
+
+			for msg.Type != msgGetHeaders {
+				msg, err = readMessage(conn)
+				So(err, ShouldBeNil)
+			}
+
+			header := BlockHeader{Prev: version.Head, Time: genesisTime, Bits: BlockWork.InitialBits}
+			for reached, _ := reachThreshold(&header); reached; reached, _ = reachThreshold(&header) {
+				header.NextTry()
+			}
+			msg, err = newMessage(msgHeaders, headersMessage{[]BlockHeader{header}})
+			So(err, ShouldBeNil)
+			So(writeMessage(conn, msg), ShouldBeNil)
+
+			for err == nil {
+				_, err = readMessage(conn)
+			}
+			So(eventually(time.Second, func() bool { return len(node.Peers()) == 0 }), ShouldBeTrue)
+			So(node.Height(), ShouldEqual, 0)
+		})
+	})
+
+	Convey("Nodes on competing branches", t, func() {
+		genesis, err := NewGenesisBlock()
+		So(err, ShouldBeNil)
+		light, err := mineChain(genesis, 3)
+		So(err, ShouldBeNil)
+		heavy, err := mineChain(genesis, 5)
+		So(err, ShouldBeNil)
+
+		nodes, err := startTestNodes(light, 1)
+		So(err, ShouldBeNil)
+		defer closeTestNodes(nodes)
+		other, err := startTestNodes(heavy, 1)
+		So(err, ShouldBeNil)
+		defer closeTestNodes(other)
+		nodes = append(nodes, other...)
+
+		Convey("converge on the heavier one", func() {
+			_, err := nodes[0].Connect(nodes[1].ListenAddr())
+			So(err, ShouldBeNil)
+
+			So(eventually(5*time.Second, func() bool { return nodes[0].Height() == 5 }), ShouldBeTrue)
+			head, err := nodes[0].Head().Hash()
+			So(err, ShouldBeNil)
+			heavyHash, err := heavy.Hash()
+			So(err, ShouldBeNil)
+			So(head, ShouldEqual, heavyHash)
+			So(valueOf(nodes[0].State(), "height").Val, ShouldEqual, "5")
+
+			Convey("and follow it as it grows", func() {
+				b, err := mineBlock(nodes[1])
+				So(err, ShouldBeNil)
+				So(nodes[1].AddBlock(b), ShouldBeNil)
+
+				So(eventually(5*time.Second, func() bool { return nodes[0].Height() == 6 }), ShouldBeTrue)
+				head, err := nodes[0].Head().Hash()
+				So(err, ShouldBeNil)
+				hash, err := b.Hash()
+				So(err, ShouldBeNil)
+				So(head, ShouldEqual, hash)
+			})
+		})
+	})
+
+	Convey("A node persisting its chain", t, func() {
+		dir, err := ioutil.TempDir("", "bcdis-sync")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		genesis, err := NewGenesisBlock()
+		So(err, ShouldBeNil)
+		middle, err := mineChain(genesis, 10)
+		So(err, ShouldBeNil)
+		head, err := mineChain(middle, 10)
+		So(err, ShouldBeNil)
+
+		store, err := OpenBlockStore(dir)
+		So(err, ShouldBeNil)
+		loaded, err := loadOrCreateChain(store)
+		So(err, ShouldBeNil)
+		node, err := NewNode(loaded)
+		So(err, ShouldBeNil)
+		node.SetStore(store)
+
+		peers, err := startTestNodes(middle, 1)
+		So(err, ShouldBeNil)
+		defer closeTestNodes(peers)
+		_, err = node.Connect(peers[0].ListenAddr())
+		So(err, ShouldBeNil)
+		So(eventually(5*time.Second, func() bool { return node.Height() == 10 }), ShouldBeTrue)
+
+		Convey("resumes synchronizing after a restart", func() {
+			node.Close()
+			So(store.Close(), ShouldBeNil)
+
+			store, err := OpenBlockStore(dir)
+			So(err, ShouldBeNil)
+			defer store.Close()
+			So(store.Height(), ShouldEqual, 10)
+			loaded, err := loadOrCreateChain(store)
+			So(err, ShouldBeNil)
+			node, err := NewNode(loaded)
+			So(err, ShouldBeNil)
+			defer node.Close()
+			node.SetStore(store)
+			So(node.Height(), ShouldEqual, 10)
+
+			peers, err := startTestNodes(head, 1)
+			So(err, ShouldBeNil)
+			defer closeTestNodes(peers)
+			_, err = node.Connect(peers[0].ListenAddr())
+			So(err, ShouldBeNil)
+
+			So(eventually(5*time.Second, func() bool { return node.Height() == 20 }), ShouldBeTrue)
+			So(valueOf(node.State(), "height").Val, ShouldEqual, "20")
+			So(store.Height(), ShouldEqual, 20)
+		})
+	})
+}
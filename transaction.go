@@ -4,6 +4,7 @@ import (
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"math/big"
 	"time"
 
@@ -16,15 +17,25 @@ type Transaction struct {
 }
 
 type TransactionHeader struct {
-	From  string
-	To    string
-	What  string
-	Time  time.Time
-	Nonce uint64
+	From string
+	// serialized public key of the sender, whose address must be From
+	PublicKey []byte
+	// number of transactions applied from From before this one
+	Sequence uint64
+	To       string
+	What     string
+	Time     time.Time
+	Nonce    uint64
 }
 
 func (t *Transaction) Hash() ([32]byte, error) {
-	data, err := json.Marshal(t.Header)
+	return t.HashWithNonce(t.Header.Nonce)
+}
+
+func (t *Transaction) HashWithNonce(nonce uint64) ([32]byte, error) {
+	header := t.Header
+	header.Nonce = nonce
+	data, err := json.Marshal(header)
 	if err != nil {
 		return [32]byte{}, err
 	}
@@ -47,6 +58,14 @@ func (t *Transaction) NextTry() {
 	t.Header.Nonce++
 }
 
+func (t *Transaction) SetNonce(nonce uint64) {
+	t.Header.Nonce = nonce
+}
+
+func (t *Transaction) Target() *big.Int {
+	return TransactionWork.Target(len(t.Header.What))
+}
+
 func (t *Transaction) SignWith(signature []byte) error {
 	t.signature = []byte(base64.StdEncoding.EncodeToString(signature))
 	return nil
@@ -61,12 +80,34 @@ func (t *Transaction) Signature() ([]byte, error) {
 	return signature, nil
 }
 
+// VerifySignature checks the transaction is signed with the public key it
+// carries, and that the key is the key of its sender
+func (t *Transaction) VerifySignature() error {
+	if len(t.Header.PublicKey) == 0 {
+		return errors.New("transaction without a public key")
+	}
+	if string(addressOf(t.Header.PublicKey)) != t.Header.From {
+		return errors.New("public key is not the key of the sender")
+	}
+	key, err := parsePublicKey(t.Header.PublicKey)
+	if err != nil {
+		return err
+	}
+
+	return verifyWithKey(t, key)
+}
+
+// Command decodes the command of a transaction, refusing the ones the
+// server would not have parsed
 func (t *Transaction) Command() (Command, error) {
 	var cmd Command
 	err := json.Unmarshal([]byte(t.Header.What), &cmd)
 	if err != nil {
 		return Command{}, err
 	}
+	if err := cmd.validate(); err != nil {
+		return Command{}, err
+	}
 	cmd.TX = t
 
 	return cmd, nil
@@ -91,3 +132,23 @@ func NewTransactionFromCommand(from string, command Command) (*Transaction, erro
 
 	return NewTransaction(from, command.Key, string(payload)), nil
 }
+
+// NewAccountTransaction creates a transaction sent from an account, which
+// must sign it once it is worked
+func NewAccountTransaction(account *Account, command Command) (*Transaction, error) {
+	address, err := account.Address()
+	if err != nil {
+		return nil, err
+	}
+	publicKey, err := account.PublicKeyBytes()
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := NewTransactionFromCommand(string(address), command)
+	if err != nil {
+		return nil, err
+	}
+	tx.Header.PublicKey = publicKey
+	return tx, nil
+}
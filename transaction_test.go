@@ -1,6 +1,8 @@
 package main
 
 import (
+	"math/big"
+	"strings"
 	"testing"
 
 	. "github.com/smartystreets/goconvey/convey"
@@ -32,6 +34,24 @@ func TestTransaction(t *testing.T) {
 
 				So(err, ShouldBeNil)
 			})
+
+			Convey("needs less work than a block", func() {
+				So(t.Target().Cmp(BlockWork.MaxTarget()), ShouldBeGreaterThan, 0)
+			})
+
+			Convey("needs more work for a larger command", func() {
+				policy := TransactionWork
+				So(t.Target(), ShouldResemble, compactToBig(policy.Bits))
+
+				large := NewTransaction("alice", "bob", strings.Repeat("x", policy.FreeBytes+1))
+				So(large.Target(), ShouldResemble, new(big.Int).Rsh(compactToBig(policy.Bits), 1))
+
+				larger := NewTransaction("alice", "bob", strings.Repeat("x", policy.FreeBytes+policy.BytesPerDoubling+1))
+				So(larger.Target(), ShouldResemble, new(big.Int).Rsh(compactToBig(policy.Bits), 2))
+
+				huge := NewTransaction("alice", "bob", strings.Repeat("x", policy.FreeBytes+100*policy.BytesPerDoubling))
+				So(huge.Target(), ShouldResemble, new(big.Int).Rsh(compactToBig(policy.Bits), uint(policy.MaxDoublings)))
+			})
 		})
 
 		Convey("is signable", func() {
@@ -75,4 +95,43 @@ func TestTransaction(t *testing.T) {
 		})
 
 	})
+
+	Convey("A transaction from an account", t, func() {
+		account, err := NewAccount()
+		So(err, ShouldBeNil)
+		address, err := account.Address()
+		So(err, ShouldBeNil)
+		tx, err := NewAccountTransaction(account, NewCommand(SET, "foo", "bar"))
+		So(err, ShouldBeNil)
+		So(tx.Header.From, ShouldEqual, string(address))
+		So(Sign(tx, account), ShouldBeNil)
+
+		Convey("is verified with the public key it carries", func() {
+			So(tx.VerifySignature(), ShouldBeNil)
+		})
+
+		Convey("fails to verify once changed", func() {
+			tx.Header.What = "changed"
+			So(tx.VerifySignature(), ShouldNotBeNil)
+		})
+
+		Convey("fails to verify without a public key", func() {
+			tx.Header.PublicKey = nil
+			So(tx.VerifySignature(), ShouldNotBeNil)
+		})
+
+		Convey("fails to verify when signed by another account", func() {
+			other, err := NewAccount()
+			So(err, ShouldBeNil)
+			So(Sign(tx, other), ShouldBeNil)
+			So(tx.VerifySignature(), ShouldNotBeNil)
+
+			Convey("even carrying its key", func() {
+				tx.Header.PublicKey, err = other.PublicKeyBytes()
+				So(err, ShouldBeNil)
+				So(Sign(tx, other), ShouldBeNil)
+				So(tx.VerifySignature(), ShouldNotBeNil)
+			})
+		})
+	})
 }
@@ -0,0 +1,465 @@
+// a Merkle Patricia trie used to commit states into block headers
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	trieLeafType byte = iota
+	trieExtensionType
+	trieBranchType
+)
+
+// root hash of a trie without any key
+var emptyTrieRoot = sha256.Sum256(nil)
+
+// Trie is an immutable Merkle Patricia trie over hex nibbles of the keys.
+// Put and Delete return a new trie which shares all unchanged nodes with
+// the original one, so older versions stay valid and cheap to keep.
+type Trie struct {
+	root trieNode
+}
+
+// nodes are never modified after creation, so their hash is computed once
+type trieNode interface {
+	hash() [32]byte
+	encode() []byte
+}
+
+type trieLeaf struct {
+	path  []byte
+	value []byte
+	h     [32]byte
+}
+
+type trieExtension struct {
+	path  []byte
+	child trieNode
+	h     [32]byte
+}
+
+type trieBranch struct {
+	children [16]trieNode
+	value    []byte
+	hasValue bool
+	h        [32]byte
+}
+
+func (n *trieLeaf) hash() [32]byte      { return n.h }
+func (n *trieExtension) hash() [32]byte { return n.h }
+func (n *trieBranch) hash() [32]byte    { return n.h }
+
+func (n *trieLeaf) encode() []byte {
+	buf := []byte{trieLeafType}
+	buf = appendBytes(buf, n.path)
+	return appendBytes(buf, n.value)
+}
+
+func (n *trieExtension) encode() []byte {
+	buf := []byte{trieExtensionType}
+	buf = appendBytes(buf, n.path)
+	h := n.child.hash()
+	return append(buf, h[:]...)
+}
+
+func (n *trieBranch) encode() []byte {
+	buf := []byte{trieBranchType}
+	for _, child := range n.children {
+		var h [32]byte
+		if child != nil {
+			h = child.hash()
+		}
+		buf = append(buf, h[:]...)
+	}
+	if !n.hasValue {
+		return append(buf, 0)
+	}
+	buf = append(buf, 1)
+	return appendBytes(buf, n.value)
+}
+
+func newTrieLeaf(path, value []byte) *trieLeaf {
+	n := &trieLeaf{path: path, value: value}
+	n.h = sha256.Sum256(n.encode())
+	return n
+}
+
+func newTrieExtension(path []byte, child trieNode) *trieExtension {
+	n := &trieExtension{path: path, child: child}
+	n.h = sha256.Sum256(n.encode())
+	return n
+}
+
+func newTrieBranch(children [16]trieNode, value []byte, hasValue bool) *trieBranch {
+	n := &trieBranch{children: children, value: value, hasValue: hasValue}
+	n.h = sha256.Sum256(n.encode())
+	return n
+}
+
+func NewTrie() *Trie {
+	return &Trie{}
+}
+
+// Hash returns the root hash committing to every key and value in the trie
+func (t *Trie) Hash() [32]byte {
+	if t.root == nil {
+		return emptyTrieRoot
+	}
+	return t.root.hash()
+}
+
+func (t *Trie) Get(key []byte) ([]byte, bool) {
+	n := t.root
+	path := toNibbles(key)
+	for {
+		switch node := n.(type) {
+		case nil:
+			return nil, false
+		case *trieLeaf:
+			if !bytes.Equal(node.path, path) {
+				return nil, false
+			}
+			return node.value, true
+		case *trieExtension:
+			if !bytes.HasPrefix(path, node.path) {
+				return nil, false
+			}
+			path = path[len(node.path):]
+			n = node.child
+		case *trieBranch:
+			if len(path) == 0 {
+				return node.value, node.hasValue
+			}
+			n = node.children[path[0]]
+			path = path[1:]
+		}
+	}
+}
+
+func (t *Trie) Put(key, value []byte) *Trie {
+	return &Trie{trieInsert(t.root, toNibbles(key), value)}
+}
+
+func (t *Trie) Delete(key []byte) *Trie {
+	root, changed := trieDelete(t.root, toNibbles(key))
+	if !changed {
+		return t
+	}
+	return &Trie{root}
+}
+
+// Prove returns the encoded nodes on the path from the root to key. The
+// proof shows either the value of key or that key is not in the trie.
+func (t *Trie) Prove(key []byte) [][]byte {
+	var proof [][]byte
+	n := t.root
+	path := toNibbles(key)
+	for n != nil {
+		proof = append(proof, n.encode())
+		switch node := n.(type) {
+		case *trieLeaf:
+			return proof
+		case *trieExtension:
+			if !bytes.HasPrefix(path, node.path) {
+				return proof
+			}
+			path = path[len(node.path):]
+			n = node.child
+		case *trieBranch:
+			if len(path) == 0 {
+				return proof
+			}
+			n = node.children[path[0]]
+			path = path[1:]
+		}
+	}
+	return proof
+}
+
+// VerifyTrieProof checks a proof generated by Trie.Prove against a root
+// hash. It returns the value of key, or false if the proof shows key is not
+// in the trie.
+func VerifyTrieProof(root [32]byte, key []byte, proof [][]byte) ([]byte, bool, error) {
+	if root == emptyTrieRoot && len(proof) == 0 {
+		return nil, false, nil
+	}
+
+	expected := root
+	path := toNibbles(key)
+	for i, encoded := range proof {
+		if sha256.Sum256(encoded) != expected {
+			return nil, false, errors.New("Invalid trie proof: hash mismatch")
+		}
+		last := i == len(proof)-1
+
+		n, children, err := decodeTrieNode(encoded)
+		if err != nil {
+			return nil, false, err
+		}
+		switch node := n.(type) {
+		case *trieLeaf:
+			if !last {
+				return nil, false, errors.New("Invalid trie proof: nodes after leaf")
+			}
+			if !bytes.Equal(node.path, path) {
+				return nil, false, nil
+			}
+			return node.value, true, nil
+		case *trieExtension:
+			if !bytes.HasPrefix(path, node.path) {
+				if !last {
+					return nil, false, errors.New("Invalid trie proof: nodes after divergence")
+				}
+				return nil, false, nil
+			}
+			path = path[len(node.path):]
+			expected = children[0]
+		case *trieBranch:
+			if len(path) == 0 {
+				if !last {
+					return nil, false, errors.New("Invalid trie proof: nodes after key")
+				}
+				return node.value, node.hasValue, nil
+			}
+			expected = children[path[0]]
+			path = path[1:]
+			if expected == [32]byte{} {
+				if !last {
+					return nil, false, errors.New("Invalid trie proof: nodes after divergence")
+				}
+				return nil, false, nil
+			}
+		}
+	}
+
+	return nil, false, errors.New("Invalid trie proof: incomplete path")
+}
+
+// decodeTrieNode decodes a node and the hashes of its children. Children are
+// not resolved, so the returned extensions and branches are only partially
+// filled.
+func decodeTrieNode(data []byte) (trieNode, [][32]byte, error) {
+	invalid := errors.New("Invalid trie proof: malformed node")
+	if len(data) == 0 {
+		return nil, nil, invalid
+	}
+
+	rest := data[1:]
+	switch data[0] {
+	case trieLeafType:
+		path, rest, ok := readBytes(rest)
+		if !ok {
+			return nil, nil, invalid
+		}
+		value, rest, ok := readBytes(rest)
+		if !ok || len(rest) != 0 {
+			return nil, nil, invalid
+		}
+		return &trieLeaf{path: path, value: value}, nil, nil
+	case trieExtensionType:
+		path, rest, ok := readBytes(rest)
+		if !ok || len(rest) != 32 {
+			return nil, nil, invalid
+		}
+		var child [32]byte
+		copy(child[:], rest)
+		return &trieExtension{path: path}, [][32]byte{child}, nil
+	case trieBranchType:
+		if len(rest) < 16*32+1 {
+			return nil, nil, invalid
+		}
+		children := make([][32]byte, 16)
+		for i := range children {
+			copy(children[i][:], rest[i*32:])
+		}
+		rest = rest[16*32:]
+		node := &trieBranch{hasValue: rest[0] == 1}
+		rest = rest[1:]
+		if node.hasValue {
+			value, tail, ok := readBytes(rest)
+			if !ok {
+				return nil, nil, invalid
+			}
+			node.value, rest = value, tail
+		}
+		if len(rest) != 0 {
+			return nil, nil, invalid
+		}
+		return node, children, nil
+	}
+
+	return nil, nil, invalid
+}
+
+func trieInsert(n trieNode, path, value []byte) trieNode {
+	switch node := n.(type) {
+	case nil:
+		return newTrieLeaf(path, value)
+	case *trieLeaf:
+		p := commonPrefix(node.path, path)
+		if p == len(node.path) && p == len(path) {
+			return newTrieLeaf(path, value)
+		}
+
+		var children [16]trieNode
+		var branchValue []byte
+		hasValue := false
+		if p == len(node.path) {
+			branchValue, hasValue = node.value, true
+		} else {
+			children[node.path[p]] = newTrieLeaf(node.path[p+1:], node.value)
+		}
+		if p == len(path) {
+			branchValue, hasValue = value, true
+		} else {
+			children[path[p]] = newTrieLeaf(path[p+1:], value)
+		}
+		return withExtension(path[:p], newTrieBranch(children, branchValue, hasValue))
+	case *trieExtension:
+		p := commonPrefix(node.path, path)
+		if p == len(node.path) {
+			return newTrieExtension(node.path, trieInsert(node.child, path[p:], value))
+		}
+
+		var children [16]trieNode
+		var branchValue []byte
+		hasValue := false
+		children[node.path[p]] = withExtension(node.path[p+1:], node.child)
+		if p == len(path) {
+			branchValue, hasValue = value, true
+		} else {
+			children[path[p]] = newTrieLeaf(path[p+1:], value)
+		}
+		return withExtension(path[:p], newTrieBranch(children, branchValue, hasValue))
+	case *trieBranch:
+		if len(path) == 0 {
+			return newTrieBranch(node.children, value, true)
+		}
+		children := node.children
+		children[path[0]] = trieInsert(children[path[0]], path[1:], value)
+		return newTrieBranch(children, node.value, node.hasValue)
+	}
+
+	panic("unknown trie node")
+}
+
+func trieDelete(n trieNode, path []byte) (trieNode, bool) {
+	switch node := n.(type) {
+	case nil:
+		return nil, false
+	case *trieLeaf:
+		if !bytes.Equal(node.path, path) {
+			return n, false
+		}
+		return nil, true
+	case *trieExtension:
+		if !bytes.HasPrefix(path, node.path) {
+			return n, false
+		}
+		child, changed := trieDelete(node.child, path[len(node.path):])
+		if !changed {
+			return n, false
+		}
+		return withExtension(node.path, child), true
+	case *trieBranch:
+		children := node.children
+		value, hasValue := node.value, node.hasValue
+		if len(path) == 0 {
+			if !hasValue {
+				return n, false
+			}
+			value, hasValue = nil, false
+		} else {
+			child, changed := trieDelete(children[path[0]], path[1:])
+			if !changed {
+				return n, false
+			}
+			children[path[0]] = child
+		}
+		return collapseBranch(children, value, hasValue), true
+	}
+
+	panic("unknown trie node")
+}
+
+// withExtension prefixes a node with path, merging it into the node when
+// possible so the trie keeps a canonical shape
+func withExtension(path []byte, n trieNode) trieNode {
+	if len(path) == 0 || n == nil {
+		return n
+	}
+
+	switch node := n.(type) {
+	case *trieLeaf:
+		return newTrieLeaf(concatNibbles(path, node.path), node.value)
+	case *trieExtension:
+		return newTrieExtension(concatNibbles(path, node.path), node.child)
+	}
+	return newTrieExtension(path, n)
+}
+
+// collapseBranch replaces a branch left with a single entry by an
+// equivalent leaf or extension
+func collapseBranch(children [16]trieNode, value []byte, hasValue bool) trieNode {
+	count := 0
+	last := -1
+	for i, child := range children {
+		if child != nil {
+			count++
+			last = i
+		}
+	}
+
+	switch {
+	case count == 0 && !hasValue:
+		return nil
+	case count == 0:
+		return newTrieLeaf([]byte{}, value)
+	case count == 1 && !hasValue:
+		return withExtension([]byte{byte(last)}, children[last])
+	}
+	return newTrieBranch(children, value, hasValue)
+}
+
+func toNibbles(key []byte) []byte {
+	nibbles := make([]byte, len(key)*2)
+	for i, b := range key {
+		nibbles[i*2] = b >> 4
+		nibbles[i*2+1] = b & 0x0f
+	}
+	return nibbles
+}
+
+func concatNibbles(a, b []byte) []byte {
+	path := make([]byte, 0, len(a)+len(b))
+	path = append(path, a...)
+	return append(path, b...)
+}
+
+func commonPrefix(a, b []byte) int {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	return i
+}
+
+func appendBytes(buf, data []byte) []byte {
+	var length [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(length[:], uint64(len(data)))
+	buf = append(buf, length[:n]...)
+	return append(buf, data...)
+}
+
+func readBytes(buf []byte) ([]byte, []byte, bool) {
+	length, n := binary.Uvarint(buf)
+	if n <= 0 || uint64(len(buf)-n) < length {
+		return nil, nil, false
+	}
+	end := n + int(length)
+	return buf[n:end], buf[end:], true
+}
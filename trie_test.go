@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestTrie(t *testing.T) {
+	Convey("A trie", t, func() {
+		trie := NewTrie()
+
+		Convey("is empty when created", func() {
+			So(trie.Hash(), ShouldEqual, emptyTrieRoot)
+			_, ok := trie.Get([]byte("foo"))
+			So(ok, ShouldBeFalse)
+		})
+
+		Convey("can store values of keys sharing prefixes", func() {
+			keys := []string{"foo", "foobar", "fo", "bar", "", "foz"}
+			for i, k := range keys {
+				trie = trie.Put([]byte(k), []byte(fmt.Sprint(i)))
+			}
+
+			for i, k := range keys {
+				v, ok := trie.Get([]byte(k))
+				So(ok, ShouldBeTrue)
+				So(string(v), ShouldEqual, fmt.Sprint(i))
+			}
+			_, ok := trie.Get([]byte("f"))
+			So(ok, ShouldBeFalse)
+
+			Convey("is not changed by later updates", func() {
+				root := trie.Hash()
+				updated := trie.Put([]byte("foo"), []byte("new")).Delete([]byte("bar"))
+
+				So(updated.Hash(), ShouldNotEqual, root)
+				So(trie.Hash(), ShouldEqual, root)
+				v, ok := trie.Get([]byte("foo"))
+				So(ok, ShouldBeTrue)
+				So(string(v), ShouldEqual, "0")
+			})
+
+			Convey("has the same root hash regardless of insertion order", func() {
+				other := NewTrie()
+				for i := len(keys) - 1; i >= 0; i-- {
+					other = other.Put([]byte(keys[i]), []byte(fmt.Sprint(i)))
+				}
+				So(other.Hash(), ShouldEqual, trie.Hash())
+			})
+
+			Convey("has the same root hash as a trie which never had deleted keys", func() {
+				deleted := trie.Delete([]byte("foobar")).Delete([]byte("fo")).Delete([]byte("missing"))
+
+				other := NewTrie()
+				for i, k := range keys {
+					if k != "foobar" && k != "fo" {
+						other = other.Put([]byte(k), []byte(fmt.Sprint(i)))
+					}
+				}
+				So(deleted.Hash(), ShouldEqual, other.Hash())
+
+				for _, k := range keys {
+					deleted = deleted.Delete([]byte(k))
+				}
+				So(deleted.Hash(), ShouldEqual, emptyTrieRoot)
+			})
+
+			Convey("can prove the value of a key", func() {
+				for i, k := range keys {
+					v, ok, err := VerifyTrieProof(trie.Hash(), []byte(k), trie.Prove([]byte(k)))
+					So(err, ShouldBeNil)
+					So(ok, ShouldBeTrue)
+					So(string(v), ShouldEqual, fmt.Sprint(i))
+				}
+			})
+
+			Convey("can prove a key is absent", func() {
+				for _, k := range []string{"f", "foob", "food", "baz", "z"} {
+					_, ok, err := VerifyTrieProof(trie.Hash(), []byte(k), trie.Prove([]byte(k)))
+					So(err, ShouldBeNil)
+					So(ok, ShouldBeFalse)
+				}
+			})
+
+			Convey("rejects a proof against another root", func() {
+				other := trie.Put([]byte("foo"), []byte("forged"))
+				_, _, err := VerifyTrieProof(trie.Hash(), []byte("foo"), other.Prove([]byte("foo")))
+				So(err, ShouldNotBeNil)
+			})
+		})
+	})
+}